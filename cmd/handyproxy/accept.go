@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	maxConnectionsModeBlock = "block"
+	maxConnectionsModeClose = "close"
+)
+
+// connectionSlots caps the number of connections handled at the same time. A
+// nil value means there is no cap.
+type connectionSlots chan struct{}
+
+func newConnectionSlots(max int) connectionSlots {
+	if max <= 0 {
+		return nil
+	}
+	return make(connectionSlots, max)
+}
+
+// Acquire waits until a slot is free and takes it.
+func (slots connectionSlots) Acquire() {
+	if slots != nil {
+		slots <- struct{}{}
+	}
+}
+
+// TryAcquire takes a slot if one is free, without waiting.
+func (slots connectionSlots) TryAcquire() bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (slots connectionSlots) Release() {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// Connections beyond the limit arrive in floods, when the proxy is already
+// overloaded
+var connectionLimitLog = newRateLimitedLogger(0.1, 5)
+
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// acceptBackoff tracks the delay to apply after Accept failed because the
+// process or the system ran out of file descriptors. Retrying immediately would
+// just spin until some connection is closed.
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+// Wait sleeps before the next Accept, if err calls for it.
+func (backoff *acceptBackoff) Wait(err error) {
+	if !errors.Is(err, syscall.EMFILE) && !errors.Is(err, syscall.ENFILE) {
+		return
+	}
+	backoff.delay = min(max(2*backoff.delay, minAcceptDelay), maxAcceptDelay)
+	log.Printf("out of file descriptors, retrying to accept connections in %v", backoff.delay)
+	time.Sleep(backoff.delay)
+}
+
+func (backoff *acceptBackoff) Reset() {
+	backoff.delay = 0
+}
+
+// acceptConnections accepts connections from ln and passes them to handler,
+// honouring the connection cap, until ln is closed.
+func acceptConnections(ln net.Listener, slots connectionSlots, mode string, handler func(*net.TCPConn)) {
+	var backoff acceptBackoff
+	for {
+		if mode == maxConnectionsModeBlock {
+			slots.Acquire()
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			if mode == maxConnectionsModeBlock {
+				slots.Release()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println(err)
+			backoff.Wait(err)
+			continue
+		}
+		backoff.Reset()
+		if mode == maxConnectionsModeClose && !slots.TryAcquire() {
+			connectionLimitLog.Printf("connection limit reached, closing connection from %s", conn.RemoteAddr().String())
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			defer slots.Release()
+			handler(conn.(*net.TCPConn))
+		}()
+	}
+}
+
+func validateMaxConnectionsMode(mode string) error {
+	switch mode {
+	case maxConnectionsModeBlock, maxConnectionsModeClose:
+		return nil
+	}
+	return fmt.Errorf("invalid -max-connections-mode %q, must be %q or %q",
+		mode, maxConnectionsModeBlock, maxConnectionsModeClose)
+}
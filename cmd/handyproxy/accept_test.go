@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionSlots(t *testing.T) {
+	var unlimited connectionSlots = newConnectionSlots(0)
+	require.Nil(t, unlimited)
+	for range 10 {
+		require.True(t, unlimited.TryAcquire())
+	}
+	unlimited.Acquire()
+	unlimited.Release()
+
+	slots := newConnectionSlots(2)
+	require.True(t, slots.TryAcquire())
+	slots.Acquire()
+	require.False(t, slots.TryAcquire())
+	slots.Release()
+	require.True(t, slots.TryAcquire())
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	var backoff acceptBackoff
+	backoff.Wait(fmt.Errorf("accept: %w", syscall.ECONNABORTED))
+	require.Zero(t, backoff.delay)
+	backoff.Wait(fmt.Errorf("accept: %w", syscall.EMFILE))
+	require.Equal(t, minAcceptDelay, backoff.delay)
+	backoff.Wait(fmt.Errorf("accept: %w", syscall.ENFILE))
+	require.Equal(t, 2*minAcceptDelay, backoff.delay)
+	backoff.delay = maxAcceptDelay * 3 / 4
+	start := time.Now()
+	backoff.Wait(syscall.EMFILE)
+	require.Equal(t, maxAcceptDelay, backoff.delay)
+	require.GreaterOrEqual(t, time.Since(start), maxAcceptDelay)
+	backoff.Reset()
+	require.Zero(t, backoff.delay)
+}
+
+func TestAcceptConnections(t *testing.T) {
+	for _, mode := range []string{maxConnectionsModeBlock, maxConnectionsModeClose} {
+		t.Run(mode, func(t *testing.T) {
+			ln, err := net.Listen("tcp4", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer ln.Close()
+
+			handled := make(chan struct{}, 2)
+			release := make(chan struct{})
+			go acceptConnections(ln, newConnectionSlots(1), mode, func(conn *net.TCPConn) {
+				defer conn.Close()
+				handled <- struct{}{}
+				<-release
+			})
+
+			first, err := net.Dial("tcp4", ln.Addr().String())
+			require.NoError(t, err)
+			defer first.Close()
+			<-handled
+
+			// The only slot is taken
+			second, err := net.Dial("tcp4", ln.Addr().String())
+			require.NoError(t, err)
+			defer second.Close()
+			if mode == maxConnectionsModeClose {
+				require.NoError(t, second.SetReadDeadline(time.Now().Add(5*time.Second)))
+				_, err = second.Read(make([]byte, 1))
+				require.ErrorIs(t, err, io.EOF)
+			} else {
+				select {
+				case <-handled:
+					require.FailNow(t, "connection handled beyond the limit")
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+
+			// Once the first connection is done, the next ones are handled
+			close(release)
+			if mode == maxConnectionsModeBlock {
+				<-handled
+			} else {
+				third, err := net.Dial("tcp4", ln.Addr().String())
+				require.NoError(t, err)
+				defer third.Close()
+				<-handled
+			}
+		})
+	}
+}
+
+func TestValidateMaxConnectionsMode(t *testing.T) {
+	require.NoError(t, validateMaxConnectionsMode(maxConnectionsModeBlock))
+	require.NoError(t, validateMaxConnectionsMode(maxConnectionsModeClose))
+	require.Error(t, validateMaxConnectionsMode("drop"))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/binary-manu/handyproxy/internal/hostname"
+)
+
+const (
+	accessActionAllow  = "allow"
+	accessActionReject = "reject"
+)
+
+// accessRule allows or rejects the connections which match all of its
+// conditions. Each condition lists alternatives, any of which may match, and
+// conditions which list nothing match every connection.
+type accessRule struct {
+	Spec    string
+	Allow   bool
+	Clients []netip.Prefix
+	Domains []string
+	JA3     []string
+	// JA4 fingerprints may contain path.Match wildcards, so that their
+	// sections can be matched separately
+	JA4 []string
+}
+
+func (rule *accessRule) matches(client netip.Addr, host string, metadata *hostname.Metadata) bool {
+	if len(rule.Clients) > 0 && !slices.ContainsFunc(rule.Clients, func(prefix netip.Prefix) bool { return prefix.Contains(client) }) {
+		return false
+	}
+	if len(rule.Domains) > 0 && !matchDomainPatterns(host, rule.Domains) {
+		return false
+	}
+	if metadata == nil {
+		metadata = &hostname.Metadata{}
+	}
+	if len(rule.JA3) > 0 && !slices.ContainsFunc(rule.JA3, func(ja3 string) bool { return ja3 == metadata.JA3 }) {
+		return false
+	}
+	if len(rule.JA4) > 0 && !slices.ContainsFunc(rule.JA4, func(pattern string) bool {
+		matched, _ := path.Match(pattern, metadata.JA4)
+		return matched && metadata.JA4 != ""
+	}) {
+		return false
+	}
+	return true
+}
+
+// accessRules implements flag.Value, so that -access-rule can be repeated.
+// Each value has the form ACTION:key=value,... Alternative values for a key
+// are separated by semicolons, and @FILE reads them from FILE, one per line.
+type accessRules []*accessRule
+
+func (rules *accessRules) String() string {
+	if rules == nil {
+		return ""
+	}
+	var s []string
+	for _, rule := range *rules {
+		s = append(s, rule.Spec)
+	}
+	return strings.Join(s, " ")
+}
+
+func (rules *accessRules) Set(s string) error {
+	action, spec, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("%q does not have the form ACTION:key=value,...", s)
+	}
+	rule := &accessRule{Spec: s}
+	switch action {
+	case accessActionAllow:
+		rule.Allow = true
+	case accessActionReject:
+	default:
+		return fmt.Errorf("invalid access rule action %q, must be %q or %q", action, accessActionAllow, accessActionReject)
+	}
+
+	values, err := parseKeyValues(spec, "client", "host", "ja3", "ja4")
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		alternatives, err := parseAlternatives(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		for _, alternative := range alternatives {
+			switch key {
+			case "client":
+				var prefix netip.Prefix
+				if strings.Contains(alternative, "/") {
+					prefix, err = netip.ParsePrefix(alternative)
+				} else {
+					var addr netip.Addr
+					addr, err = netip.ParseAddr(alternative)
+					prefix = netip.PrefixFrom(addr, addr.BitLen())
+				}
+				rule.Clients = append(rule.Clients, prefix.Masked())
+			case "host":
+				rule.Domains = append(rule.Domains, parseDomainPattern(alternative))
+			case "ja3":
+				rule.JA3 = append(rule.JA3, strings.ToLower(alternative))
+			case "ja4":
+				_, err = path.Match(alternative, "")
+				rule.JA4 = append(rule.JA4, alternative)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+		}
+	}
+
+	*rules = append(*rules, rule)
+	return nil
+}
+
+// parseAlternatives splits a list of values separated by semicolons, replacing
+// @FILE with the lines of FILE. Empty lines and lines starting with # are
+// ignored.
+func parseAlternatives(s string) ([]string, error) {
+	var alternatives []string
+	for _, value := range strings.Split(s, ";") {
+		value = strings.TrimSpace(value)
+		fileName, isFile := strings.CutPrefix(value, "@")
+		if !isFile {
+			if value != "" {
+				alternatives = append(alternatives, value)
+			}
+			continue
+		}
+		file, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				alternatives = append(alternatives, line)
+			}
+		}
+		err = scanner.Err()
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", fileName, err)
+		}
+	}
+	if len(alternatives) == 0 {
+		return nil, fmt.Errorf("no values in %q", s)
+	}
+	return alternatives, nil
+}
+
+type accessDeniedError struct {
+	Rule string
+}
+
+func (e *accessDeniedError) Error() string {
+	return fmt.Sprintf("denied by access rule %q", e.Rule)
+}
+
+// accessList applies accessRules in order: the first rule matching a
+// connection decides its fate, and connections matching no rule are allowed.
+// A nil accessList allows everything.
+type accessList struct {
+	rules accessRules
+}
+
+func newAccessList(rules accessRules) *accessList {
+	if len(rules) == 0 {
+		return nil
+	}
+	return &accessList{rules: rules}
+}
+
+// Check tells whether a client may connect to host. metadata is nil if
+// hostname sniffing did not succeed, in which case fingerprint conditions
+// never match.
+func (list *accessList) Check(client netip.Addr, host string, metadata *hostname.Metadata) error {
+	if list == nil {
+		return nil
+	}
+	for _, rule := range list.rules {
+		if rule.matches(client, host, metadata) {
+			if rule.Allow {
+				return nil
+			}
+			return &accessDeniedError{rule.Spec}
+		}
+	}
+	return nil
+}
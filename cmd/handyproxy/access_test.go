@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/binary-manu/handyproxy/internal/hostname"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testJA3 = "e7d705a3286e19ea42f587b344ee6865"
+	testJA4 = "t10d070600_c50f5591e341_1a3805c3aa63"
+)
+
+func TestAccessRules(t *testing.T) {
+	badFingerprints := filepath.Join(t.TempDir(), "bad-ja3.txt")
+	require.NoError(t, os.WriteFile(badFingerprints, []byte("# Known bad\n\n"+testJA3+"\n"), 0o644))
+
+	tls10Client := &hostname.Metadata{HostName: "www.example.com", JA3: testJA3, JA4: testJA4}
+	tls13Client := &hostname.Metadata{HostName: "www.example.com", JA3: "0cce74b0d9b7f8528fb2181588d23793",
+		JA4: "t13d1516h2_8daaf6152771_e5627efa2ab1"}
+
+	tests := []struct {
+		Description string
+		Rules       []string
+		Client      string
+		Host        string
+		Metadata    *hostname.Metadata
+		Denied      bool
+	}{
+		{"No rules", nil, "192.0.2.1", "www.example.com", tls10Client, false},
+		{"JA3 from file", []string{"reject:ja3=@" + badFingerprints}, "192.0.2.1", "www.example.com", tls10Client, true},
+		{"JA3 not in file", []string{"reject:ja3=@" + badFingerprints}, "192.0.2.1", "www.example.com", tls13Client, false},
+		{"JA4 wildcard", []string{"reject:ja4=t10*;t11*"}, "192.0.2.1", "www.example.com", tls10Client, true},
+		{"JA4 wildcard, no match", []string{"reject:ja4=t10*;t11*"}, "192.0.2.1", "www.example.com", tls13Client, false},
+		{"No fingerprint", []string{"reject:ja4=*"}, "192.0.2.1", "www.example.com", nil, false},
+		{"Allow before reject", []string{"allow:client=192.0.2.0/24", "reject:ja4=t10*"},
+			"192.0.2.1", "www.example.com", tls10Client, false},
+		{"All conditions must match", []string{"reject:client=198.51.100.0/24,ja4=t10*"},
+			"192.0.2.1", "www.example.com", tls10Client, false},
+		{"Subdomain", []string{"reject:host=example.com"}, "192.0.2.1", "www.example.com", nil, true},
+		{"Other domain", []string{"reject:host=example.com"}, "192.0.2.1", "www.example.org", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			var rules accessRules
+			for _, rule := range test.Rules {
+				require.NoError(t, rules.Set(rule))
+			}
+			err := newAccessList(rules).Check(netip.MustParseAddr(test.Client), test.Host, test.Metadata)
+			if test.Denied {
+				require.ErrorAs(t, err, new(*accessDeniedError))
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestInvalidAccessRules(t *testing.T) {
+	for _, rule := range []string{
+		"ja3=" + testJA3,
+		"deny:ja3=" + testJA3,
+		"reject:sni=www.example.com",
+		"reject:client=192.0.2.0/33",
+		"reject:ja4=[",
+		"reject:ja3=",
+		"reject:ja3=@/nonexistent",
+	} {
+		t.Run(rule, func(t *testing.T) {
+			var rules accessRules
+			require.Error(t, rules.Set(rule))
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/binary-manu/handyproxy/internal/ratelimit"
+)
+
+// parseByteSize parses a number of bytes, with an optional k, M or G suffix
+// (powers of 1024).
+func parseByteSize(s string) (int64, error) {
+	size := s
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative size %d", n)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %s is too large", size)
+	}
+	return n * multiplier, nil
+}
+
+// bandwidthLimit is a pair of rates, in bytes per second, for traffic sent by
+// the client (up) and received by it (down). A zero rate means no limit. It
+// implements flag.Value, parsing values like up=1M,down=512k,burst=64k.
+type bandwidthLimit struct {
+	Up, Down int64
+	Burst    int64
+}
+
+func (limit *bandwidthLimit) String() string {
+	if limit == nil || limit.Up == 0 && limit.Down == 0 {
+		return ""
+	}
+	return fmt.Sprintf("up=%d,down=%d,burst=%d", limit.Up, limit.Down, limit.Burst)
+}
+
+func (limit *bandwidthLimit) Set(s string) error {
+	values, err := parseKeyValues(s, "up", "down", "burst")
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		var size int64
+		if size, err = parseByteSize(value); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		switch key {
+		case "up":
+			limit.Up = size
+		case "down":
+			limit.Down = size
+		case "burst":
+			limit.Burst = size
+		}
+	}
+	return nil
+}
+
+func (limit *bandwidthLimit) enabled() bool {
+	return limit.Up > 0 || limit.Down > 0
+}
+
+func newBandwidthBucket(rate, burst int64) *ratelimit.TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		// One second worth of traffic
+		burst = rate
+	}
+	return ratelimit.NewTokenBucket(float64(rate), int(burst))
+}
+
+// bandwidthBuckets holds the buckets enforcing a bandwidthLimit. Either can be
+// nil.
+type bandwidthBuckets struct {
+	Up, Down *ratelimit.TokenBucket
+}
+
+func newBandwidthBuckets(limit *bandwidthLimit) bandwidthBuckets {
+	return bandwidthBuckets{
+		Up:   newBandwidthBucket(limit.Up, limit.Burst),
+		Down: newBandwidthBucket(limit.Down, limit.Burst),
+	}
+}
+
+// domainBandwidthGroup is a set of destination domains sharing a single
+// bandwidth limit. A pattern matches the domain itself and all its
+// subdomains, while * matches every destination.
+type domainBandwidthGroup struct {
+	Patterns []string
+	Limit    bandwidthLimit
+	buckets  bandwidthBuckets
+}
+
+func (group *domainBandwidthGroup) matches(host string) bool {
+	return matchDomainPatterns(host, group.Patterns)
+}
+
+// matchDomainPatterns tells whether host is one of the domains given by
+// patterns, or a subdomain of one of them. Patterns must have been normalized
+// by parseDomainPattern.
+func matchDomainPatterns(host string, patterns []string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, pattern := range patterns {
+		if pattern == "*" || host == pattern || strings.HasSuffix(host, "."+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDomainPattern(pattern string) string {
+	pattern = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(pattern)), ".")
+	return strings.TrimPrefix(pattern, "*.")
+}
+
+// domainBandwidthGroups implements flag.Value, so that -bandwidth-domain can
+// be repeated. Each value has the form PATTERN[;PATTERN...]:up=...,down=...
+type domainBandwidthGroups []*domainBandwidthGroup
+
+func (groups *domainBandwidthGroups) String() string {
+	if groups == nil {
+		return ""
+	}
+	var s []string
+	for _, group := range *groups {
+		s = append(s, strings.Join(group.Patterns, ";"))
+	}
+	return strings.Join(s, " ")
+}
+
+func (groups *domainBandwidthGroups) Set(s string) error {
+	patterns, spec, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("%q does not have the form PATTERN[;PATTERN...]:key=value,...", s)
+	}
+	group := &domainBandwidthGroup{}
+	for _, pattern := range strings.Split(patterns, ";") {
+		if pattern = parseDomainPattern(pattern); pattern != "" {
+			group.Patterns = append(group.Patterns, pattern)
+		}
+	}
+	if len(group.Patterns) == 0 {
+		return fmt.Errorf("no domain patterns in %q", s)
+	}
+	if err := group.Limit.Set(spec); err != nil {
+		return err
+	}
+	group.buckets = newBandwidthBuckets(&group.Limit)
+	*groups = append(*groups, group)
+	return nil
+}
+
+type clientBandwidth struct {
+	refs    int
+	buckets bandwidthBuckets
+}
+
+// bandwidthShaper hands out the buckets limiting each tunnel. A connection is
+// subject to its own limit, to the limit of its client address (shared by all
+// connections from that address) and to the limit of the first domain group
+// its destination matches. A nil bandwidthShaper does not limit anything.
+type bandwidthShaper struct {
+	connLimit   bandwidthLimit
+	clientLimit bandwidthLimit
+	domains     domainBandwidthGroups
+	mu          sync.Mutex
+	clients     map[netip.Addr]*clientBandwidth
+}
+
+func newBandwidthShaper(opts *options) *bandwidthShaper {
+	if !opts.BandwidthConn.enabled() && !opts.BandwidthClient.enabled() && len(*opts.BandwidthDomains) == 0 {
+		return nil
+	}
+	return &bandwidthShaper{
+		connLimit:   *opts.BandwidthConn,
+		clientLimit: *opts.BandwidthClient,
+		domains:     *opts.BandwidthDomains,
+		clients:     make(map[netip.Addr]*clientBandwidth),
+	}
+}
+
+// Acquire returns the buckets limiting traffic in each direction for a
+// connection from client to host. release must be called once the connection
+// is closed.
+func (shaper *bandwidthShaper) Acquire(client netip.Addr, host string) (up, down []*ratelimit.TokenBucket, release func()) {
+	if shaper == nil {
+		return nil, nil, func() {}
+	}
+
+	add := func(buckets bandwidthBuckets) {
+		if buckets.Up != nil {
+			up = append(up, buckets.Up)
+		}
+		if buckets.Down != nil {
+			down = append(down, buckets.Down)
+		}
+	}
+
+	add(newBandwidthBuckets(&shaper.connLimit))
+	for _, group := range shaper.domains {
+		if group.matches(host) {
+			add(group.buckets)
+			break
+		}
+	}
+
+	release = func() {}
+	if shaper.clientLimit.enabled() {
+		client = client.Unmap()
+		shaper.mu.Lock()
+		shared := shaper.clients[client]
+		if shared == nil {
+			shared = &clientBandwidth{buckets: newBandwidthBuckets(&shaper.clientLimit)}
+			shaper.clients[client] = shared
+		}
+		shared.refs++
+		shaper.mu.Unlock()
+		add(shared.buckets)
+
+		release = func() {
+			shaper.mu.Lock()
+			defer shaper.mu.Unlock()
+			if shared.refs--; shared.refs == 0 {
+				delete(shaper.clients, client)
+			}
+		}
+	}
+	return up, down, release
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		Value    string
+		Expected int64
+		Valid    bool
+	}{
+		{"0", 0, true},
+		{"1500", 1500, true},
+		{"64k", 64 << 10, true},
+		{"64K", 64 << 10, true},
+		{"2M", 2 << 20, true},
+		{"3G", 3 << 30, true},
+		{"8589934591G", 8589934591 << 30, true},
+		{"8589934592G", 0, false},
+		{"9000000000G", 0, false},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"9223372036854775808", 0, false},
+		{"-1k", 0, false},
+		{"1.5M", 0, false},
+		{"1T", 0, false},
+		{"k", 0, false},
+		{"", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Value, func(t *testing.T) {
+			size, err := parseByteSize(test.Value)
+			if test.Valid {
+				require.NoError(t, err)
+				require.Equal(t, test.Expected, size)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestBandwidthLimit(t *testing.T) {
+	var limit bandwidthLimit
+	require.False(t, limit.enabled())
+	require.NoError(t, limit.Set("up=1M,down=512k,burst=64k"))
+	require.Equal(t, bandwidthLimit{Up: 1 << 20, Down: 512 << 10, Burst: 64 << 10}, limit)
+	require.True(t, limit.enabled())
+
+	for _, value := range []string{"up=1M,sideways=1k", "up=fast", "down=-1", "burst"} {
+		require.Error(t, new(bandwidthLimit).Set(value), value)
+	}
+}
+
+func TestDomainBandwidthGroups(t *testing.T) {
+	var groups domainBandwidthGroups
+	require.NoError(t, groups.Set("*.Example.com.;example.org:down=1M"))
+	require.Equal(t, []string{"example.com", "example.org"}, groups[0].Patterns)
+	require.NotNil(t, groups[0].buckets.Down)
+	require.Nil(t, groups[0].buckets.Up)
+	require.True(t, groups[0].matches("www.example.com"))
+	require.True(t, groups[0].matches("EXAMPLE.ORG."))
+	require.False(t, groups[0].matches("notexample.com"))
+
+	require.Error(t, groups.Set("example.com"))
+	require.Error(t, groups.Set(";:down=1M"))
+	require.Error(t, groups.Set("example.com:down=lots"))
+}
+
+func newTestBandwidthShaper(t *testing.T, args ...string) *bandwidthShaper {
+	flags := flag.NewFlagSet("test", flag.PanicOnError)
+	opts := newOptions(flags)
+	require.NoError(t, flags.Parse(args))
+	return newBandwidthShaper(opts)
+}
+
+func TestBandwidthShaper(t *testing.T) {
+	require.Nil(t, newTestBandwidthShaper(t))
+
+	shaper := newTestBandwidthShaper(t,
+		"-bandwidth-conn", "up=1M",
+		"-bandwidth-client", "up=2M,down=2M",
+		"-bandwidth-domain", "example.com:down=1M",
+		"-bandwidth-domain", "*:down=4M",
+	)
+	client := netip.MustParseAddr("192.0.2.1")
+
+	up1, down1, release1 := shaper.Acquire(client, "www.example.com")
+	// Connection and client limits up, domain and client limits down
+	require.Len(t, up1, 2)
+	require.Len(t, down1, 2)
+	up2, down2, release2 := shaper.Acquire(netip.MustParseAddr("::ffff:192.0.2.1"), "www.example.net")
+	require.Len(t, up2, 2)
+	require.Len(t, down2, 2)
+
+	// Each connection has its own bucket, the client bucket is shared
+	require.NotSame(t, up1[0], up2[0])
+	require.Same(t, up1[1], up2[1])
+	// Only the first matching domain group applies
+	require.NotSame(t, down1[0], down2[0])
+	require.Same(t, down1[1], down2[1])
+
+	_, down3, release3 := shaper.Acquire(netip.MustParseAddr("192.0.2.2"), "www.example.com")
+	require.Same(t, down1[0], down3[0])
+	require.NotSame(t, down1[1], down3[1])
+	release3()
+
+	// Client buckets are dropped once all its connections are closed
+	release1()
+	require.Len(t, shaper.clients, 1)
+	release2()
+	require.Empty(t, shaper.clients)
+	up4, _, release4 := shaper.Acquire(client, "www.example.com")
+	require.NotSame(t, up1[1], up4[1])
+	release4()
+}
+
+func TestNilBandwidthShaper(t *testing.T) {
+	var shaper *bandwidthShaper
+	up, down, release := shaper.Acquire(netip.MustParseAddr("192.0.2.1"), "www.example.com")
+	require.Nil(t, up)
+	require.Nil(t, down)
+	release()
+}
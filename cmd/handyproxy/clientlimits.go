@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/ratelimit"
+)
+
+const clientLimitSweepInterval = time.Minute
+
+// clientLimitRule sets the limits for clients whose address is within Prefix.
+// Zero values mean no limit.
+type clientLimitRule struct {
+	Prefix netip.Prefix
+	// If true, all clients within Prefix share the same counters, otherwise
+	// each client address gets its own.
+	SharedByPrefix    bool
+	MaxConnections    int
+	ConnectionRate    float64
+	ConnectionBurst   int
+	ConnectsPerMinute int
+}
+
+// clientLimitRules implements flag.Value, so that -client-limit can be
+// repeated. Each value has the form PREFIX:key=value,...
+type clientLimitRules []clientLimitRule
+
+func (rules *clientLimitRules) String() string {
+	if rules == nil {
+		return ""
+	}
+	var s []string
+	for _, rule := range *rules {
+		s = append(s, rule.Prefix.String())
+	}
+	return strings.Join(s, " ")
+}
+
+func (rules *clientLimitRules) Set(s string) error {
+	// IPv6 prefixes contain colons too, so look for the last one before "="
+	sep := strings.LastIndex(s[:max(strings.Index(s, "="), 0)], ":")
+	if sep < 0 {
+		return fmt.Errorf("%q does not have the form PREFIX:key=value,...", s)
+	}
+	prefixString, spec := s[:sep], s[sep+1:]
+
+	var rule clientLimitRule
+	var err error
+	if strings.Contains(prefixString, "/") {
+		rule.Prefix, err = netip.ParsePrefix(prefixString)
+	} else {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(prefixString)
+		rule.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if err != nil {
+		return fmt.Errorf("invalid client address or prefix %q: %w", prefixString, err)
+	}
+	rule.Prefix = rule.Prefix.Masked()
+
+	values, err := parseKeyValues(spec, "scope", "conns", "rate", "burst", "connects")
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		switch key {
+		case "scope":
+			switch value {
+			case "ip":
+				rule.SharedByPrefix = false
+			case "prefix":
+				rule.SharedByPrefix = true
+			default:
+				return fmt.Errorf("invalid scope %q, must be ip or prefix", value)
+			}
+		case "conns":
+			rule.MaxConnections, err = strconv.Atoi(value)
+		case "rate":
+			rule.ConnectionRate, err = strconv.ParseFloat(value, 64)
+		case "burst":
+			rule.ConnectionBurst, err = strconv.Atoi(value)
+		case "connects":
+			rule.ConnectsPerMinute, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+	}
+	if rule.ConnectionBurst <= 0 {
+		rule.ConnectionBurst = int(math.Ceil(rule.ConnectionRate))
+	}
+
+	*rules = append(*rules, rule)
+	return nil
+}
+
+type clientLimitError struct {
+	Client netip.Addr
+	Limit  string
+}
+
+func (e *clientLimitError) Error() string {
+	return fmt.Sprintf("client %s exceeded its %s limit", e.Client, e.Limit)
+}
+
+type clientState struct {
+	connections    int
+	connectionRate *ratelimit.TokenBucket
+	connectRate    *ratelimit.TokenBucket
+}
+
+func (state *clientState) idle() bool {
+	return state.connections == 0 &&
+		(state.connectionRate == nil || state.connectionRate.Full()) &&
+		(state.connectRate == nil || state.connectRate.Full())
+}
+
+// clientLimiter enforces clientLimitRules. For each client, the rule with the
+// longest matching prefix applies. A nil clientLimiter allows everything.
+type clientLimiter struct {
+	rules   []clientLimitRule
+	mu      sync.Mutex
+	clients map[string]*clientState
+}
+
+func newClientLimiter(rules clientLimitRules) *clientLimiter {
+	if len(rules) == 0 {
+		return nil
+	}
+	limiter := &clientLimiter{
+		rules:   slices.Clone(rules),
+		clients: make(map[string]*clientState),
+	}
+	slices.SortStableFunc(limiter.rules, func(a, b clientLimitRule) int {
+		return b.Prefix.Bits() - a.Prefix.Bits()
+	})
+	go func() {
+		for range time.Tick(clientLimitSweepInterval) {
+			limiter.sweep()
+		}
+	}()
+	return limiter
+}
+
+// state returns the counters for client, creating them if needed. It must be
+// called with the lock held.
+func (limiter *clientLimiter) state(client netip.Addr) (*clientLimitRule, *clientState) {
+	client = client.Unmap()
+	for i := range limiter.rules {
+		rule := &limiter.rules[i]
+		if !rule.Prefix.Contains(client) {
+			continue
+		}
+		key := client.String()
+		if rule.SharedByPrefix {
+			key = rule.Prefix.String()
+		}
+		state := limiter.clients[key]
+		if state == nil {
+			state = &clientState{}
+			if rule.ConnectionRate > 0 {
+				state.connectionRate = ratelimit.NewTokenBucket(rule.ConnectionRate, rule.ConnectionBurst)
+			}
+			if rule.ConnectsPerMinute > 0 {
+				state.connectRate = ratelimit.NewTokenBucket(float64(rule.ConnectsPerMinute)/60, rule.ConnectsPerMinute)
+			}
+			limiter.clients[key] = state
+		}
+		return rule, state
+	}
+	return nil, nil
+}
+
+// Admit checks whether client may open a new connection. If so, the returned
+// function must be called once the connection is closed.
+func (limiter *clientLimiter) Admit(client netip.Addr) (release func(), err error) {
+	if limiter == nil {
+		return func() {}, nil
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	rule, state := limiter.state(client)
+	if rule == nil {
+		return func() {}, nil
+	}
+	if rule.MaxConnections > 0 && state.connections >= rule.MaxConnections {
+		return nil, &clientLimitError{client, "concurrent connections"}
+	}
+	if state.connectionRate != nil && !state.connectionRate.Allow() {
+		return nil, &clientLimitError{client, "connection rate"}
+	}
+	state.connections++
+	return func() {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		state.connections--
+	}, nil
+}
+
+// AllowConnect checks whether client may have another CONNECT sent upstream.
+func (limiter *clientLimiter) AllowConnect(client netip.Addr) error {
+	if limiter == nil {
+		return nil
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if _, state := limiter.state(client); state != nil && state.connectRate != nil && !state.connectRate.Allow() {
+		return &clientLimitError{client, "upstream CONNECT rate"}
+	}
+	return nil
+}
+
+// sweep forgets clients whose counters are back to their initial state.
+func (limiter *clientLimiter) sweep() {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	for key, state := range limiter.clients {
+		if state.idle() {
+			delete(limiter.clients, key)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientLimitRules(t *testing.T) {
+	tests := []struct {
+		Description string
+		Value       string
+		Expected    *clientLimitRule
+	}{
+		{"IPv4 prefix", "192.0.2.0/24:conns=10,rate=2.5,connects=60",
+			&clientLimitRule{Prefix: netip.MustParsePrefix("192.0.2.0/24"), MaxConnections: 10, ConnectionRate: 2.5, ConnectionBurst: 3, ConnectsPerMinute: 60}},
+		{"Single address", "192.0.2.1:conns=1",
+			&clientLimitRule{Prefix: netip.MustParsePrefix("192.0.2.1/32"), MaxConnections: 1}},
+		{"IPv6 prefix is masked", "2001:db8::1/32:scope=prefix,rate=1,burst=5",
+			&clientLimitRule{Prefix: netip.MustParsePrefix("2001:db8::/32"), SharedByPrefix: true, ConnectionRate: 1, ConnectionBurst: 5}},
+		{"Single IPv6 address", "2001:db8::1:scope=ip,conns=3",
+			&clientLimitRule{Prefix: netip.MustParsePrefix("2001:db8::1/128"), MaxConnections: 3}},
+		{"No key", "192.0.2.0/24", nil},
+		{"No prefix", "conns=1", nil},
+		{"Invalid prefix", "192.0.2.0/33:conns=1", nil},
+		{"Unknown key", "192.0.2.0/24:conn=1", nil},
+		{"Invalid scope", "192.0.2.0/24:scope=subnet", nil},
+		{"Invalid number", "192.0.2.0/24:conns=many", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			var rules clientLimitRules
+			err := rules.Set(test.Value)
+			if test.Expected == nil {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, clientLimitRules{*test.Expected}, rules)
+		})
+	}
+}
+
+func newTestClientLimiter(t *testing.T, values ...string) *clientLimiter {
+	var rules clientLimitRules
+	for _, value := range values {
+		require.NoError(t, rules.Set(value))
+	}
+	return newClientLimiter(rules)
+}
+
+func TestClientLimiterConnections(t *testing.T) {
+	limiter := newTestClientLimiter(t,
+		"192.0.2.0/24:conns=2",
+		"192.0.2.128/25:scope=prefix,conns=1",
+	)
+	client := netip.MustParseAddr("192.0.2.1")
+
+	release1, err := limiter.Admit(client)
+	require.NoError(t, err)
+	// IPv4-mapped addresses count as the same client
+	release2, err := limiter.Admit(netip.MustParseAddr("::ffff:192.0.2.1"))
+	require.NoError(t, err)
+	_, err = limiter.Admit(client)
+	require.ErrorAs(t, err, new(*clientLimitError))
+	// Other clients have their own counters
+	releaseOther, err := limiter.Admit(netip.MustParseAddr("192.0.2.2"))
+	require.NoError(t, err)
+	releaseOther()
+	release1()
+	release3, err := limiter.Admit(client)
+	require.NoError(t, err)
+	release2()
+	release3()
+
+	// The longest prefix applies, shared by all its clients
+	releaseShared, err := limiter.Admit(netip.MustParseAddr("192.0.2.200"))
+	require.NoError(t, err)
+	_, err = limiter.Admit(netip.MustParseAddr("192.0.2.201"))
+	require.Error(t, err)
+	releaseShared()
+
+	// Clients without rules are not limited
+	for range 5 {
+		_, err = limiter.Admit(netip.MustParseAddr("198.51.100.1"))
+		require.NoError(t, err)
+	}
+}
+
+func TestClientLimiterRates(t *testing.T) {
+	// Rates so low that no tokens come back during the test
+	limiter := newTestClientLimiter(t, "192.0.2.0/24:rate=0.001,burst=2,connects=1")
+	client := netip.MustParseAddr("192.0.2.1")
+
+	for range 2 {
+		release, err := limiter.Admit(client)
+		require.NoError(t, err)
+		release()
+	}
+	_, err := limiter.Admit(client)
+	require.ErrorAs(t, err, new(*clientLimitError))
+
+	require.NoError(t, limiter.AllowConnect(client))
+	err = limiter.AllowConnect(client)
+	require.ErrorAs(t, err, new(*clientLimitError))
+	require.NoError(t, limiter.AllowConnect(netip.MustParseAddr("192.0.2.2")))
+	require.NoError(t, limiter.AllowConnect(netip.MustParseAddr("198.51.100.1")))
+}
+
+func TestClientLimiterSweep(t *testing.T) {
+	limiter := newTestClientLimiter(t, "192.0.2.0/24:conns=1", "198.51.100.0/24:rate=0.001,burst=1")
+
+	release, err := limiter.Admit(netip.MustParseAddr("192.0.2.1"))
+	require.NoError(t, err)
+	rateRelease, err := limiter.Admit(netip.MustParseAddr("198.51.100.1"))
+	require.NoError(t, err)
+	rateRelease()
+
+	// Open connections and spent tokens keep the state
+	limiter.sweep()
+	require.Len(t, limiter.clients, 2)
+
+	release()
+	limiter.sweep()
+	require.Len(t, limiter.clients, 1)
+	require.Contains(t, limiter.clients, "198.51.100.1")
+}
+
+func TestNilClientLimiter(t *testing.T) {
+	limiter := newClientLimiter(nil)
+	require.Nil(t, limiter)
+	release, err := limiter.Admit(netip.MustParseAddr("192.0.2.1"))
+	require.NoError(t, err)
+	release()
+	require.NoError(t, limiter.AllowConnect(netip.MustParseAddr("192.0.2.1")))
+}
@@ -4,11 +4,16 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"net"
 )
 
-var defaultOrigin = flag.String("default-origin", "127.0.0.1:5555", "[debug] assume all traffic is targeting this address")
+var defaultOrigin = flag.String("default-origin", "127.0.0.1:5555",
+	"[debug] assume all traffic is targeting this address (empty -> treat it as not REDIRECTed)")
 
-func getOriginalDestination(*net.TCPConn) (origin string, err error) {
+func getOriginalDestination(c *net.TCPConn) (origin string, err error) {
+	if *defaultOrigin == "" {
+		return "", fmt.Errorf("%w to %s from %s", errNotRedirected, c.LocalAddr().String(), c.RemoteAddr().String())
+	}
 	return *defaultOrigin, nil
 }
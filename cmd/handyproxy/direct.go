@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errNotRedirected is returned by getOriginalDestination for connections which
+// were made to handyproxy's own port, rather than being REDIRECTed to it.
+var errNotRedirected = errors.New("received non REDIRECTed traffic")
+
+const (
+	directModeClose  = "close"
+	directModeDrop   = "drop"
+	directModeStatus = "status"
+	directModeProxy  = "proxy"
+)
+
+const (
+	// Upper bound for the request header of direct connections
+	maxDirectRequestHeader = 16 << 10
+	// How long direct clients have to send their request header
+	directRequestTimeout = 10 * time.Second
+)
+
+// Port scanners would otherwise fill the log with these
+var directLog = newRateLimitedLogger(0.1, 5)
+
+func validateDirectMode(mode string) error {
+	switch mode {
+	case directModeClose, directModeDrop, directModeStatus, directModeProxy:
+		return nil
+	default:
+		return fmt.Errorf("invalid direct connection mode %q, must be one of %q, %q, %q or %q",
+			mode, directModeClose, directModeDrop, directModeStatus, directModeProxy)
+	}
+}
+
+// handleDirectConnection deals with a connection which was not REDIRECTed,
+// according to -direct-mode. If the client is to be served as an explicit
+// proxy client, it returns the destination of its request, and sets
+// ctx.Pending to the client data read so far which must be sent there.
+// Otherwise, it returns an empty origin and the connection must be closed.
+func handleDirectConnection(ctx *connectionContext, cause error) (origin string) {
+	metricRejections.Add("not-redirected", 1)
+	switch *ctx.Opts.DirectMode {
+	case directModeDrop:
+		_ = ctx.C.SetLinger(0)
+	case directModeStatus:
+		if _, _, err := readDirectRequest(ctx.C); err == nil {
+			writeDirectResponse(ctx.C, http.StatusOK, directStatusPage(ctx))
+		}
+	case directModeProxy:
+		req, raw, err := readDirectRequest(ctx.C)
+		if err != nil {
+			break
+		}
+		if origin, err = explicitProxyOrigin(req); err != nil {
+			writeDirectResponse(ctx.C, http.StatusBadRequest, html.EscapeString(err.Error()))
+			directLog.Printf("bad explicit proxy request from %s: %s", ctx.C.RemoteAddr().String(), err)
+			return ""
+		}
+		if req.Method == http.MethodConnect {
+			if _, err = io.WriteString(ctx.C, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+				return ""
+			}
+			ctx.Pending = raw[headerLength(raw):]
+		} else {
+			// Origin servers must accept requests in absolute form, so they
+			// can be forwarded as they are
+			ctx.Pending = raw
+		}
+		return origin
+	}
+	directLog.Printf("%s, discarding", cause)
+	return ""
+}
+
+// readDirectRequest reads the request header of a direct client. It returns
+// the parsed request and the raw data read, which may extend past the header.
+func readDirectRequest(c *net.TCPConn) (*http.Request, []byte, error) {
+	_ = c.SetReadDeadline(time.Now().Add(directRequestTimeout))
+	defer func() { _ = c.SetReadDeadline(time.Time{}) }()
+
+	var raw []byte
+	buf := make([]byte, 4096)
+	for headerLength(raw) == 0 {
+		if len(raw) >= maxDirectRequestHeader {
+			return nil, nil, fmt.Errorf("request header exceeds %d bytes", maxDirectRequestHeader)
+		}
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		raw = append(raw, buf[:n]...)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	return req, raw, err
+}
+
+// headerLength returns the length of the HTTP header at the beginning of data,
+// or 0 if it is not complete.
+func headerLength(data []byte) int {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return i + 4
+	}
+	return 0
+}
+
+// explicitProxyOrigin returns the destination of a request sent to a proxy,
+// which must be either a CONNECT or use an absolute http URL.
+func explicitProxyOrigin(req *http.Request) (string, error) {
+	if req.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(req.Host); err != nil {
+			return "", fmt.Errorf("invalid CONNECT target %q: %w", req.Host, err)
+		}
+		return req.Host, nil
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		return "", fmt.Errorf("only CONNECT and absolute http:// requests are supported")
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port), nil
+}
+
+func directStatusPage(ctx *connectionContext) string {
+	return fmt.Sprintf("<p>HandyProxy %s is forwarding REDIRECTed connections to %s.</p>\n"+
+		"<p>Connections handled so far: %d.</p>\n",
+		html.EscapeString(version), html.EscapeString(*ctx.Opts.UpstreamProxy), metricConnections.Value())
+}
+
+func writeDirectResponse(c *net.TCPConn, statusCode int, body string) {
+	status := strconv.Itoa(statusCode) + " " + http.StatusText(statusCode)
+	page := fmt.Sprintf("<!DOCTYPE html>\n<html><head><title>%s</title></head>\n<body><h1>%s</h1>\n%s</body></html>\n",
+		status, status, body)
+	_ = c.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	_, err := fmt.Fprintf(c, "HTTP/1.1 %s\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\n"+
+		"Cache-Control: no-store\r\nConnection: close\r\n\r\n%s", status, len(page), page)
+	if err == nil {
+		_ = c.CloseWrite()
+		_ = c.SetReadDeadline(time.Now().Add(rejectDrainTimeout))
+		_, _ = io.Copy(io.Discard, c)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplicitProxyRequests(t *testing.T) {
+	tests := []struct {
+		Description    string
+		Request        string
+		ExpectedOrigin string
+		ExpectError    bool
+	}{
+		{"CONNECT", "CONNECT www.example.com:443 HTTP/1.1\r\nHost: www.example.com:443\r\n\r\n", "www.example.com:443", false},
+		{"CONNECT to IPv6 address", "CONNECT [2001:db8::1]:443 HTTP/1.1\r\n\r\n", "[2001:db8::1]:443", false},
+		{"CONNECT without port", "CONNECT www.example.com HTTP/1.1\r\n\r\n", "", true},
+		{"Absolute URL", "GET http://www.example.com/index.html HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "www.example.com:80", false},
+		{"Absolute URL with port", "GET http://www.example.com:8080/ HTTP/1.1\r\n\r\n", "www.example.com:8080", false},
+		{"Origin form", "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "", true},
+		{"HTTPS URL", "GET https://www.example.com/ HTTP/1.1\r\n\r\n", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(test.Request)))
+			require.NoError(t, err)
+			origin, err := explicitProxyOrigin(req)
+			if test.ExpectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.ExpectedOrigin, origin)
+		})
+	}
+}
+
+func TestHeaderLength(t *testing.T) {
+	require.Zero(t, headerLength([]byte("CONNECT a:1 HTTP/1.1\r\n")))
+	require.Equal(t, 24, headerLength([]byte("CONNECT a:1 HTTP/1.1\r\n\r\n\x16\x03\x01")))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/binary-manu/handyproxy/internal/dnsmap"
+)
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseFakePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	families := make(map[bool]bool)
+	for _, item := range splitList(s) {
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, err
+		}
+		if err = dnsmap.ValidateFakePrefix(prefix); err != nil {
+			return nil, err
+		}
+		if families[prefix.Addr().Is4()] {
+			return nil, fmt.Errorf("more than one fake address prefix for the same address family")
+		}
+		families[prefix.Addr().Is4()] = true
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func validateDNSOptions(opts *options) error {
+	if *opts.DNSListen == "" {
+		if *opts.DNSFakePrefixes != "" {
+			return errors.New("-dns-fake-prefix requires -dns-listen")
+		}
+		return nil
+	}
+	upstream := splitList(*opts.DNSUpstream)
+	if len(upstream) == 0 {
+		return errors.New("-dns-listen requires -dns-upstream")
+	}
+	for _, server := range upstream {
+		if _, err := netip.ParseAddr(server); err != nil {
+			if _, err = netip.ParseAddrPort(server); err != nil {
+				return fmt.Errorf("invalid upstream DNS server %q, must be IP or IP:PORT", server)
+			}
+		}
+	}
+	prefixes, err := parseFakePrefixes(*opts.DNSFakePrefixes)
+	if err != nil {
+		return fmt.Errorf("invalid -dns-fake-prefix: %w", err)
+	}
+	// Sniffed hostnames never resolve to fake addresses
+	if len(prefixes) > 0 && *opts.VerifyHostName != verifyHostNameOff {
+		return errors.New("-verify-hostname cannot be used with -dns-fake-prefix")
+	}
+	return nil
+}
+
+// newDNSMap returns the map of the addresses given out by the embedded DNS
+// server, or nil if the server is disabled.
+func newDNSMap(opts *options) *dnsmap.Map {
+	if *opts.DNSListen == "" {
+		return nil
+	}
+	mapOpts := []dnsmap.Option{dnsmap.WithMinTTL(*opts.DNSMinTTL)}
+	// Validated at startup
+	prefixes, _ := parseFakePrefixes(*opts.DNSFakePrefixes)
+	for _, prefix := range prefixes {
+		mapOpts = append(mapOpts, dnsmap.WithFakePrefix(prefix))
+	}
+	return dnsmap.New(mapOpts...)
+}
+
+// serveDNS starts the embedded DNS server, recording the addresses it gives
+// out into addrs, if it is enabled.
+func serveDNS(opts *options, addrs *dnsmap.Map) {
+	if addrs == nil {
+		return
+	}
+	conn, err := net.ListenPacket("udp", *opts.DNSListen)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	mode := "forwarding"
+	if addrs.Faking() {
+		mode = "fake address"
+	}
+	log.Printf("Serving DNS on %s in %s mode, with upstream servers %s", conn.LocalAddr(), mode, *opts.DNSUpstream)
+	server := dnsmap.NewServer(addrs, splitList(*opts.DNSUpstream))
+	go func() {
+		log.Printf("DNS server failed: %s", server.Serve(conn))
+	}()
+}
+
+type fakeAddressError struct {
+	Addr netip.Addr
+}
+
+func (e *fakeAddressError) Error() string {
+	return fmt.Sprintf("%s is a fake address whose hostname is no longer known", e.Addr)
+}
+
+// resolveFakeOrigin replaces origin, if it is one of the synthetic addresses
+// given out by the embedded DNS server, with the hostname it was given out for
+// and the same port. Synthetic addresses cannot be reached, so an error is
+// returned for those whose hostname is no longer known.
+func resolveFakeOrigin(addrs *dnsmap.Map, origin string) (string, error) {
+	addrPort, err := netip.ParseAddrPort(origin)
+	if err != nil || !addrs.IsFake(addrPort.Addr()) {
+		return origin, nil
+	}
+	name, ok := addrs.Lookup(addrPort.Addr())
+	if !ok {
+		return "", &fakeAddressError{addrPort.Addr().Unmap()}
+	}
+	return net.JoinHostPort(name, strconv.Itoa(int(addrPort.Port()))), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/dnsmap"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDNSOptions(t *testing.T) {
+	tests := []struct {
+		Description string
+		Args        []string
+		Valid       bool
+	}{
+		{"Disabled", nil, true},
+		{"Forwarding", []string{"-dns-listen", ":53", "-dns-upstream", "192.0.2.53, [2001:db8::53]:5353"}, true},
+		{"Fake addresses", []string{"-dns-listen", ":53", "-dns-upstream", "192.0.2.53", "-dns-fake-prefix", "198.18.0.0/15,fd00::/64"}, true},
+		{"No upstream", []string{"-dns-listen", ":53"}, false},
+		{"Upstream hostname", []string{"-dns-listen", ":53", "-dns-upstream", "dns.example.com"}, false},
+		{"Fake prefix without server", []string{"-dns-fake-prefix", "198.18.0.0/15"}, false},
+		{"Invalid fake prefix", []string{"-dns-listen", ":53", "-dns-upstream", "192.0.2.53", "-dns-fake-prefix", "198.18.0.0"}, false},
+		{"Tiny fake prefix", []string{"-dns-listen", ":53", "-dns-upstream", "192.0.2.53", "-dns-fake-prefix", "198.18.0.0/31"}, false},
+		{"Two IPv4 fake prefixes", []string{"-dns-listen", ":53", "-dns-upstream", "192.0.2.53", "-dns-fake-prefix", "198.18.0.0/16,198.19.0.0/16"}, false},
+		{"Fake addresses and verification", []string{"-dns-listen", ":53", "-dns-upstream", "192.0.2.53", "-dns-fake-prefix", "198.18.0.0/15", "-verify-hostname", "ip"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.PanicOnError)
+			opts := newOptions(flags)
+			require.NoError(t, flags.Parse(test.Args))
+			if test.Valid {
+				require.NoError(t, validateDNSOptions(opts))
+			} else {
+				require.Error(t, validateDNSOptions(opts))
+			}
+		})
+	}
+}
+
+func TestResolveFakeOrigin(t *testing.T) {
+	addrs := dnsmap.New(dnsmap.WithFakePrefix(netip.MustParsePrefix("198.18.0.0/15")))
+	addrs.Add("real.example.com", netip.MustParseAddr("192.0.2.1"), time.Hour)
+	fake, ok := addrs.FakeAddr("ssh.example.com", false)
+	require.True(t, ok)
+
+	tests := []struct {
+		Description string
+		Addrs       *dnsmap.Map
+		Origin      string
+		Expected    string
+		Valid       bool
+	}{
+		{"Fake address", addrs, netip.AddrPortFrom(fake, 22).String(), "ssh.example.com:22", true},
+		{"IPv4-mapped fake address", addrs, "[::ffff:" + fake.String() + "]:22", "ssh.example.com:22", true},
+		{"Unknown fake address", addrs, "198.18.0.200:22", "", false},
+		{"Real address", addrs, "192.0.2.1:22", "192.0.2.1:22", true},
+		{"Hostname", addrs, "www.example.com:443", "www.example.com:443", true},
+		{"No DNS server", nil, "198.18.0.200:22", "198.18.0.200:22", true},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			origin, err := resolveFakeOrigin(test.Addrs, test.Origin)
+			if test.Valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+			require.Equal(t, test.Expected, origin)
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/dialer"
+	"github.com/binary-manu/handyproxy/internal/resolver"
+)
+
+type doctorStatus string
+
+const (
+	doctorOK      doctorStatus = "ok"
+	doctorWarning doctorStatus = "warning"
+	doctorError   doctorStatus = "error"
+)
+
+type doctorCheck struct {
+	Name   string       `json:"name"`
+	Status doctorStatus `json:"status"`
+	Detail string       `json:"detail"`
+}
+
+type doctorReport struct {
+	Version string        `json:"version"`
+	Checks  []doctorCheck `json:"checks"`
+}
+
+func (report *doctorReport) add(name string, status doctorStatus, format string, args ...any) {
+	report.Checks = append(report.Checks, doctorCheck{
+		Name:   name,
+		Status: status,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+func (report *doctorReport) failed() bool {
+	for _, check := range report.Checks {
+		if check.Status == doctorError {
+			return true
+		}
+	}
+	return false
+}
+
+func (report *doctorReport) writeText(w io.Writer) {
+	fmt.Fprintln(w, "HandyProxy", report.Version, "doctor report")
+	for _, check := range report.Checks {
+		fmt.Fprintf(w, "%-9s %s: %s\n", "["+string(check.Status)+"]", check.Name, check.Detail)
+	}
+}
+
+func runDoctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	opts := newOptions(flags)
+	target := flags.String("target", "www.example.com:443", "origin to request a test tunnel to")
+	jsonOutput := flags.Bool("json", false, "print the report as JSON")
+	_ = flags.Parse(args)
+
+	report := doctorReport{Version: version}
+	doctorCheckUpstream(&report, opts, *target)
+	doctorCheckNoFileLimit(&report)
+	doctorCheckListener(&report, opts)
+	doctorCheckIPForward(&report)
+	doctorCheckConntrack(&report)
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(&report)
+	} else {
+		report.writeText(os.Stdout)
+	}
+
+	if report.failed() {
+		return 1
+	}
+	return 0
+}
+
+func doctorCheckUpstream(report *doctorReport, opts *options, target string) {
+	const name = "upstream"
+
+	host, port, err := net.SplitHostPort(*opts.UpstreamProxy)
+	if err != nil {
+		report.add(name+" address", doctorError, "invalid upstream proxy %q: %s", *opts.UpstreamProxy, err)
+		return
+	}
+
+	lookupCtx, cancel := context.WithTimeout(context.Background(), *opts.DialTimeout)
+	defer cancel()
+	upstreamResolver := resolver.New()
+	addrs, err := upstreamResolver.LookupNetIP(lookupCtx, host)
+	if err != nil {
+		report.add(name+" resolution", doctorError, "unable to resolve %s: %s", host, err)
+		return
+	}
+	addrStrings := make([]string, len(addrs))
+	for i, addr := range addrs {
+		addrStrings[i] = addr.String()
+	}
+	report.add(name+" resolution", doctorOK, "%s resolves to %s", host, strings.Join(addrStrings, ", "))
+
+	// Each address is checked on its own, with the timeout of a single attempt
+	addrDialer := newOutboundDialer(opts)
+	if *opts.DialAttemptTimeout > 0 {
+		addrDialer.Timeout = min(addrDialer.Timeout, *opts.DialAttemptTimeout)
+	}
+	for _, addr := range addrs {
+		checkName := fmt.Sprintf("%s dial %s", name, addr)
+		addrPort := net.JoinHostPort(addr.String(), port)
+		start := time.Now()
+		conn, err := addrDialer.Dial("tcp", addrPort)
+		if err != nil {
+			report.add(checkName, doctorError, "%s", err)
+			continue
+		}
+		_ = conn.Close()
+		report.add(checkName, doctorOK, "connected in %v", time.Since(start).Round(time.Millisecond))
+	}
+
+	doctorCheckConnect(report, opts, newUpstreamDialer(opts, upstreamResolver), target)
+}
+
+func doctorCheckConnect(report *doctorReport, opts *options, upstreamDialer *dialer.Dialer, target string) {
+	checkName := "CONNECT " + target
+
+	conn, err := upstreamDialer.Dial("tcp", *opts.UpstreamProxy)
+	if err != nil {
+		report.add(checkName, doctorError, "unable to connect to the upstream proxy: %s", err)
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(*opts.DialTimeout))
+
+	start := time.Now()
+	rsp, _, err := sendConnect(conn, target)
+	if err != nil {
+		report.add(checkName, doctorError, "no valid response from the upstream proxy: %s", err)
+		return
+	}
+	defer rsp.Body.Close()
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	switch {
+	case rsp.StatusCode/100 == 2:
+		report.add(checkName, doctorOK, "proxy answered %q in %v", rsp.Status, elapsed)
+	case len(rsp.Header.Values("Proxy-Authenticate")) > 0:
+		report.add(checkName, doctorError, "proxy answered %q, authentication challenges: %s",
+			rsp.Status, strings.Join(rsp.Header.Values("Proxy-Authenticate"), "; "))
+	default:
+		report.add(checkName, doctorError, "proxy answered %q", rsp.Status)
+	}
+}
+
+func doctorCheckNoFileLimit(report *doctorReport) {
+	const name = "file descriptor limit"
+	// Below this, a busy router quickly runs out of descriptors
+	const recommendedSoftLimit = 4096
+
+	soft, hard, err := getNoFileLimit()
+	if err != nil {
+		report.add(name, doctorWarning, "%s", err)
+		return
+	}
+	status := doctorOK
+	if soft < recommendedSoftLimit {
+		status = doctorWarning
+	}
+	// Each tunnel uses one descriptor for the client and one for the proxy
+	report.add(name, status, "soft limit %d, hard limit %d: room for about %d concurrent connections",
+		soft, hard, soft/2)
+}
+
+func doctorCheckListener(report *doctorReport, opts *options) {
+	checkName := fmt.Sprintf("local port %d", *opts.LocalPort)
+
+	ln, err := net.Listen("tcp4", fmt.Sprintf(":%d", *opts.LocalPort))
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			report.add(checkName, doctorWarning, "already in use, is handyproxy already running?")
+		} else {
+			report.add(checkName, doctorError, "%s", err)
+		}
+		return
+	}
+	_ = ln.Close()
+	report.add(checkName, doctorOK, "available")
+}
+
+// Where the kernel settings checked by the doctor are read from
+var doctorProcSys = "/proc/sys"
+
+func readProcInt(path string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join(doctorProcSys, path))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func doctorCheckIPForward(report *doctorReport) {
+	const name = "IPv4 forwarding"
+
+	forward, err := readProcInt("net/ipv4/ip_forward")
+	switch {
+	case err != nil:
+		report.add(name, doctorWarning, "unable to read setting: %s", err)
+	case forward == 0:
+		report.add(name, doctorWarning, "disabled, only locally generated (OUTPUT) traffic can be redirected")
+	default:
+		report.add(name, doctorOK, "enabled")
+	}
+}
+
+func doctorCheckConntrack(report *doctorReport) {
+	const name = "connection tracking"
+
+	size, err := readProcInt("net/netfilter/nf_conntrack_max")
+	if err != nil {
+		report.add(name, doctorWarning, "nf_conntrack seems unavailable, REDIRECT rules need it: %s", err)
+		return
+	}
+	count, err := readProcInt("net/netfilter/nf_conntrack_count")
+	if err != nil {
+		report.add(name, doctorOK, "available, table size %d", size)
+		return
+	}
+	status := doctorOK
+	if count*10 >= size*9 {
+		status = doctorWarning
+	}
+	report.add(name, status, "available, %d of %d entries in use", count, size)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveFakeProxy answers every CONNECT request with response, on a local
+// listener, and returns its address.
+func serveFakeProxy(t *testing.T, response string) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if req, err := http.ReadRequest(bufio.NewReader(conn)); err == nil && req.Method == http.MethodConnect {
+					_, _ = conn.Write([]byte(response))
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func newDoctorOptions(t *testing.T, args ...string) *options {
+	flags := flag.NewFlagSet("test", flag.PanicOnError)
+	opts := newOptions(flags)
+	require.NoError(t, flags.Parse(args))
+	return opts
+}
+
+func TestDoctorCheckUpstream(t *testing.T) {
+	tests := []struct {
+		Description    string
+		Response       string
+		ExpectedStatus doctorStatus
+		ExpectedDetail string
+	}{
+		{"Tunnel", "HTTP/1.1 200 Connection established\r\n\r\n", doctorOK, `proxy answered "200 Connection established"`},
+		{"Authentication", "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"proxy\"\r\nProxy-Authenticate: NTLM\r\nContent-Length: 0\r\n\r\n",
+			doctorError, `authentication challenges: Basic realm="proxy"; NTLM`},
+		{"Denied", "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n", doctorError, `proxy answered "403 Forbidden"`},
+		{"Garbage", "SSH-2.0-OpenSSH_9.6\r\n", doctorError, "no valid response from the upstream proxy"},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			opts := newDoctorOptions(t, "-upstream-proxy", serveFakeProxy(t, test.Response))
+			var report doctorReport
+			doctorCheckUpstream(&report, opts, "www.example.com:443")
+
+			require.Len(t, report.Checks, 3)
+			require.Equal(t, doctorOK, report.Checks[0].Status)
+			require.Equal(t, "upstream resolution", report.Checks[0].Name)
+			require.Equal(t, doctorOK, report.Checks[1].Status)
+			require.Equal(t, "upstream dial 127.0.0.1", report.Checks[1].Name)
+			require.Equal(t, "CONNECT www.example.com:443", report.Checks[2].Name)
+			require.Equal(t, test.ExpectedStatus, report.Checks[2].Status)
+			require.Contains(t, report.Checks[2].Detail, test.ExpectedDetail)
+			require.Equal(t, test.ExpectedStatus == doctorError, report.failed())
+		})
+	}
+}
+
+func TestDoctorCheckUpstreamUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	var report doctorReport
+	doctorCheckUpstream(&report, newDoctorOptions(t, "-upstream-proxy", addr), "www.example.com:443")
+	require.Len(t, report.Checks, 3)
+	require.Equal(t, doctorError, report.Checks[1].Status)
+	require.Equal(t, doctorError, report.Checks[2].Status)
+	require.Contains(t, report.Checks[2].Detail, "unable to connect to the upstream proxy")
+
+	report = doctorReport{}
+	doctorCheckUpstream(&report, newDoctorOptions(t, "-upstream-proxy", "127.0.0.1"), "www.example.com:443")
+	require.Len(t, report.Checks, 1)
+	require.Equal(t, "upstream address", report.Checks[0].Name)
+	require.True(t, report.failed())
+}
+
+func TestDoctorCheckListener(t *testing.T) {
+	ln, err := net.Listen("tcp4", ":0")
+	require.NoError(t, err)
+	opts := newDoctorOptions(t)
+	*opts.LocalPort = ln.Addr().(*net.TCPAddr).Port
+
+	var report doctorReport
+	doctorCheckListener(&report, opts)
+	require.NoError(t, ln.Close())
+	doctorCheckListener(&report, opts)
+	require.Equal(t, doctorWarning, report.Checks[0].Status)
+	require.Equal(t, doctorOK, report.Checks[1].Status)
+}
+
+func TestDoctorKernelChecks(t *testing.T) {
+	procSys := t.TempDir()
+	saved := doctorProcSys
+	doctorProcSys = procSys
+	t.Cleanup(func() { doctorProcSys = saved })
+	write := func(path, value string) {
+		path = filepath.Join(procSys, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(value+"\n"), 0o644))
+	}
+	check := func(run func(*doctorReport)) doctorCheck {
+		var report doctorReport
+		run(&report)
+		require.Len(t, report.Checks, 1)
+		return report.Checks[0]
+	}
+
+	require.Equal(t, doctorWarning, check(doctorCheckIPForward).Status)
+	write("net/ipv4/ip_forward", "0")
+	require.Equal(t, doctorWarning, check(doctorCheckIPForward).Status)
+	write("net/ipv4/ip_forward", "1")
+	require.Equal(t, doctorOK, check(doctorCheckIPForward).Status)
+
+	require.Equal(t, doctorWarning, check(doctorCheckConntrack).Status)
+	write("net/netfilter/nf_conntrack_max", "1000")
+	result := check(doctorCheckConntrack)
+	require.Equal(t, doctorOK, result.Status)
+	require.Equal(t, "available, table size 1000", result.Detail)
+	write("net/netfilter/nf_conntrack_count", "899")
+	require.Equal(t, doctorOK, check(doctorCheckConntrack).Status)
+	write("net/netfilter/nf_conntrack_count", "900")
+	result = check(doctorCheckConntrack)
+	require.Equal(t, doctorWarning, result.Status)
+	require.Equal(t, "available, 900 of 1000 entries in use", result.Detail)
+}
+
+func TestDoctorReportText(t *testing.T) {
+	report := doctorReport{Version: "1.2.3"}
+	report.add("IPv4 forwarding", doctorOK, "enabled")
+	report.add("local port 8443", doctorWarning, "already in use")
+	require.False(t, report.failed())
+
+	var text bytes.Buffer
+	report.writeText(&text)
+	require.Equal(t, "HandyProxy 1.2.3 doctor report\n"+
+		"[ok]      IPv4 forwarding: enabled\n"+
+		"[warning] local port 8443: already in use\n", text.String())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/binary-manu/handyproxy/internal/hostname"
+)
+
+const (
+	echPolicyTrust  = "trust"
+	echPolicyIP     = "ip"
+	echPolicyReject = "reject"
+)
+
+func validateECHPolicy(policy string) error {
+	switch policy {
+	case echPolicyTrust, echPolicyIP, echPolicyReject:
+		return nil
+	default:
+		return fmt.Errorf("invalid ECH policy %q, must be one of %q, %q or %q",
+			policy, echPolicyTrust, echPolicyIP, echPolicyReject)
+	}
+}
+
+type echRejectedError struct {
+	PublicName string
+}
+
+func (e *echRejectedError) Error() string {
+	return fmt.Sprintf("Encrypted Client Hello with public name %s rejected by -ech-policy", e.PublicName)
+}
+
+// applyECHPolicy decides what to do with a connection whose sniffed hostname
+// may only be the public name of an ECH client-facing server. It tells
+// whether the hostname can be used as the destination, rather than the
+// original destination address, or returns an error if the connection must be
+// rejected.
+func applyECHPolicy(policy string, metadata *hostname.Metadata) (bool, error) {
+	if !metadata.ECH {
+		return true, nil
+	}
+	metricECHConnections.Add(1)
+	switch policy {
+	case echPolicyIP:
+		return false, nil
+	case echPolicyReject:
+		return false, &echRejectedError{metadata.PublicName}
+	default:
+		return true, nil
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/binary-manu/handyproxy/internal/hostname"
+	"github.com/stretchr/testify/require"
+)
+
+func TestECHPolicy(t *testing.T) {
+	plain := &hostname.Metadata{HostName: "www.example.com"}
+	ech := &hostname.Metadata{HostName: "public.example.com", ECH: true, PublicName: "public.example.com"}
+	tests := []struct {
+		Policy      string
+		Metadata    *hostname.Metadata
+		UseHostName bool
+		Rejected    bool
+	}{
+		{echPolicyTrust, plain, true, false},
+		{echPolicyIP, plain, true, false},
+		{echPolicyReject, plain, true, false},
+		{echPolicyTrust, ech, true, false},
+		{echPolicyIP, ech, false, false},
+		{echPolicyReject, ech, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.Policy+"/"+test.Metadata.HostName, func(t *testing.T) {
+			useHostName, err := applyECHPolicy(test.Policy, test.Metadata)
+			require.Equal(t, test.UseHostName, useHostName)
+			if test.Rejected {
+				require.ErrorAs(t, err, new(*echRejectedError))
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+	require.Error(t, validateECHPolicy("ignore"))
+}
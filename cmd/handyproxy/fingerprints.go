@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"sync"
+
+	"github.com/binary-manu/handyproxy/internal/hostname"
+)
+
+// Fingerprints are chosen by clients, so only this many are tracked
+// individually, to bound memory use and the size of metrics. Further ones are
+// counted together.
+const maxTrackedFingerprints = 1000
+
+// fingerprintTracker counts TLS connections by JA4 fingerprint, and logs
+// fingerprints the first time they are seen, so that unusual clients stand
+// out.
+type fingerprintTracker struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+var tlsFingerprints = fingerprintTracker{seen: make(map[string]struct{})}
+
+func (tracker *fingerprintTracker) Observe(client netip.Addr, metadata *hostname.Metadata) {
+	if metadata == nil || metadata.JA4 == "" {
+		return
+	}
+	tracker.mu.Lock()
+	_, seen := tracker.seen[metadata.JA4]
+	track := seen || len(tracker.seen) < maxTrackedFingerprints
+	if track && !seen {
+		tracker.seen[metadata.JA4] = struct{}{}
+	}
+	tracker.mu.Unlock()
+
+	if !track {
+		metricTLSFingerprints.Add("other", 1)
+		return
+	}
+	metricTLSFingerprints.Add(metadata.JA4, 1)
+	if !seen {
+		log.Printf("new TLS client fingerprint JA4 %s JA3 %s, from %s for %s",
+			metadata.JA4, metadata.JA3, client, metadata.HostName)
+	}
+}
+
+// describeFingerprints returns the fingerprints in metadata, formatted to be
+// appended to log messages.
+func describeFingerprints(metadata *hostname.Metadata) string {
+	if metadata == nil || metadata.JA4 == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (JA4 %s JA3 %s)", metadata.JA4, metadata.JA3)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseKeyValues parses a comma-separated list of key=value pairs, accepting
+// only the given keys.
+func parseKeyValues(s string, keys ...string) (map[string]string, error) {
+	values := make(map[string]string)
+	if s == "" {
+		return values, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%q is not a key=value pair", pair)
+		}
+		known := false
+		for _, k := range keys {
+			known = known || k == key
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown key %q, must be one of %s", key, strings.Join(keys, ", "))
+		}
+		values[key] = strings.TrimSpace(value)
+	}
+	return values, nil
+}
@@ -2,82 +2,377 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/binary-manu/handyproxy/internal/dialer"
+	"github.com/binary-manu/handyproxy/internal/dnsmap"
 	"github.com/binary-manu/handyproxy/internal/hostname"
+	"github.com/binary-manu/handyproxy/internal/resolver"
 )
 
 var version = "master"
 
 type options struct {
-	LocalPort     *int
-	UpstreamProxy *string
-	VersionFlag   *bool
-	DialTimeout   *time.Duration
-	SniffTimeout  *time.Duration
-	SniffMaxBytes *int64
+	LocalPort           *int
+	UpstreamProxy       *string
+	VersionFlag         *bool
+	DialTimeout         *time.Duration
+	DialAttemptTimeout  *time.Duration
+	SniffTimeout        *time.Duration
+	SniffMaxBytes       *int64
+	SniffEngine         *string
+	SniffStrategies     *sniffStrategyList
+	SniffRules          *sniffRules
+	ECHPolicy           *string
+	PortMismatch        *string
+	VerifyHostName      *string
+	VerifyHostNameCIDRs *domainPrefixList
+	STARTTLS            *starttlsPorts
+	DNSListen           *string
+	DNSUpstream         *string
+	DNSFakePrefixes     *string
+	DNSMinTTL           *time.Duration
+	FwMark              *uint
+
+	MaxConnections     *int
+	MaxConnectionsMode *string
+	ClientLimits       *clientLimitRules
+	MetricsListen      *string
+	BandwidthConn      *bandwidthLimit
+	BandwidthClient    *bandwidthLimit
+	BandwidthDomains   *domainBandwidthGroups
+	AccessRules        *accessRules
+	IdleTimeout        *time.Duration
+	MaxTunnelLifetime  *time.Duration
+	KeepAliveIdle      *time.Duration
+	KeepAliveInterval  *time.Duration
+	KeepAliveCount     *int
+	TCPUserTimeout     *time.Duration
+	RejectClose        *string
+	DirectMode         *string
+	UpstreamPoolSize   *int
+	UpstreamPoolMaxAge *time.Duration
 }
 
+// hostNameSnifferFactory creates the sniffer for each connection, with the
+// settings of the first -sniff-rule matching its original destination.
 type hostNameSnifferFactory struct {
 	hostNameSnifferFactoryInterface
+	rules    sniffRules
+	defaults sniffSettings
+	// Hostnames of the addresses given out by the embedded DNS server
+	addrs *dnsmap.Map
 }
 
 type hostNameSnifferFactoryInterface interface {
-	NewHostNameSniffer() *hostname.Sniffer
+	NewHostNameSnifferWith(settings *sniffSettings) *hostname.Sniffer
+}
+
+func (factory *hostNameSnifferFactory) NewHostNameSniffer(origin string) *hostname.Sniffer {
+	settings := factory.rules.settingsFor(origin, factory.defaults)
+	sniffer := hostname.NewNullSniffer()
+	if settings.enabled() {
+		sniffer = factory.NewHostNameSnifferWith(&settings)
+	}
+	if addrPort, err := netip.ParseAddrPort(origin); err == nil && factory.addrs != nil {
+		return hostname.NewAddressMapSniffer(addrPort, factory.addrs.Lookup, sniffer)
+	}
+	return sniffer
+}
+
+type namedSniffStrategy struct {
+	Name     string
+	Strategy *hostname.SniffStrategy
+	// Same as Strategy, for the sequential engine
+	Incremental *hostname.IncrementalSniffStrategy
+}
+
+// hostNameSniffStrategies lists the strategies available for hostname
+// sniffing, which -sniff-strategies selects by name
+var hostNameSniffStrategies = []namedSniffStrategy{
+	{hostname.StrategyNameHTTP, hostname.NewHTTPSnifferStrategy(), hostname.NewIncrementalHTTPSnifferStrategy()},
+	{hostname.StrategyNameTLS, hostname.NewTLSSnifferStrategy(), hostname.NewIncrementalTLSSnifferStrategy()},
+	{hostname.StrategyNameH2C, hostname.NewH2CSnifferStrategy(), hostname.NewIncrementalH2CSnifferStrategy()},
+	{hostname.StrategyNameXMPP, hostname.NewXMPPSnifferStrategy(), hostname.NewIncrementalXMPPSnifferStrategy()},
+	{hostname.StrategyNamePostgres, hostname.NewPostgresSnifferStrategy(), hostname.NewIncrementalPostgresSnifferStrategy()},
+}
+
+// Used unless -sniff-strategies says otherwise
+var defaultSniffStrategies = strings.Join([]string{hostname.StrategyNameHTTP, hostname.StrategyNameTLS, hostname.StrategyNameH2C}, ",")
+
+// sniffStrategyList implements flag.Value, holding the strategies selected by
+// -sniff-strategies as a comma separated list of names.
+type sniffStrategyList []namedSniffStrategy
+
+func (list *sniffStrategyList) String() string {
+	if list == nil {
+		return ""
+	}
+	var names []string
+	for _, strategy := range *list {
+		names = append(names, strategy.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (list *sniffStrategyList) Set(s string) error {
+	var strategies sniffStrategyList
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(hostNameSniffStrategies, func(strategy namedSniffStrategy) bool {
+			return strategy.Name == name
+		})
+		if i < 0 {
+			return fmt.Errorf("unknown sniff strategy %q, must be one of %s", name, sniffStrategyNames())
+		}
+		if !slices.ContainsFunc(strategies, func(strategy namedSniffStrategy) bool { return strategy.Name == name }) {
+			strategies = append(strategies, hostNameSniffStrategies[i])
+		}
+	}
+	*list = strategies
+	return nil
 }
 
-type nullHostNameSnifferFactory struct{}
+func sniffStrategyNames() string {
+	var names []string
+	for _, strategy := range hostNameSniffStrategies {
+		names = append(names, strategy.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+const (
+	sniffEngineParallel   = "parallel"
+	sniffEngineSequential = "sequential"
+)
 
-func (factory *nullHostNameSnifferFactory) NewHostNameSniffer() *hostname.Sniffer {
-	return hostname.NewNullSniffer()
+func validateSniffEngine(engine string) error {
+	switch engine {
+	case sniffEngineParallel, sniffEngineSequential:
+		return nil
+	default:
+		return fmt.Errorf("invalid sniff engine %q, must be either %q or %q",
+			engine, sniffEngineParallel, sniffEngineSequential)
+	}
 }
 
-type parallelHostNameSnifferFactory struct {
-	opts *options
+// validateSniffStrategies rejects the strategies which cannot work on live
+// traffic. PostgreSQL clients only send their ClientHello after the server
+// accepts an SSLRequest, so the postgres strategy would hold their connections
+// until the sniff timeout, and is only allowed by the sniff subcommand.
+func validateSniffStrategies(opts *options) error {
+	lists := []sniffStrategyList{*opts.SniffStrategies}
+	for _, rule := range *opts.SniffRules {
+		lists = append(lists, rule.Strategies)
+	}
+	for _, list := range lists {
+		if slices.ContainsFunc(list, func(strategy namedSniffStrategy) bool {
+			return strategy.Name == hostname.StrategyNamePostgres
+		}) {
+			return fmt.Errorf("the %q sniff strategy only works with the sniff subcommand, use -starttls %s:PORT instead",
+				hostname.StrategyNamePostgres, starttlsPostgres)
+		}
+	}
+	return nil
 }
 
-func (factory *parallelHostNameSnifferFactory) NewHostNameSniffer() *hostname.Sniffer {
-	return hostname.NewParallelSniffer(
-		hostname.WithParallelMaxData(*factory.opts.SniffMaxBytes),
-		hostname.WithParallelTimeout(*factory.opts.SniffTimeout),
-		hostname.WithParallelSnifferStrategy(hostname.NewHTTPSnifferStrategy()),
-		hostname.WithParallelSnifferStrategy(hostname.NewTLSSnifferStrategy()),
-	)
+type parallelHostNameSnifferFactory struct{}
+
+func (factory *parallelHostNameSnifferFactory) NewHostNameSnifferWith(settings *sniffSettings) *hostname.Sniffer {
+	snifferOpts := []hostname.ParallelSnifferOption{
+		hostname.WithParallelMaxData(settings.MaxData),
+		hostname.WithParallelTimeout(settings.Timeout),
+	}
+	for _, strategy := range settings.Strategies {
+		snifferOpts = append(snifferOpts, hostname.WithParallelSnifferStrategy(strategy.Strategy))
+	}
+	return hostname.NewParallelSniffer(snifferOpts...)
 }
 
-func newHostNameSnifferFactoryFromOptions(opts *options) *hostNameSnifferFactory {
-	if *opts.SniffTimeout < 0 {
-		return &hostNameSnifferFactory{&nullHostNameSnifferFactory{}}
+type sequentialHostNameSnifferFactory struct{}
+
+func (factory *sequentialHostNameSnifferFactory) NewHostNameSnifferWith(settings *sniffSettings) *hostname.Sniffer {
+	snifferOpts := []hostname.SequentialSnifferOption{
+		hostname.WithSequentialMaxData(settings.MaxData),
+		hostname.WithSequentialTimeout(settings.Timeout),
+	}
+	for _, strategy := range settings.Strategies {
+		snifferOpts = append(snifferOpts, hostname.WithSequentialSnifferStrategy(strategy.Incremental))
+	}
+	return hostname.NewSequentialSniffer(snifferOpts...)
+}
+
+func newHostNameSnifferFactoryFromOptions(opts *options, addrs *dnsmap.Map) *hostNameSnifferFactory {
+	factory := &hostNameSnifferFactory{
+		addrs: addrs,
+		rules: *opts.SniffRules,
+		defaults: sniffSettings{
+			Strategies: *opts.SniffStrategies,
+			Timeout:    *opts.SniffTimeout,
+			MaxData:    *opts.SniffMaxBytes,
+		},
+	}
+	if *opts.SniffEngine == sniffEngineSequential {
+		factory.hostNameSnifferFactoryInterface = &sequentialHostNameSnifferFactory{}
 	} else {
-		return &hostNameSnifferFactory{&parallelHostNameSnifferFactory{opts}}
+		factory.hostNameSnifferFactoryInterface = &parallelHostNameSnifferFactory{}
 	}
+	return factory
 }
 
 type connectionContext struct {
-	Opts            *options
-	C               *net.TCPConn
-	HostNameSniffer *hostname.Sniffer
+	Opts                   *options
+	C                      *net.TCPConn
+	HostNameSnifferFactory *hostNameSnifferFactory
+	// Created by HostNameSnifferFactory once the original destination is known
+	HostNameSniffer  *hostname.Sniffer
+	Dialer           *dialer.Dialer
+	LoopDetector     *loopDetector
+	HostNameVerifier *hostNameVerifier
+	ClientLimiter    *clientLimiter
+	AccessList       *accessList
+	Shaper           *bandwidthShaper
+	UpstreamPool     *upstreamPool
+	// Hostnames of the addresses given out by the embedded DNS server
+	DNSMap *dnsmap.Map
+	// Client data read outside of the sniffer, to be sent upstream first
+	Pending []byte
 }
 
-func main() {
-	options := options{
-		LocalPort:     flag.Int("local-port", 8443, "local port to listen on for REDIRECTed traffic"),
-		UpstreamProxy: flag.String("upstream-proxy", "localhost:3128", "upstream proxy to CONNECT to"),
-		VersionFlag:   flag.Bool("version", false, "show version information"),
-		DialTimeout:   flag.Duration("dial-timeout", 3*time.Minute, "timeout for connections to the proxy"),
-		SniffTimeout: flag.Duration("sniff-timeout", -1,
+func newOptions(flags *flag.FlagSet) *options {
+	opts := &options{
+		LocalPort:     flags.Int("local-port", 8443, "local port to listen on for REDIRECTed traffic"),
+		UpstreamProxy: flags.String("upstream-proxy", "localhost:3128", "upstream proxy to CONNECT to"),
+		VersionFlag:   flags.Bool("version", false, "show version information"),
+		DialTimeout:   flags.Duration("dial-timeout", 3*time.Minute, "timeout for connections to the proxy"),
+		DialAttemptTimeout: flags.Duration("dial-attempt-timeout", 10*time.Second,
+			"timeout for connecting to each address of the proxy, before moving to the next one (0 -> -dial-timeout)"),
+		SniffTimeout: flags.Duration("sniff-timeout", -1,
 			fmt.Sprintf("maximum acceptable delay for hostname sniffing (<0 -> disable, =0 -> %v)", hostname.SniffDefaultTimeout)),
-		SniffMaxBytes: flag.Int64("sniff-max-bytes", hostname.SniffDefaultMaxData,
+		SniffMaxBytes: flags.Int64("sniff-max-bytes", hostname.SniffDefaultMaxData,
 			"maximum number of bytes used for hostname sniffing (<= 0 -> use default)"),
+		SniffEngine: flags.String("sniff-engine", sniffEngineParallel,
+			fmt.Sprintf("how to run hostname sniffing strategies: %q runs each in its own goroutine, %q runs all in the connection goroutine",
+				sniffEngineParallel, sniffEngineSequential)),
+		SniffStrategies: &sniffStrategyList{},
+		SniffRules:      &sniffRules{},
+		ECHPolicy: flags.String("ech-policy", echPolicyTrust,
+			fmt.Sprintf("what to do with TLS clients using Encrypted Client Hello: %q connects to the public name, "+
+				"%q to the original destination address, %q rejects them", echPolicyTrust, echPolicyIP, echPolicyReject)),
+		PortMismatch: flags.String("port-mismatch", portMismatchClient,
+			fmt.Sprintf("what to do when a client names a port other than the original destination port, as in an HTTP Host header: "+
+				"%q connects to the client's port, %q to the original destination port, %q to the original destination address, %q rejects the connection",
+				portMismatchClient, portMismatchOrigin, portMismatchIP, portMismatchReject)),
+		VerifyHostName: flags.String("verify-hostname", verifyHostNameOff,
+			fmt.Sprintf("check that sniffed hostnames resolve to the original destination address: %q disables the check, "+
+				"on mismatch %q connects to the original destination address, %q rejects the connection",
+				verifyHostNameOff, verifyHostNameIP, verifyHostNameReject)),
+		VerifyHostNameCIDRs: &domainPrefixList{},
+		STARTTLS:            &starttlsPorts{},
+		DNSListen: flags.String("dns-listen", "",
+			"address to serve DNS on, learning the hostnames of the addresses in the answers (empty -> disable)"),
+		DNSUpstream: flags.String("dns-upstream", "",
+			"comma separated list of DNS servers to forward queries to, as IP or IP:PORT"),
+		DNSFakePrefixes: flags.String("dns-fake-prefix", "",
+			"comma separated list of prefixes, at most one per address family, to answer A and AAAA queries with synthetic addresses from (empty -> forward them)"),
+		DNSMinTTL: flags.Duration("dns-min-ttl", dnsmap.DefaultMinTTL,
+			"minimum time the hostnames of addresses in DNS answers are remembered for"),
+		FwMark: flags.Uint("fwmark", 0,
+			"firewall mark (SO_MARK) to set on outbound sockets, to exempt them from REDIRECT rules (0 -> disable)"),
+		MaxConnections: flags.Int("max-connections", 0,
+			"maximum number of connections handled at the same time (<= 0 -> unlimited)"),
+		MaxConnectionsMode: flags.String("max-connections-mode", maxConnectionsModeBlock,
+			fmt.Sprintf("what to do when -max-connections is reached: %q stops accepting, %q accepts and closes",
+				maxConnectionsModeBlock, maxConnectionsModeClose)),
+		ClientLimits:     &clientLimitRules{},
+		BandwidthConn:    &bandwidthLimit{},
+		BandwidthClient:  &bandwidthLimit{},
+		BandwidthDomains: &domainBandwidthGroups{},
+		AccessRules:      &accessRules{},
+		IdleTimeout: flags.Duration("idle-timeout", 0,
+			"tear tunnels down after this long without traffic in either direction (0 -> disable)"),
+		MaxTunnelLifetime: flags.Duration("max-tunnel-lifetime", 0,
+			"tear tunnels down after this long, regardless of traffic (0 -> disable)"),
+		KeepAliveIdle: flags.Duration("keepalive-idle", 0,
+			"idle time before sending TCP keepalive probes (0 -> 15s, <0 -> disable keepalives)"),
+		KeepAliveInterval: flags.Duration("keepalive-interval", 0,
+			"interval between TCP keepalive probes (0 -> 15s)"),
+		KeepAliveCount: flags.Int("keepalive-count", 0,
+			"number of unanswered TCP keepalive probes before dropping a connection (0 -> 9)"),
+		TCPUserTimeout: flags.Duration("tcp-user-timeout", 0,
+			"maximum time transmitted data may remain unacknowledged before dropping a connection (0 -> system default)"),
+		RejectClose: flags.String("reject-close", rejectCloseFIN,
+			fmt.Sprintf("how to close rejected client connections: %q for a graceful close, %q to reset them",
+				rejectCloseFIN, rejectCloseRST)),
+		DirectMode: flags.String("direct-mode", directModeClose,
+			fmt.Sprintf("what to do with connections which were not REDIRECTed: %q, %q (reset), "+
+				"%q (serve a status page) or %q (act as an explicit proxy)",
+				directModeClose, directModeDrop, directModeStatus, directModeProxy)),
+		UpstreamPoolSize: flags.Int("upstream-pool-size", 0,
+			"number of idle connections to keep open to the upstream proxy, ready for new clients (0 -> disable)"),
+		UpstreamPoolMaxAge: flags.Duration("upstream-pool-max-age", 30*time.Second,
+			"close idle pooled connections after this long, before the proxy drops them (0 -> never)"),
+		MetricsListen: flags.String("metrics-listen", "",
+			"address to serve metrics on, at /debug/vars (empty -> disable)"),
+	}
+	_ = opts.SniffStrategies.Set(defaultSniffStrategies)
+	flags.Var(opts.SniffStrategies, "sniff-strategies",
+		fmt.Sprintf("comma separated list of hostname sniffing strategies to run, among %s", sniffStrategyNames()))
+	flags.Var(opts.SniffRules, "sniff-rule",
+		"hostname sniffing strategies for some destinations, as STRATEGY[,STRATEGY...][:key=value,...] with keys port, dest, timeout and max-bytes, "+
+			"or none to disable sniffing (can be repeated, first match wins)")
+	flags.Var(opts.ClientLimits, "client-limit",
+		"per-client limits, as PREFIX:key=value,... with keys conns, rate, burst, connects and scope (can be repeated)")
+	flags.Var(opts.BandwidthConn, "bandwidth-conn",
+		"bandwidth limit for each connection, as up=RATE,down=RATE,burst=SIZE in bytes (k, M, G suffixes allowed)")
+	flags.Var(opts.BandwidthClient, "bandwidth-client",
+		"bandwidth limit shared by all connections from the same client address, same format as -bandwidth-conn")
+	flags.Var(opts.BandwidthDomains, "bandwidth-domain",
+		"bandwidth limit shared by destinations in a group of domains, as DOMAIN[;DOMAIN...]:up=RATE,... (can be repeated)")
+	flags.Var(opts.VerifyHostNameCIDRs, "verify-hostname-cidr",
+		"networks accepted for a group of domains by -verify-hostname, besides their DNS answers, as DOMAIN[;DOMAIN...]:CIDR[;CIDR...] (can be repeated)")
+	flags.Var(opts.STARTTLS, "starttls",
+		"ports where to relay plaintext mail sessions and check the SNI sent after STARTTLS, as PROTOCOL:PORT[;PORT...] with PROTOCOL smtp, imap, pop3 or postgres (can be repeated)")
+	flags.Var(opts.AccessRules, "access-rule",
+		"allow or reject connections, as ACTION:key=value,... with keys client, host, ja3 and ja4 (can be repeated, first match wins)")
+	return opts
+}
+
+// Subcommands receive the arguments following their name and return the
+// process exit status.
+var subcommands = map[string]func(args []string) int{
+	"doctor": runDoctor,
+	"sniff":  runSniff,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(subcommand(os.Args[2:]))
+		}
+	}
+
+	options := newOptions(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [subcommand] [options]\n\nSubcommands:\n", os.Args[0])
+		for _, name := range slices.Sorted(maps.Keys(subcommands)) {
+			fmt.Fprintf(flag.CommandLine.Output(), "  %s\n", name)
+		}
+		fmt.Fprintf(flag.CommandLine.Output(), "\nOptions:\n")
+		flag.PrintDefaults()
 	}
 	flag.Parse()
 
@@ -86,28 +381,127 @@ func main() {
 		return
 	}
 
-	hostNameSnifferFactory := newHostNameSnifferFactoryFromOptions(&options)
+	if err := validateMaxConnectionsMode(*options.MaxConnectionsMode); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validateRejectClose(*options.RejectClose); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validateDirectMode(*options.DirectMode); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validateSniffEngine(*options.SniffEngine); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validateSniffStrategies(options); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validateECHPolicy(*options.ECHPolicy); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validateVerifyHostName(*options.VerifyHostName); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validatePortMismatch(*options.PortMismatch); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validateDNSOptions(options); err != nil {
+		log.Fatalln(err)
+	}
+
+	soft, _, err := raiseNoFileLimit()
+	if err != nil {
+		log.Printf("unable to raise the file descriptor limit: %s", err)
+	}
+	if soft > 0 {
+		log.Printf("File descriptor limit is %d, enough for about %d connections", soft, soft/2)
+	}
+
+	dnsMap := newDNSMap(options)
+	hostNameSnifferFactory := newHostNameSnifferFactoryFromOptions(options, dnsMap)
+	upstreamResolver := resolver.New()
+	upstreamDialer := newUpstreamDialer(options, upstreamResolver)
+	loopDetector := newLoopDetector(options, upstreamResolver)
+	hostNameVerifier := newHostNameVerifier(options, upstreamResolver)
+	clientLimiter := newClientLimiter(*options.ClientLimits)
+	accessList := newAccessList(*options.AccessRules)
+	shaper := newBandwidthShaper(options)
+	upstreamPool := newUpstreamPool(options, upstreamDialer)
+	serveMetrics(*options.MetricsListen)
+	serveDNS(options, dnsMap)
 
 	ln, err := net.Listen("tcp4", fmt.Sprintf(":%d", *options.LocalPort))
 	if err != nil {
 		log.Fatalln(err)
 	}
 	log.Printf("Listening for TCP traffic on port %d and sending it to %s\n", *options.LocalPort, *options.UpstreamProxy)
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println(err)
-			continue
+	slots := newConnectionSlots(*options.MaxConnections)
+	acceptConnections(ln, slots, *options.MaxConnectionsMode, func(conn *net.TCPConn) {
+		if err := configureClientConn(conn, options); err != nil {
+			log.Printf("unable to set socket options for connection from %s: %s", conn.RemoteAddr().String(), err)
 		}
-		go handleConnection(&connectionContext{
-			Opts:            &options,
-			C:               conn.(*net.TCPConn),
-			HostNameSniffer: hostNameSnifferFactory.NewHostNameSniffer(),
+		handleConnection(&connectionContext{
+			Opts:                   options,
+			C:                      conn,
+			HostNameSnifferFactory: hostNameSnifferFactory,
+			HostNameSniffer:        hostname.NewNullSniffer(),
+			Dialer:                 upstreamDialer,
+			LoopDetector:           loopDetector,
+			HostNameVerifier:       hostNameVerifier,
+			ClientLimiter:          clientLimiter,
+			AccessList:             accessList,
+			Shaper:                 shaper,
+			UpstreamPool:           upstreamPool,
+			DNSMap:                 dnsMap,
 		})
+	})
+}
+
+// sendConnect asks the proxy at the other end of pipe to open a tunnel to
+// origin and returns its response. The response body is left unread. It also
+// returns the data read from pipe past the response header: if the tunnel was
+// set up, that data comes from origin, for example the greeting of a server
+// which speaks first, and must be sent to the client.
+func sendConnect(pipe net.Conn, origin string) (*http.Response, []byte, error) {
+	connectReq, err := http.NewRequest("CONNECT", "http://"+origin, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = connectReq.Write(pipe); err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(pipe)
+	rsp, err := http.ReadResponse(r, connectReq)
+	if err != nil {
+		return nil, nil, err
 	}
+	buffered, _ := r.Peek(r.Buffered())
+	return rsp, bytes.Clone(buffered), nil
+}
+
+// Upper bound for error bodies from the upstream proxy relayed to clients
+const maxConnectErrorBody = 64 << 10
+
+// connectError is returned when the upstream proxy refuses a CONNECT. It keeps
+// the response, so that it can be relayed to the client.
+type connectError struct {
+	Proxy      string
+	Origin     string
+	StatusCode int
+	Status     string
+	Header     http.Header
+	Body       []byte
 }
 
-func setupConnectUpstream(ctx *connectionContext, origin string) (c *net.TCPConn, err error) {
+func (e *connectError) Error() string {
+	return fmt.Sprintf("CONNECT to proxy %s for origin %s returned status code %d instead of 2xx",
+		e.Proxy, e.Origin, e.StatusCode)
+}
+
+// setupConnectUpstream opens a tunnel to origin through the upstream proxy. It
+// returns the connection to the proxy, and the data origin already sent through
+// it, which must be relayed to the client first.
+func setupConnectUpstream(ctx *connectionContext, origin string) (c *net.TCPConn, buffered []byte, err error) {
 	var pipe *net.TCPConn
 
 	defer func() {
@@ -116,20 +510,34 @@ func setupConnectUpstream(ctx *connectionContext, origin string) (c *net.TCPConn
 		}
 	}()
 
-	pipe0, err := net.DialTimeout("tcp4", *ctx.Opts.UpstreamProxy, *ctx.Opts.DialTimeout)
-	if err != nil {
-		return
+	dial := func() error {
+		pipe0, err := ctx.Dialer.Dial("tcp", *ctx.Opts.UpstreamProxy)
+		if err != nil {
+			return err
+		}
+		pipe = pipe0.(*net.TCPConn)
+		return nil
 	}
-	pipe = pipe0.(*net.TCPConn)
 
-	connectReq, err := http.NewRequest("CONNECT", "http://"+origin, nil)
-	if err != nil {
-		return
+	pipe = ctx.UpstreamPool.Get()
+	pooled := pipe != nil
+	if !pooled {
+		if err = dial(); err != nil {
+			return
+		}
 	}
-	if err = connectReq.Write(pipe); err != nil {
-		return
+
+	connectRsp, buffered, err := sendConnect(pipe, origin)
+	if err != nil && pooled {
+		// The proxy may have dropped the pooled connection after it was last
+		// checked: retry once on a fresh one
+		_ = pipe.Close()
+		pipe = nil
+		if err = dial(); err != nil {
+			return
+		}
+		connectRsp, buffered, err = sendConnect(pipe, origin)
 	}
-	connectRsp, err := http.ReadResponse(bufio.NewReader(pipe), connectReq)
 	if err != nil {
 		return
 	}
@@ -144,65 +552,180 @@ func setupConnectUpstream(ctx *connectionContext, origin string) (c *net.TCPConn
 
 	// So, if we get a 2xx and have read all headers, rest of the data must come
 	// from the origin, so don't try to read the body. Otherwise, we have an
-	// error, and that may have a body, but we do not care about it.
+	// error, and its body may explain the reason to the client.
 
 	if connectRsp.StatusCode/100 != 2 {
-		err = fmt.Errorf("CONNECT to proxy %s for origin %s returned status code %d instead of 2xx",
-			*ctx.Opts.UpstreamProxy, origin, connectRsp.StatusCode)
+		_ = pipe.SetReadDeadline(time.Now().Add(connectErrorBodyTimeout))
+		body, _ := io.ReadAll(io.LimitReader(connectRsp.Body, maxConnectErrorBody))
+		err = &connectError{
+			Proxy:      *ctx.Opts.UpstreamProxy,
+			Origin:     origin,
+			StatusCode: connectRsp.StatusCode,
+			Status:     connectRsp.Status,
+			Header:     connectRsp.Header,
+			Body:       body,
+		}
 		return
 	}
 
-	return pipe, nil
+	return pipe, buffered, nil
 }
 
 func handleConnection(ctx *connectionContext) {
 	defer ctx.C.Close()
+	metricConnections.Add(1)
 
-	origin, err := getOriginalDestination(ctx.C)
+	client := ctx.C.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+	releaseClient, err := ctx.ClientLimiter.Admit(client)
 	if err != nil {
+		metricRejections.Add("client-limit", 1)
+		log.Printf("discarding connection: %s", err)
+		rejectClient(ctx, "", err)
+		return
+	}
+	defer releaseClient()
+
+	origin, err := getOriginalDestination(ctx.C)
+	if errors.Is(err, errNotRedirected) {
+		if origin = handleDirectConnection(ctx, err); origin == "" {
+			return
+		}
+	} else if err != nil {
 		log.Println(err)
 		return
 	}
+	if err = ctx.LoopDetector.Check(origin); err != nil {
+		log.Printf("discarding connection from %s: %s", ctx.C.RemoteAddr().String(), err)
+		rejectClient(ctx, origin, err)
+		return
+	}
 
-	hostName, err := ctx.HostNameSniffer.SniffHostName(ctx.C)
+	var starttlsProtocol string
+	if len(ctx.Pending) > 0 {
+		// Part of the client data has already been consumed, and the
+		// destination is known anyway
+		ctx.HostNameSniffer = hostname.NewNullSniffer()
+	} else if starttlsProtocol = ctx.Opts.STARTTLS.protocolFor(origin); starttlsProtocol != "" {
+		// The server speaks first, the hostname can only be found after
+		// STARTTLS, once the tunnel is up
+		ctx.HostNameSniffer = hostname.NewNullSniffer()
+	} else {
+		ctx.HostNameSniffer = ctx.HostNameSnifferFactory.NewHostNameSniffer(origin)
+	}
+	metadata, err := ctx.HostNameSniffer.SniffMetadata(ctx.C)
+	// For the paths which do not get to send the buffered data upstream
+	defer ctx.HostNameSniffer.Release()
 	if err == nil {
-		// There must always be a port in the destination of a CONNECT. If the returned name
-		// does not contain one, append the port from the original destination.
-		if !strings.ContainsRune(hostName, ':') {
-			parts := strings.Split(origin, ":")
-			hostName = fmt.Sprintf("%s:%s", hostName, parts[1])
+		var port string
+		useHostName, echErr := applyECHPolicy(*ctx.Opts.ECHPolicy, metadata)
+		if echErr != nil {
+			metricRejections.Add("ech", 1)
+			log.Printf("discarding connection from %s to %s: %s", ctx.C.RemoteAddr().String(), origin, echErr)
+			rejectClient(ctx, origin, echErr)
+			return
+		}
+		if useHostName {
+			var portErr error
+			if useHostName, port, portErr = applyPortMismatchPolicy(*ctx.Opts.PortMismatch, metadata, origin); portErr != nil {
+				metricRejections.Add("port-mismatch", 1)
+				log.Printf("discarding connection from %s to %s: %s", ctx.C.RemoteAddr().String(), origin, portErr)
+				rejectClient(ctx, origin, portErr)
+				return
+			}
+		}
+		if metadata.Strategy == hostname.StrategyNameAddressMap {
+			// The original destination was given out as an address of the name
+			metricDNSHostNames.Add(1)
+		} else if useHostName {
+			var verifyErr error
+			if useHostName, verifyErr = ctx.HostNameVerifier.Check(metadata.HostName, origin); verifyErr != nil {
+				metricRejections.Add("hostname-mismatch", 1)
+				log.Printf("discarding connection from %s to %s: %s", ctx.C.RemoteAddr().String(), origin, verifyErr)
+				rejectClient(ctx, origin, verifyErr)
+				return
+			}
+		}
+		if useHostName {
+			// There must always be a port in the destination of a CONNECT. If the client
+			// did not give one, the port from the original destination is used.
+			origin = net.JoinHostPort(metadata.HostName, port)
 		}
-		origin = hostName
 	} else {
 		if errors.As(err, new(*hostname.FatalError)) {
 			log.Printf("fatal hostname sniffing error, aborting connection %s: %s", ctx.C.RemoteAddr().String(), err)
+			rejectClient(ctx, origin, err)
 			return
 		}
 	}
 
-	pipe, err := setupConnectUpstream(ctx, origin)
+	// Synthetic addresses are left when no hostname was sniffed, or policies
+	// chose the original destination over it
+	if resolved, fakeErr := resolveFakeOrigin(ctx.DNSMap, origin); fakeErr != nil {
+		metricRejections.Add("fake-address", 1)
+		log.Printf("discarding connection from %s to %s: %s", ctx.C.RemoteAddr().String(), origin, fakeErr)
+		rejectClient(ctx, origin, fakeErr)
+		return
+	} else if resolved != origin {
+		metricDNSHostNames.Add(1)
+		origin = resolved
+	}
+
+	tlsFingerprints.Observe(client, metadata)
+	destination, _, _ := net.SplitHostPort(origin)
+	if err = ctx.AccessList.Check(client, destination, metadata); err != nil {
+		metricRejections.Add("access-rule", 1)
+		log.Printf("discarding connection from %s to %s: %s%s",
+			ctx.C.RemoteAddr().String(), origin, err, describeFingerprints(metadata))
+		rejectClient(ctx, origin, err)
+		return
+	}
+
+	if err = ctx.ClientLimiter.AllowConnect(client); err != nil {
+		metricRejections.Add("client-limit", 1)
+		log.Printf("discarding connection to %s: %s", origin, err)
+		rejectClient(ctx, origin, err)
+		return
+	}
+
+	pipe, buffered, err := setupConnectUpstream(ctx, origin)
 	if err != nil {
 		log.Println(err)
+		rejectClient(ctx, origin, err)
 		return
 	}
 	defer pipe.Close()
 
+	if _, err = pipe.Write(ctx.Pending); err != nil {
+		return
+	}
 	_, err = ctx.HostNameSniffer.GetBufferedData().WriteTo(pipe)
+	// The buffer is no longer needed, no point keeping it for the whole life
+	// of the tunnel
+	ctx.HostNameSniffer.Release()
 	if err != nil {
 		return
 	}
-	handleTunnel(ctx.C, pipe)
-}
 
-func handleTunnel(in, out *net.TCPConn) {
-	var wg sync.WaitGroup
-	copier := func(dst, src *net.TCPConn) {
-		defer wg.Done()
-		_, _ = io.Copy(dst, src)
-		_ = dst.CloseWrite()
+	upLimiters, downLimiters, releaseShaper := ctx.Shaper.Acquire(client, destination)
+	defer releaseShaper()
+	t := &tunnel{
+		Client:       ctx.C,
+		Upstream:     pipe,
+		UpLimiters:   upLimiters,
+		DownLimiters: downLimiters,
+		IdleTimeout:  *ctx.Opts.IdleTimeout,
+		MaxLifetime:  *ctx.Opts.MaxTunnelLifetime,
+	}
+	// Servers which speak first may have sent their greeting along with the
+	// CONNECT response
+	if len(buffered) > 0 {
+		if _, err = ctx.C.Write(buffered); err != nil {
+			return
+		}
+		t.transferredDown(len(buffered))
+	}
+	if starttlsProtocol != "" && relaySTARTTLS(ctx, t, origin, starttlsProtocol) {
+		return
 	}
-	wg.Add(2)
-	go copier(in, out)
-	go copier(out, in)
-	wg.Wait()
+	t.Run()
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/binary-manu/handyproxy/internal/resolver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffStrategyList(t *testing.T) {
+	var list sniffStrategyList
+	require.NoError(t, list.Set("tls, xmpp,tls,postgres"))
+	require.Equal(t, "tls,xmpp,postgres", list.String())
+
+	for _, value := range []string{"", "tls,", "mqtt", "http,TLS"} {
+		t.Run(value, func(t *testing.T) {
+			var list sniffStrategyList
+			require.Error(t, list.Set(value))
+		})
+	}
+}
+
+func TestValidateSniffStrategies(t *testing.T) {
+	tests := []struct {
+		Description string
+		Args        []string
+		Valid       bool
+	}{
+		{"Defaults", nil, true},
+		{"Strategies", []string{"-sniff-strategies", "tls,xmpp"}, true},
+		{"Rules", []string{"-sniff-rule", "none:port=5432", "-sniff-rule", "tls:port=443"}, true},
+		{"Postgres strategy", []string{"-sniff-strategies", "tls,postgres"}, false},
+		{"Postgres rule", []string{"-sniff-rule", "postgres:port=5432"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.PanicOnError)
+			opts := newOptions(flags)
+			require.NoError(t, flags.Parse(test.Args))
+			if test.Valid {
+				require.NoError(t, validateSniffStrategies(opts))
+			} else {
+				require.Error(t, validateSniffStrategies(opts))
+			}
+		})
+	}
+}
+
+func TestSetupConnectUpstream(t *testing.T) {
+	tests := []struct {
+		Description string
+		Response    string
+		Buffered    string
+		Status      int
+	}{
+		{"Tunnel", "HTTP/1.1 200 Connection established\r\n\r\n", "", 0},
+		// Servers which speak first may share a segment with the response
+		{"Greeting", "HTTP/1.1 200 Connection established\r\n\r\n220 mail.example.com ESMTP\r\n", "220 mail.example.com ESMTP\r\n", 0},
+		{"Refused", "HTTP/1.1 403 Forbidden\r\nContent-Length: 6\r\n\r\ndenied", "", 403},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.PanicOnError)
+			opts := newOptions(flags)
+			require.NoError(t, flags.Parse([]string{"-upstream-proxy", serveFakeProxy(t, test.Response)}))
+			ctx := &connectionContext{
+				Opts:   opts,
+				Dialer: newUpstreamDialer(opts, resolver.New()),
+			}
+
+			pipe, buffered, err := setupConnectUpstream(ctx, "192.0.2.1:25")
+			if test.Status != 0 {
+				var connectErr *connectError
+				require.ErrorAs(t, err, &connectErr)
+				require.Equal(t, test.Status, connectErr.StatusCode)
+				require.Equal(t, "denied", string(connectErr.Body))
+				return
+			}
+			require.NoError(t, err)
+			defer pipe.Close()
+			require.Equal(t, test.Buffered, string(buffered))
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/binary-manu/handyproxy/internal/ratelimit"
+)
+
+// rateLimitedLogger drops messages beyond a given rate, so that clients cannot
+// flood the log. The number of dropped messages is reported with the next
+// message logged.
+type rateLimitedLogger struct {
+	bucket     *ratelimit.TokenBucket
+	suppressed atomic.Int64
+}
+
+func newRateLimitedLogger(perSecond float64, burst int) *rateLimitedLogger {
+	return &rateLimitedLogger{bucket: ratelimit.NewTokenBucket(perSecond, burst)}
+}
+
+func (logger *rateLimitedLogger) Printf(format string, args ...any) {
+	if !logger.bucket.Allow() {
+		logger.suppressed.Add(1)
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if suppressed := logger.suppressed.Swap(0); suppressed > 0 {
+		msg = fmt.Sprintf("%s (%d similar messages suppressed)", msg, suppressed)
+	}
+	log.Print(msg)
+}
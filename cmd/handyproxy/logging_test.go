@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/binary-manu/handyproxy/internal/ratelimit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitedLogger(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	// Tokens come back far too slowly to matter: only the burst is logged
+	logger := newRateLimitedLogger(0.001, 2)
+	for i := range 10 {
+		logger.Printf("message %d", i)
+	}
+	require.Equal(t, "message 0\nmessage 1\n", output.String())
+
+	// The next message logged reports those dropped
+	output.Reset()
+	logger.bucket = ratelimit.NewTokenBucket(0.001, 1)
+	logger.Printf("message %d", 10)
+	require.Equal(t, "message 10 (8 similar messages suppressed)", strings.TrimSpace(output.String()))
+}
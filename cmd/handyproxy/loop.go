@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/resolver"
+)
+
+// loopDetector recognizes connections whose original destination is
+// handyproxy itself, either its listener or its upstream proxy. Forwarding them
+// would make handyproxy connect to itself over and over.
+type loopDetector struct {
+	localPort    uint16
+	localAddrs   map[netip.Addr]struct{}
+	resolver     *resolver.Resolver
+	upstreamHost string
+	upstreamPort uint16
+	timeout      time.Duration
+}
+
+func newLoopDetector(opts *options, resolver *resolver.Resolver) *loopDetector {
+	detector := &loopDetector{
+		localPort:  uint16(*opts.LocalPort),
+		localAddrs: make(map[netip.Addr]struct{}),
+		resolver:   resolver,
+		timeout:    *opts.DialTimeout,
+	}
+
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("loop detection: unable to list local addresses: %s", err)
+	}
+	for _, ifAddr := range ifAddrs {
+		if ipNet, ok := ifAddr.(*net.IPNet); ok {
+			if addr, ok := netip.AddrFromSlice(ipNet.IP); ok {
+				detector.localAddrs[addr.Unmap()] = struct{}{}
+			}
+		}
+	}
+
+	host, port, err := net.SplitHostPort(*opts.UpstreamProxy)
+	if err == nil {
+		var portNum int
+		if portNum, err = net.LookupPort("tcp", port); err == nil {
+			detector.upstreamHost, detector.upstreamPort = host, uint16(portNum)
+		}
+	}
+	if err != nil {
+		log.Printf("loop detection: invalid upstream proxy %s: %s", *opts.UpstreamProxy, err)
+	}
+
+	return detector
+}
+
+// Check returns an error if connecting to origin would loop back into
+// handyproxy. Origins that are not IP:port pairs are never considered loops.
+func (detector *loopDetector) Check(origin string) error {
+	addrPort, err := netip.ParseAddrPort(origin)
+	if err != nil {
+		return nil
+	}
+	addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+
+	if addrPort.Port() == detector.localPort {
+		addr := addrPort.Addr()
+		if _, isLocal := detector.localAddrs[addr]; isLocal || addr.IsLoopback() || addr.IsUnspecified() {
+			return fmt.Errorf("original destination %s is handyproxy's own listener, refusing to loop", origin)
+		}
+	}
+	if detector.upstreamHost == "" || addrPort.Port() != detector.upstreamPort {
+		return nil
+	}
+	// The upstream addresses may change over time, but are usually cached
+	ctx, cancel := context.WithTimeout(context.Background(), detector.timeout)
+	defer cancel()
+	upstreamAddrs, err := detector.resolver.LookupNetIP(ctx, detector.upstreamHost)
+	if err != nil {
+		return nil
+	}
+	if slices.Contains(upstreamAddrs, addrPort.Addr()) {
+		return fmt.Errorf("original destination %s is the upstream proxy, refusing to loop", origin)
+	}
+	return nil
+}
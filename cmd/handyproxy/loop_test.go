@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"net/netip"
+	"testing"
+
+	"github.com/binary-manu/handyproxy/internal/resolver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoopDetector(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.PanicOnError)
+	opts := newOptions(flags)
+	require.NoError(t, flags.Parse([]string{"-local-port", "8443", "-upstream-proxy", "192.0.2.10:3128"}))
+	detector := newLoopDetector(opts, resolver.New())
+	// An address of a local interface
+	detector.localAddrs[netip.MustParseAddr("198.51.100.7")] = struct{}{}
+
+	tests := []struct {
+		Description string
+		Origin      string
+		Loop        bool
+	}{
+		{"Loopback listener", "127.0.0.1:8443", true},
+		{"Other loopback address", "127.0.0.2:8443", true},
+		{"IPv4-mapped loopback listener", "[::ffff:127.0.0.1]:8443", true},
+		{"Unspecified address", "0.0.0.0:8443", true},
+		{"Local interface listener", "198.51.100.7:8443", true},
+		{"IPv4-mapped local interface listener", "[::ffff:198.51.100.7]:8443", true},
+		{"Other local port", "198.51.100.7:443", false},
+		{"Remote host on the listener port", "203.0.113.1:8443", false},
+		{"Upstream proxy", "192.0.2.10:3128", true},
+		{"IPv4-mapped upstream proxy", "[::ffff:192.0.2.10]:3128", true},
+		{"Other port of the upstream proxy", "192.0.2.10:443", false},
+		{"Other host on the upstream port", "192.0.2.11:3128", false},
+		{"Hostname", "www.example.com:8443", false},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			err := detector.Check(test.Origin)
+			if test.Loop {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLoopDetectorInvalidUpstream(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.PanicOnError)
+	opts := newOptions(flags)
+	require.NoError(t, flags.Parse([]string{"-local-port", "8443", "-upstream-proxy", "192.0.2.10"}))
+	detector := newLoopDetector(opts, resolver.New())
+
+	// The listener is still protected
+	require.Error(t, detector.Check("127.0.0.1:8443"))
+	require.NoError(t, detector.Check("192.0.2.10:3128"))
+}
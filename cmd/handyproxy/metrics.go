@@ -0,0 +1,45 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Metrics are published via expvar, and can be read as JSON from /debug/vars
+// on the address given by -metrics-listen.
+var (
+	metricConnections    = expvar.NewInt("connections")
+	metricRejections     = expvar.NewMap("rejections")
+	metricTunnelsAborted = expvar.NewMap("tunnels_aborted")
+	metricUpstreamPool   = expvar.NewMap("upstream_pool")
+	// Connections by JA4 fingerprint of the TLS client
+	metricTLSFingerprints = expvar.NewMap("tls_fingerprints")
+	// Connections whose ClientHello carries an ECH extension, real or not
+	metricECHConnections = expvar.NewInt("ech_connections")
+	// Sniffed hostnames not matching the original destination address
+	metricHostNameMismatches = expvar.NewInt("hostname_mismatches")
+	// Connections whose hostname came from the embedded DNS server
+	metricDNSHostNames = expvar.NewInt("dns_hostnames")
+	// Ports named by clients not matching the original destination port
+	metricPortMismatches = expvar.NewInt("port_mismatches")
+	// Updated on the data path, so kept as plain atomics and published below
+	metricBytesUp   atomic.Int64
+	metricBytesDown atomic.Int64
+)
+
+func init() {
+	expvar.Publish("bytes_up", expvar.Func(func() any { return metricBytesUp.Load() }))
+	expvar.Publish("bytes_down", expvar.Func(func() any { return metricBytesDown.Load() }))
+}
+
+func serveMetrics(address string) {
+	if address == "" {
+		return
+	}
+	go func() {
+		// expvar registers its handler with the default mux
+		log.Printf("metrics server failed: %s", http.ListenAndServe(address, nil))
+	}()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/binary-manu/handyproxy/internal/hostname"
+)
+
+const (
+	portMismatchClient = "client"
+	portMismatchOrigin = "origin"
+	portMismatchIP     = "ip"
+	portMismatchReject = "reject"
+)
+
+// Mismatches are not errors with most policies, but may be frequent
+var portMismatchLog = newRateLimitedLogger(0.1, 5)
+
+func validatePortMismatch(policy string) error {
+	switch policy {
+	case portMismatchClient, portMismatchOrigin, portMismatchIP, portMismatchReject:
+		return nil
+	default:
+		return fmt.Errorf("invalid port mismatch policy %q, must be one of %q, %q, %q or %q",
+			policy, portMismatchClient, portMismatchOrigin, portMismatchIP, portMismatchReject)
+	}
+}
+
+type portMismatchError struct {
+	HostName   string
+	Port       uint16
+	OriginPort string
+}
+
+func (e *portMismatchError) Error() string {
+	return fmt.Sprintf("port %d requested for %s does not match the original destination port %s",
+		e.Port, e.HostName, e.OriginPort)
+}
+
+// applyPortMismatchPolicy decides which port to connect to when the client
+// named one along with the hostname, like in an HTTP Host header, which may
+// differ from the port of the original destination. It returns the port and
+// whether the hostname can be used as the destination, rather than the
+// original destination address, or an error if the connection must be
+// rejected.
+func applyPortMismatchPolicy(policy string, metadata *hostname.Metadata, origin string) (bool, string, error) {
+	_, originPort, err := net.SplitHostPort(origin)
+	if err != nil || metadata.Port == 0 || strconv.Itoa(int(metadata.Port)) == originPort {
+		return true, originPort, nil
+	}
+
+	metricPortMismatches.Add(1)
+	err = &portMismatchError{metadata.HostName, metadata.Port, originPort}
+	switch policy {
+	case portMismatchOrigin:
+		portMismatchLog.Printf("%s, connecting to the original destination port", err)
+		return true, originPort, nil
+	case portMismatchIP:
+		portMismatchLog.Printf("%s, connecting to the original destination", err)
+		return false, originPort, nil
+	case portMismatchReject:
+		return false, originPort, err
+	default:
+		return true, strconv.Itoa(int(metadata.Port)), nil
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/binary-manu/handyproxy/internal/hostname"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortMismatchPolicy(t *testing.T) {
+	noPort := &hostname.Metadata{HostName: "www.example.com"}
+	samePort := &hostname.Metadata{HostName: "www.example.com", Port: 80}
+	otherPort := &hostname.Metadata{HostName: "www.example.com", Port: 8080}
+	tests := []struct {
+		Policy      string
+		Metadata    *hostname.Metadata
+		UseHostName bool
+		Port        string
+		Rejected    bool
+	}{
+		{portMismatchClient, noPort, true, "80", false},
+		{portMismatchReject, noPort, true, "80", false},
+		{portMismatchReject, samePort, true, "80", false},
+		{portMismatchClient, otherPort, true, "8080", false},
+		{portMismatchOrigin, otherPort, true, "80", false},
+		{portMismatchIP, otherPort, false, "80", false},
+		{portMismatchReject, otherPort, false, "80", true},
+	}
+	for _, test := range tests {
+		t.Run(test.Policy+"/"+test.Metadata.Authority(), func(t *testing.T) {
+			useHostName, port, err := applyPortMismatchPolicy(test.Policy, test.Metadata, "192.0.2.1:80")
+			require.Equal(t, test.UseHostName, useHostName)
+			require.Equal(t, test.Port, port)
+			if test.Rejected {
+				require.ErrorAs(t, err, new(*portMismatchError))
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+	require.Error(t, validatePortMismatch("ignore"))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/hostname"
+)
+
+const (
+	// How long to wait for the error body of a failed CONNECT
+	connectErrorBodyTimeout = 2 * time.Second
+	// How long to spend sending a rejection to the client
+	rejectWriteTimeout = 5 * time.Second
+	// How long to keep reading from the client after rejecting it. Closing a
+	// socket with unread data makes the kernel send an RST, which may discard
+	// the rejection before the client has read it.
+	rejectDrainTimeout = time.Second
+)
+
+const (
+	rejectCloseFIN = "fin"
+	rejectCloseRST = "rst"
+)
+
+func validateRejectClose(mode string) error {
+	switch mode {
+	case rejectCloseFIN, rejectCloseRST:
+		return nil
+	default:
+		return fmt.Errorf("invalid reject close mode %q, must be %q or %q", mode, rejectCloseFIN, rejectCloseRST)
+	}
+}
+
+// rejectClient tells the client that its connection will not be forwarded,
+// in a form suitable for the protocol it speaks, if that is known from the
+// data read from it so far. The connection is then prepared to be closed
+// by the caller, gracefully or with an RST, according to -reject-close.
+func rejectClient(ctx *connectionContext, origin string, err error) {
+	if *ctx.Opts.RejectClose == rejectCloseRST {
+		// Makes the caller's Close send an RST
+		defer func() { _ = ctx.C.SetLinger(0) }()
+	}
+
+	var buffered bytes.Buffer
+	buffered.Write(ctx.Pending)
+	_, _ = ctx.HostNameSniffer.GetBufferedData().WriteTo(&buffered)
+
+	var response []byte
+	switch hostname.DetectProtocol(buffered.Bytes()) {
+	case hostname.ProtocolHTTP:
+		response = httpErrorResponse(origin, err)
+	case hostname.ProtocolTLS:
+		response = tlsAlertRecord(tlsAlertFor(err))
+	default:
+		return
+	}
+
+	_ = ctx.C.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	if _, err = ctx.C.Write(response); err != nil {
+		return
+	}
+	if *ctx.Opts.RejectClose == rejectCloseFIN {
+		_ = ctx.C.CloseWrite()
+	}
+	_ = ctx.C.SetReadDeadline(time.Now().Add(rejectDrainTimeout))
+	_, _ = io.Copy(io.Discard, ctx.C)
+}
+
+// httpErrorResponse builds the response sent to HTTP clients whose request
+// could not be forwarded. Error responses from the upstream proxy are relayed
+// with their own body, if it is HTML or text. Statuses which only make sense
+// to proxy clients, like 407, are turned into a 502.
+func httpErrorResponse(origin string, err error) []byte {
+	status := "502 Bad Gateway"
+	reason := fmt.Sprintf("The proxy could not connect to %s.", origin)
+	var contentType string
+	var body []byte
+
+	if errors.As(err, new(*accessDeniedError)) {
+		status = "403 Forbidden"
+		reason = fmt.Sprintf("Access to %s is denied by the proxy configuration.", origin)
+	} else if mismatchErr := (*hostNameMismatchError)(nil); errors.As(err, &mismatchErr) {
+		status = "403 Forbidden"
+		reason = fmt.Sprintf("The destination address %s does not belong to %s.", mismatchErr.Addr, mismatchErr.HostName)
+	} else if portErr := (*portMismatchError)(nil); errors.As(err, &portErr) {
+		status = "403 Forbidden"
+		reason = fmt.Sprintf("The port %d requested for %s does not match the destination port %s.",
+			portErr.Port, portErr.HostName, portErr.OriginPort)
+	} else if fakeErr := (*fakeAddressError)(nil); errors.As(err, &fakeErr) {
+		reason = fmt.Sprintf("The address %s was given out by the proxy DNS server, which no longer knows its hostname.", fakeErr.Addr)
+	} else if connectErr := (*connectError)(nil); errors.As(err, &connectErr) {
+		reason = fmt.Sprintf("The upstream proxy refused to connect to %s: %s.", origin, connectErr.Status)
+		if code := connectErr.StatusCode; code/100 == 4 && code != http.StatusProxyAuthRequired || code/100 == 5 {
+			status = connectErr.Status
+			mediaType, _, _ := mime.ParseMediaType(connectErr.Header.Get("Content-Type"))
+			if len(connectErr.Body) > 0 && (mediaType == "text/html" || mediaType == "text/plain") {
+				contentType, body = connectErr.Header.Get("Content-Type"), connectErr.Body
+			}
+		}
+	}
+	if body == nil {
+		contentType = "text/html; charset=utf-8"
+		body = fmt.Appendf(nil, "<!DOCTYPE html>\n<html><head><title>%s</title></head>\n"+
+			"<body><h1>%s</h1><p>%s</p><hr><address>HandyProxy</address></body></html>\n",
+			html.EscapeString(status), html.EscapeString(status), html.EscapeString(reason))
+	}
+
+	var response strings.Builder
+	fmt.Fprintf(&response, "HTTP/1.1 %s\r\n", status)
+	fmt.Fprintf(&response, "Content-Type: %s\r\n", contentType)
+	fmt.Fprintf(&response, "Content-Length: %d\r\n", len(body))
+	response.WriteString("Cache-Control: no-store\r\nConnection: close\r\n\r\n")
+	response.Write(body)
+	return []byte(response.String())
+}
+
+// TLS alert descriptions, from RFC 8446
+const (
+	tlsAlertAccessDenied     = 49
+	tlsAlertInternalError    = 80
+	tlsAlertUnrecognizedName = 112
+)
+
+// tlsAlertFor picks the alert telling a TLS client why its connection was
+// rejected. Refusals by the upstream proxy because of policy become
+// access_denied, and those hinting that the server name does not exist become
+// unrecognized_name. Anything else is an internal_error.
+func tlsAlertFor(err error) byte {
+	var connectErr *connectError
+	switch {
+	case errors.As(err, new(*clientLimitError)), errors.As(err, new(*accessDeniedError)),
+		errors.As(err, new(*echRejectedError)), errors.As(err, new(*hostNameMismatchError)):
+		return tlsAlertAccessDenied
+	case errors.As(err, new(*fakeAddressError)):
+		return tlsAlertUnrecognizedName
+	case !errors.As(err, &connectErr):
+		return tlsAlertInternalError
+	case connectErr.StatusCode == http.StatusForbidden, connectErr.StatusCode == http.StatusProxyAuthRequired:
+		return tlsAlertAccessDenied
+	case connectErr.StatusCode == http.StatusNotFound,
+		// Squid reports name resolution failures this way
+		strings.HasPrefix(connectErr.Header.Get("X-Squid-Error"), "ERR_DNS_FAIL"):
+		return tlsAlertUnrecognizedName
+	default:
+		return tlsAlertInternalError
+	}
+}
+
+// tlsAlertRecord returns a fatal alert record. Its record layer version is the
+// one used by TLS 1.2 and, for compatibility, by TLS 1.3, which all clients
+// accept before a version has been negotiated.
+func tlsAlertRecord(description byte) []byte {
+	const (
+		recordTypeAlert = 0x15
+		alertLevelFatal = 2
+	)
+	return []byte{recordTypeAlert, 0x03, 0x03, 0x00, 0x02, alertLevelFatal, description}
+}
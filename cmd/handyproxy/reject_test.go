@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeConnectError(code int, contentType, body string) error {
+	return &connectError{
+		Proxy:      "proxy.example:3128",
+		Origin:     "www.example.com:80",
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       []byte(body),
+	}
+}
+
+func TestHTTPErrorResponse(t *testing.T) {
+	tests := []struct {
+		Description  string
+		Err          error
+		ExpectedCode int
+		ExpectedType string
+		ExpectedBody string
+	}{
+		{"Proxy unreachable", errors.New("connection refused"),
+			502, "text/html; charset=utf-8", "could not connect to www.example.com:80"},
+		{"HTML body is relayed", makeConnectError(403, "text/html", "<html>Denied by ACL</html>"),
+			403, "text/html", "<html>Denied by ACL</html>"},
+		{"Text body is relayed", makeConnectError(503, "text/plain; charset=us-ascii", "Try later"),
+			503, "text/plain; charset=us-ascii", "Try later"},
+		{"Other bodies are replaced", makeConnectError(403, "application/json", "{}"),
+			403, "text/html; charset=utf-8", "refused to connect to www.example.com:80: 403 Forbidden"},
+		{"Proxy authentication is not relayed", makeConnectError(407, "text/html", "<html>Log in</html>"),
+			502, "text/html; charset=utf-8", "refused to connect to www.example.com:80: 407 Proxy Authentication Required"},
+		{"Access rule", &accessDeniedError{"reject:host=example.com"},
+			403, "text/html; charset=utf-8", "Access to www.example.com:80 is denied"},
+		{"Hostname mismatch", &hostNameMismatchError{"www.example.com", netip.MustParseAddr("198.51.100.1")},
+			403, "text/html; charset=utf-8", "198.51.100.1 does not belong to www.example.com"},
+		{"Port mismatch", &portMismatchError{"www.example.com", 8080, "80"},
+			403, "text/html; charset=utf-8", "port 8080 requested for www.example.com does not match the destination port 80"},
+		{"Unknown fake address", &fakeAddressError{netip.MustParseAddr("198.18.0.1")},
+			502, "text/html; charset=utf-8", "198.18.0.1 was given out by the proxy DNS server"},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			response := httpErrorResponse("www.example.com:80", test.Err)
+			rsp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), nil)
+			require.NoError(t, err)
+			body, err := io.ReadAll(rsp.Body)
+			require.NoError(t, err)
+			require.Equal(t, test.ExpectedCode, rsp.StatusCode)
+			require.Equal(t, test.ExpectedType, rsp.Header.Get("Content-Type"))
+			require.True(t, rsp.Close)
+			require.Contains(t, string(body), test.ExpectedBody)
+		})
+	}
+}
+
+func TestTLSAlert(t *testing.T) {
+	squidDNSFailure := makeConnectError(503, "text/html", "")
+	squidDNSFailure.(*connectError).Header.Set("X-Squid-Error", "ERR_DNS_FAIL 0")
+
+	tests := []struct {
+		Description   string
+		Err           error
+		ExpectedAlert string
+	}{
+		{"Proxy unreachable", errors.New("connection refused"), "internal error"},
+		{"Client limit", &clientLimitError{netip.MustParseAddr("192.0.2.1"), "connection rate"}, "access denied"},
+		{"Access rule", &accessDeniedError{"reject:host=example.com"}, "access denied"},
+		{"ECH", &echRejectedError{"public.example.com"}, "access denied"},
+		{"Hostname mismatch", &hostNameMismatchError{"www.example.com", netip.MustParseAddr("198.51.100.1")}, "access denied"},
+		{"Proxy denial", makeConnectError(403, "text/html", ""), "access denied"},
+		{"Proxy authentication", makeConnectError(407, "text/html", ""), "access denied"},
+		{"Unknown host", makeConnectError(404, "text/html", ""), "unrecognized name"},
+		{"Squid DNS failure", squidDNSFailure, "unrecognized name"},
+		{"Unknown fake address", &fakeAddressError{netip.MustParseAddr("198.18.0.1")}, "unrecognized name"},
+		{"Upstream failure", makeConnectError(502, "text/html", ""), "internal error"},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			// A real TLS client must understand the alert
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go func() {
+				_, _ = io.Copy(io.Discard, server)
+			}()
+			go func() {
+				_, _ = server.Write(tlsAlertRecord(tlsAlertFor(test.Err)))
+			}()
+			err := tls.Client(client, &tls.Config{ServerName: "www.example.com"}).Handshake()
+			require.ErrorContains(t, err, "remote error: tls: "+test.ExpectedAlert)
+		})
+	}
+}
@@ -8,6 +8,7 @@ package main
 import "C"
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"syscall"
@@ -42,13 +43,18 @@ func getOriginalDestination(c *net.TCPConn) (_ string, err error) {
 		addrLen := C.socklen_t(unsafe.Sizeof(addr))
 		err = getsockopt(fd, syscall.SOL_IP, soOriginalDst, unsafe.Pointer(&addr), &addrLen)
 	})
+	if errors.Is(err, syscall.ENOENT) {
+		// No NAT took place, so conntrack has nothing to say about the connection
+		err = fmt.Errorf("%w to %s from %s", errNotRedirected, c.LocalAddr().String(), c.RemoteAddr().String())
+		return
+	}
 	if err != nil {
 		return
 	}
 	realOrigin := (&net.TCPAddr{IP: net.IP(addr.Addr[:]), Port: int(ntohs(addr.Port))}).String()
 	localAddr := c.LocalAddr().String()
 	if realOrigin == localAddr {
-		err = fmt.Errorf("received non REDIRECTed traffic to %s from %s, discarding", localAddr, c.RemoteAddr().String())
+		err = fmt.Errorf("%w to %s from %s", errNotRedirected, localAddr, c.RemoteAddr().String())
 		return
 	}
 	return realOrigin, nil
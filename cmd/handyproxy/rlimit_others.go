@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+)
+
+func getNoFileLimit() (soft, hard uint64, err error) {
+	err = fmt.Errorf("RLIMIT_NOFILE is not supported on this platform")
+	return
+}
+
+func raiseNoFileLimit() (soft, hard uint64, err error) {
+	return getNoFileLimit()
+}
@@ -0,0 +1,68 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Linux refuses soft and hard limits on open files above this value, even if
+// the hard limit is RLIM_INFINITY
+const nrOpenPath = "/proc/sys/fs/nr_open"
+
+func getNoFileLimit() (soft, hard uint64, err error) {
+	var limit syscall.Rlimit
+	if err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return
+	}
+	return uint64(limit.Cur), uint64(limit.Max), nil
+}
+
+// readNrOpen returns the system-wide ceiling on open files read from path, or
+// 0 if it is not available.
+func readNrOpen(path string) uint64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	nrOpen, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return nrOpen
+}
+
+// noFileTarget returns the soft limit on open files to ask for: the hard limit,
+// capped by nrOpen if known, and never lower than the current soft limit.
+func noFileTarget(soft, hard, nrOpen uint64) uint64 {
+	target := hard
+	if nrOpen > 0 {
+		target = min(target, nrOpen)
+	}
+	return max(target, soft)
+}
+
+// raiseNoFileLimit raises the soft limit on open files up to the hard limit, or
+// as close to it as the kernel allows, and returns the resulting limits. Go
+// already does this at startup on most systems, in which case the limits are
+// just reported. On failure, the current limits are returned with the error.
+func raiseNoFileLimit() (soft, hard uint64, err error) {
+	var limit syscall.Rlimit
+	if err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return
+	}
+	soft, hard = uint64(limit.Cur), uint64(limit.Max)
+	target := noFileTarget(soft, hard, readNrOpen(nrOpenPath))
+	if target == soft {
+		return
+	}
+	raised := limit
+	raised.Cur = target
+	if err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &raised); err != nil {
+		return
+	}
+	return target, hard, nil
+}
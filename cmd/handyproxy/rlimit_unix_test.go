@@ -0,0 +1,53 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoFileTarget(t *testing.T) {
+	const infinity = ^uint64(0)
+	tests := []struct {
+		Description string
+		Soft        uint64
+		Hard        uint64
+		NrOpen      uint64
+		Expected    uint64
+	}{
+		{"Up to the hard limit", 1024, 4096, 1 << 20, 4096},
+		{"Capped by nr_open", 1024, infinity, 1 << 20, 1 << 20},
+		{"Unknown nr_open", 1024, 4096, 0, 4096},
+		{"Already raised", 4096, 4096, 1 << 20, 4096},
+		{"Never lowered", 1 << 21, infinity, 1 << 20, 1 << 21},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			require.Equal(t, test.Expected, noFileTarget(test.Soft, test.Hard, test.NrOpen))
+		})
+	}
+}
+
+func TestReadNrOpen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nr_open")
+	require.Equal(t, uint64(0), readNrOpen(path))
+	require.NoError(t, os.WriteFile(path, []byte("1048576\n"), 0o644))
+	require.Equal(t, uint64(1048576), readNrOpen(path))
+	require.NoError(t, os.WriteFile(path, []byte("lots\n"), 0o644))
+	require.Equal(t, uint64(0), readNrOpen(path))
+}
+
+func TestRaiseNoFileLimit(t *testing.T) {
+	soft, hard, err := raiseNoFileLimit()
+	require.NoError(t, err)
+	require.NotZero(t, soft)
+	require.LessOrEqual(t, soft, hard)
+	current, _, err := getNoFileLimit()
+	require.NoError(t, err)
+	require.Equal(t, soft, current)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/capture"
+	"github.com/binary-manu/handyproxy/internal/hostname"
+)
+
+// replayReader feeds a captured stream to a sniff strategy one segment at a
+// time, stopping at the same data and time limits the proxy would enforce.
+type replayReader struct {
+	segments []capture.Segment
+	maxData  int64
+	timeout  time.Duration
+	consumed int64
+	elapsed  time.Duration
+	limited  bool
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	for len(r.segments) > 0 && len(r.segments[0].Data) == 0 {
+		r.segments = r.segments[1:]
+	}
+	if len(r.segments) == 0 {
+		return 0, io.EOF
+	}
+	seg := &r.segments[0]
+	if seg.Time > r.timeout || r.consumed >= r.maxData {
+		r.limited = true
+		return 0, io.EOF
+	}
+	r.elapsed = seg.Time
+	n := copy(p[:min(int64(len(p)), r.maxData-r.consumed)], seg.Data)
+	seg.Data = seg.Data[n:]
+	r.consumed += int64(n)
+	return n, nil
+}
+
+type replayResult struct {
+	Strategy string
+	Metadata *hostname.Metadata
+	Err      error
+	Consumed int64
+	Elapsed  time.Duration
+	Limited  bool
+}
+
+func replayStream(stream *capture.Stream, strategies sniffStrategyList, timeout time.Duration, maxData int64) []replayResult {
+	results := make([]replayResult, len(strategies))
+	for i, strategy := range strategies {
+		reader := replayReader{
+			segments: slices.Clone(stream.Segments),
+			maxData:  maxData,
+			timeout:  timeout,
+		}
+		metadata, err := strategy.Strategy.SniffMetadata(&reader)
+		results[i] = replayResult{
+			Strategy: strategy.Name,
+			Metadata: metadata,
+			Err:      err,
+			Consumed: reader.consumed,
+			Elapsed:  reader.elapsed,
+			Limited:  reader.limited,
+		}
+	}
+	return results
+}
+
+// replayWinner returns the result the proxy would have used: strategies run in
+// parallel, so the first one to succeed wins.
+func replayWinner(results []replayResult) *replayResult {
+	var winner *replayResult
+	for i := range results {
+		result := &results[i]
+		if result.Err != nil {
+			continue
+		}
+		if winner == nil || result.Elapsed < winner.Elapsed ||
+			result.Elapsed == winner.Elapsed && result.Consumed < winner.Consumed {
+			winner = result
+		}
+	}
+	return winner
+}
+
+// describeMetadata lists what a strategy found besides the hostname.
+func describeMetadata(metadata *hostname.Metadata) string {
+	var details []string
+	if metadata.HTTPMethod != "" {
+		details = append(details, metadata.HTTPMethod+" "+metadata.HTTPPath)
+	}
+	if metadata.TLSVersion != 0 {
+		details = append(details, tls.VersionName(metadata.TLSVersion))
+	}
+	if len(metadata.ALPN) > 0 {
+		details = append(details, "ALPN "+strings.Join(metadata.ALPN, ","))
+	}
+	if metadata.ECH {
+		details = append(details, "ECH public name "+metadata.PublicName)
+	}
+	if metadata.JA3 != "" {
+		details = append(details, "JA3 "+metadata.JA3)
+	}
+	if metadata.JA4 != "" {
+		details = append(details, "JA4 "+metadata.JA4)
+	}
+	return strings.Join(details, ", ")
+}
+
+func runSniff(args []string) int {
+	flags := flag.NewFlagSet("sniff", flag.ExitOnError)
+	opts := newOptions(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s sniff [options] file...\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Run hostname sniffing on raw data, hex dumps or pcap/pcapng captures.\n\nOptions:\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	// Sniffing is always enabled here, so negative values just select defaults
+	defaults := sniffSettings{
+		Strategies: *opts.SniffStrategies,
+		Timeout:    *opts.SniffTimeout,
+		MaxData:    *opts.SniffMaxBytes,
+	}
+	if defaults.Timeout <= 0 {
+		defaults.Timeout = hostname.SniffDefaultTimeout
+	}
+
+	status := 0
+	for _, path := range flags.Args() {
+		streams, err := capture.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			status = 1
+			continue
+		}
+		if len(streams) == 0 {
+			fmt.Printf("%s: no client data found\n", path)
+		}
+		for _, stream := range streams {
+			if stream.Client.IsValid() {
+				fmt.Printf("%s: %s -> %s, %d bytes\n", path, stream.Client, stream.Server, stream.Len())
+			} else {
+				fmt.Printf("%s: %d bytes\n", path, stream.Len())
+			}
+
+			// Only rules without conditions match streams whose server is unknown
+			settings := opts.SniffRules.settingsFor(stream.Server.String(), defaults)
+			if !settings.enabled() {
+				fmt.Printf("  => sniffing disabled by -sniff-rule\n")
+				continue
+			}
+			if settings.Timeout == 0 {
+				settings.Timeout = hostname.SniffDefaultTimeout
+			}
+			if settings.MaxData <= 0 {
+				settings.MaxData = hostname.SniffDefaultMaxData
+			}
+			results := replayStream(stream, settings.Strategies, settings.Timeout, settings.MaxData)
+			for _, result := range results {
+				switch {
+				case result.Err == nil:
+					fmt.Printf("  %s: %s, after %d bytes and %v\n",
+						result.Strategy, result.Metadata.Authority(), result.Consumed, result.Elapsed)
+					if details := describeMetadata(result.Metadata); details != "" {
+						fmt.Printf("    %s\n", details)
+					}
+				case result.Limited:
+					fmt.Printf("  %s: sniff limits reached after %d bytes and %v: %s\n",
+						result.Strategy, result.Consumed, result.Elapsed, result.Err)
+				default:
+					fmt.Printf("  %s: failed after %d bytes and %v: %s\n",
+						result.Strategy, result.Consumed, result.Elapsed, result.Err)
+				}
+			}
+			if winner := replayWinner(results); winner != nil {
+				fmt.Printf("  => %s (%s)\n", winner.Metadata.Authority(), winner.Strategy)
+			} else {
+				fmt.Printf("  => no hostname\n")
+			}
+		}
+	}
+	return status
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Selects no strategies in -sniff-rule, disabling sniffing
+const sniffStrategiesNone = "none"
+
+// sniffSettings tells how to sniff the hostname of a connection.
+type sniffSettings struct {
+	Strategies sniffStrategyList
+	// Negative values disable sniffing, zero selects the default
+	Timeout time.Duration
+	// Non-positive values select the default
+	MaxData int64
+}
+
+func (settings *sniffSettings) enabled() bool {
+	return settings.Timeout >= 0 && len(settings.Strategies) > 0
+}
+
+// sniffRule overrides the sniff settings for the connections which match all
+// of its conditions. Each condition lists alternatives, any of which may
+// match, and conditions which list nothing match every connection.
+type sniffRule struct {
+	Spec         string
+	Strategies   sniffStrategyList
+	Ports        []uint16
+	Destinations []netip.Prefix
+	// nil pointers keep the global settings
+	Timeout *time.Duration
+	MaxData *int64
+}
+
+func (rule *sniffRule) matches(origin netip.AddrPort) bool {
+	if len(rule.Ports) > 0 && !slices.Contains(rule.Ports, origin.Port()) {
+		return false
+	}
+	if len(rule.Destinations) > 0 && !slices.ContainsFunc(rule.Destinations, func(prefix netip.Prefix) bool {
+		return prefix.Contains(origin.Addr().Unmap())
+	}) {
+		return false
+	}
+	return true
+}
+
+// sniffRules implements flag.Value, so that -sniff-rule can be repeated. Each
+// value has the form STRATEGY[,STRATEGY...][:key=value,...], where the
+// strategies can also be "none". Alternative values for a key are separated by
+// semicolons, and @FILE reads them from FILE, one per line.
+type sniffRules []*sniffRule
+
+func (rules *sniffRules) String() string {
+	if rules == nil {
+		return ""
+	}
+	var s []string
+	for _, rule := range *rules {
+		s = append(s, rule.Spec)
+	}
+	return strings.Join(s, " ")
+}
+
+func (rules *sniffRules) Set(s string) error {
+	strategies, spec, _ := strings.Cut(s, ":")
+	rule := &sniffRule{Spec: s}
+	if strategies != sniffStrategiesNone {
+		if err := rule.Strategies.Set(strategies); err != nil {
+			return err
+		}
+	}
+
+	values, err := parseKeyValues(spec, "port", "dest", "timeout", "max-bytes")
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		switch key {
+		case "timeout":
+			var timeout time.Duration
+			timeout, err = time.ParseDuration(value)
+			rule.Timeout = &timeout
+		case "max-bytes":
+			var maxData int64
+			maxData, err = strconv.ParseInt(value, 10, 64)
+			rule.MaxData = &maxData
+		case "port", "dest":
+			var alternatives []string
+			if alternatives, err = parseAlternatives(value); err != nil {
+				break
+			}
+			for _, alternative := range alternatives {
+				if key == "port" {
+					var port uint64
+					port, err = strconv.ParseUint(alternative, 10, 16)
+					if err == nil && port == 0 {
+						err = fmt.Errorf("port 0 is not valid")
+					}
+					rule.Ports = append(rule.Ports, uint16(port))
+				} else {
+					var prefix netip.Prefix
+					if strings.Contains(alternative, "/") {
+						prefix, err = netip.ParsePrefix(alternative)
+					} else {
+						var addr netip.Addr
+						addr, err = netip.ParseAddr(alternative)
+						prefix = netip.PrefixFrom(addr, addr.BitLen())
+					}
+					rule.Destinations = append(rule.Destinations, prefix.Masked())
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+	}
+
+	*rules = append(*rules, rule)
+	return nil
+}
+
+// settingsFor returns the sniff settings of the first rule matching origin, an
+// IP:port pair, falling back to defaults for the settings the rule does not
+// give, or defaults if no rule matches. Origins that are not IP:port pairs
+// only match rules without conditions.
+func (rules sniffRules) settingsFor(origin string, defaults sniffSettings) sniffSettings {
+	addrPort, err := netip.ParseAddrPort(origin)
+	for _, rule := range rules {
+		if err != nil && (len(rule.Ports) > 0 || len(rule.Destinations) > 0) {
+			continue
+		}
+		if err == nil && !rule.matches(addrPort) {
+			continue
+		}
+		// Rules enable sniffing even if -sniff-timeout disables it
+		settings := sniffSettings{Strategies: rule.Strategies, Timeout: max(defaults.Timeout, 0), MaxData: defaults.MaxData}
+		if rule.Timeout != nil {
+			settings.Timeout = *rule.Timeout
+		}
+		if rule.MaxData != nil {
+			settings.MaxData = *rule.MaxData
+		}
+		return settings
+	}
+	return defaults
+}
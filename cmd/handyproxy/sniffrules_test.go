@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSniffRules(t *testing.T) {
+	var rules sniffRules
+	for _, rule := range []string{
+		"http:port=80",
+		"tls:port=443,timeout=500ms",
+		"tls,http:port=8443,max-bytes=4096",
+		"h2c:dest=10.0.0.0/8;2001:db8::/32,timeout=-1s",
+		"none",
+	} {
+		require.NoError(t, rules.Set(rule))
+	}
+
+	defaults := sniffSettings{Timeout: -1, MaxData: 8192}
+	require.NoError(t, defaults.Strategies.Set(defaultSniffStrategies))
+	tests := []struct {
+		Origin     string
+		Strategies string
+		Timeout    time.Duration
+		MaxData    int64
+		Enabled    bool
+	}{
+		{"192.0.2.1:80", "http", 0, 8192, true},
+		{"192.0.2.1:443", "tls", 500 * time.Millisecond, 8192, true},
+		{"[::ffff:192.0.2.1]:443", "tls", 500 * time.Millisecond, 8192, true},
+		{"192.0.2.1:8443", "tls,http", 0, 4096, true},
+		{"10.1.2.3:5000", "h2c", -time.Second, 8192, false},
+		{"[2001:db8::1]:5000", "h2c", -time.Second, 8192, false},
+		{"192.0.2.1:22", "", 0, 8192, false},
+		{"example.com:80", "", 0, 8192, false},
+	}
+	for _, test := range tests {
+		t.Run(test.Origin, func(t *testing.T) {
+			settings := rules.settingsFor(test.Origin, defaults)
+			require.Equal(t, test.Strategies, settings.Strategies.String())
+			require.Equal(t, test.Timeout, settings.Timeout)
+			require.Equal(t, test.MaxData, settings.MaxData)
+			require.Equal(t, test.Enabled, settings.enabled())
+		})
+	}
+
+	// Without rules, the defaults apply everywhere
+	require.Equal(t, defaults, sniffRules(nil).settingsFor("192.0.2.1:80", defaults))
+}
+
+func TestInvalidSniffRules(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"ssh:port=22",
+		"tls:port=0",
+		"tls:port=65536",
+		"tls:dest=300.0.0.0/8",
+		"tls:timeout=soon",
+		"tls:max-bytes=lots",
+		"tls:host=example.com",
+	} {
+		t.Run(value, func(t *testing.T) {
+			var rules sniffRules
+			require.Error(t, rules.Set(value))
+		})
+	}
+}
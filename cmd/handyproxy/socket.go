@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/binary-manu/handyproxy/internal/dialer"
+	"github.com/binary-manu/handyproxy/internal/resolver"
+)
+
+// keepAliveConfig returns the keepalive settings for both client and upstream
+// sockets. Zero values select Go's defaults.
+func keepAliveConfig(opts *options) net.KeepAliveConfig {
+	if *opts.KeepAliveIdle < 0 {
+		return net.KeepAliveConfig{Enable: false}
+	}
+	return net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     *opts.KeepAliveIdle,
+		Interval: *opts.KeepAliveInterval,
+		Count:    *opts.KeepAliveCount,
+	}
+}
+
+// setSocketOptions applies the options shared by client and upstream sockets,
+// plus the firewall mark, if mark is true.
+func setSocketOptions(raw syscall.RawConn, opts *options, mark bool) error {
+	var err error
+	ctlErr := raw.Control(func(fd uintptr) {
+		if mark && *opts.FwMark != 0 {
+			if err = setSocketMark(fd, int(*opts.FwMark)); err != nil {
+				err = fmt.Errorf("unable to set SO_MARK %#x: %w", *opts.FwMark, err)
+				return
+			}
+		}
+		if *opts.TCPUserTimeout > 0 {
+			if err = setTCPUserTimeout(fd, *opts.TCPUserTimeout); err != nil {
+				err = fmt.Errorf("unable to set TCP_USER_TIMEOUT: %w", err)
+				return
+			}
+		}
+	})
+	if ctlErr != nil {
+		return ctlErr
+	}
+	return err
+}
+
+// newOutboundDialer returns the dialer used for every connection handyproxy
+// opens on its own, so that socket options apply to all of them alike.
+func newOutboundDialer(opts *options) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:         *opts.DialTimeout,
+		KeepAliveConfig: keepAliveConfig(opts),
+	}
+	if *opts.KeepAliveIdle < 0 {
+		dialer.KeepAlive = -1
+	}
+	if *opts.FwMark != 0 || *opts.TCPUserTimeout > 0 {
+		dialer.Control = func(_, _ string, raw syscall.RawConn) error {
+			return setSocketOptions(raw, opts, true)
+		}
+	}
+	return dialer
+}
+
+// newUpstreamDialer returns the dialer used to reach the upstream proxy, which
+// tries all of its addresses with the outbound dialer's settings.
+func newUpstreamDialer(opts *options, resolver *resolver.Resolver) *dialer.Dialer {
+	return dialer.New(newOutboundDialer(opts), resolver, dialer.WithAttemptTimeout(*opts.DialAttemptTimeout))
+}
+
+// configureClientConn applies socket options to an accepted connection.
+func configureClientConn(conn *net.TCPConn, opts *options) error {
+	if err := conn.SetKeepAliveConfig(keepAliveConfig(opts)); err != nil {
+		return err
+	}
+	if *opts.TCPUserTimeout > 0 {
+		raw, err := conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		return setSocketOptions(raw, opts, false)
+	}
+	return nil
+}
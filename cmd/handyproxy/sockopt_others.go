@@ -0,0 +1,22 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+func setSocketMark(uintptr, int) error {
+	return fmt.Errorf("SO_MARK is only supported on Linux")
+}
+
+func setTCPUserTimeout(uintptr, time.Duration) error {
+	return fmt.Errorf("TCP_USER_TIMEOUT is only supported on Linux")
+}
+
+// socketIdle cannot check sockets on this platform, so they are assumed to be
+// usable.
+func socketIdle(uintptr) bool {
+	return true
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/hostname"
+)
+
+const (
+	starttlsSMTP     = "smtp"
+	starttlsIMAP     = "imap"
+	starttlsPOP3     = "pop3"
+	starttlsPostgres = "postgres"
+)
+
+const (
+	// Client data watched for a STARTTLS command. Sessions which have not
+	// started TLS by then are tunnelled without looking at them any further.
+	starttlsMaxPlaintext = 64 << 10
+	// Longer lines cannot be commands, and also stop the watch
+	starttlsMaxLine = 4096
+	// Buffer for server responses
+	starttlsResponseBuffer = 32 << 10
+)
+
+const tlsRecordTypeHandshake = 0x16
+
+// starttlsPorts implements flag.Value, mapping destination ports to the
+// protocol spoken there, so that -starttls can be repeated. Each value has the
+// form PROTOCOL:PORT[;PORT...].
+type starttlsPorts map[uint16]string
+
+func (ports *starttlsPorts) String() string {
+	if ports == nil {
+		return ""
+	}
+	var s []string
+	for _, port := range slices.Sorted(maps.Keys(*ports)) {
+		s = append(s, fmt.Sprintf("%s:%d", (*ports)[port], port))
+	}
+	return strings.Join(s, " ")
+}
+
+func (ports *starttlsPorts) Set(s string) error {
+	protocol, portList, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("%q does not have the form PROTOCOL:PORT[;PORT...]", s)
+	}
+	switch protocol {
+	case starttlsSMTP, starttlsIMAP, starttlsPOP3, starttlsPostgres:
+	default:
+		return fmt.Errorf("invalid STARTTLS protocol %q, must be one of %q, %q, %q or %q",
+			protocol, starttlsSMTP, starttlsIMAP, starttlsPOP3, starttlsPostgres)
+	}
+	if *ports == nil {
+		*ports = make(starttlsPorts)
+	}
+	for _, portString := range strings.Split(portList, ";") {
+		port, err := strconv.ParseUint(strings.TrimSpace(portString), 10, 16)
+		if err != nil || port == 0 {
+			return fmt.Errorf("invalid port %q", portString)
+		}
+		(*ports)[uint16(port)] = protocol
+	}
+	return nil
+}
+
+// protocolFor returns the protocol whose STARTTLS command must be watched for
+// on connections to origin, or an empty string.
+func (ports starttlsPorts) protocolFor(origin string) string {
+	addrPort, err := netip.ParseAddrPort(origin)
+	if err != nil {
+		return ""
+	}
+	return ports[addrPort.Port()]
+}
+
+// isSTARTTLSCommand tells whether a line sent by a client of protocol asks the
+// server to start TLS.
+func isSTARTTLSCommand(protocol string, line []byte) bool {
+	fields := bytes.Fields(line)
+	switch protocol {
+	case starttlsSMTP:
+		return len(fields) == 1 && bytes.EqualFold(fields[0], []byte("STARTTLS"))
+	case starttlsIMAP:
+		// Preceded by a tag
+		return len(fields) == 2 && bytes.EqualFold(fields[1], []byte("STARTTLS"))
+	case starttlsPOP3:
+		return len(fields) == 1 && bytes.EqualFold(fields[0], []byte("STLS"))
+	default:
+		return false
+	}
+}
+
+// relaySTARTTLS relays the plaintext part of a mail protocol or PostgreSQL
+// session between the client and the upstream of t, a tunnel to the original
+// destination, with the timeouts and the rate limits of t. Once the client
+// starts TLS after a STARTTLS command or an SSLRequest, its ClientHello is
+// sniffed and checked against -verify-hostname and the access rules before
+// being forwarded. It returns true if the connection is over, because either
+// side closed it, because it was rejected or because t was aborted. Otherwise,
+// the rest of the session can be tunnelled by running t.
+func relaySTARTTLS(ctx *connectionContext, t *tunnel, origin, protocol string) bool {
+	defer t.watch()()
+	upstream := t.Upstream
+
+	// Server responses are relayed by another goroutine until TLS starts, and
+	// then stopped via a deadline. Data read before that is still written.
+	var stopping atomic.Bool
+	downDone := make(chan struct{})
+	go func() {
+		defer close(downDone)
+		buf := make([]byte, starttlsResponseBuffer)
+		for {
+			n, err := upstream.Read(buf)
+			if n > 0 {
+				if _, err := ctx.C.Write(buf[:n]); err != nil {
+					return
+				}
+				t.transferredDown(n)
+			}
+			if err != nil {
+				if !stopping.Load() {
+					_ = ctx.C.CloseWrite()
+				}
+				return
+			}
+		}
+	}()
+	// Tells whether the tunnel can go on, as clearing the deadline may have
+	// undone an abort
+	stopDown := func() bool {
+		stopping.Store(true)
+		_ = upstream.SetReadDeadline(time.Now())
+		<-downDone
+		_ = upstream.SetReadDeadline(time.Time{})
+		return !t.aborted.Load()
+	}
+
+	// Lines trickling in count as activity before they are complete
+	client := bufio.NewReaderSize(activityReader{t, ctx.C}, starttlsMaxLine)
+	expectTLS := false
+	for watched := 0; watched < starttlsMaxPlaintext; {
+		if expectTLS {
+			// After a successful STARTTLS, the client speaks first
+			if first, err := client.Peek(1); err == nil && first[0] == tlsRecordTypeHandshake {
+				if !stopDown() {
+					return true
+				}
+				return checkSTARTTLSClientHello(ctx, t, client, origin)
+			}
+		}
+		if protocol == starttlsPostgres {
+			// There are no lines here: clients either ask for TLS right away,
+			// or speak plaintext for the whole session
+			if expectTLS {
+				break
+			}
+			request, err := client.Peek(len(hostname.PostgresSSLRequest))
+			if err != nil || string(request) != hostname.PostgresSSLRequest {
+				break
+			}
+			if _, err := upstream.Write(request); err != nil {
+				return true
+			}
+			_, _ = client.Discard(len(request))
+			watched += len(request)
+			t.transferredUp(len(request))
+			expectTLS = true
+			continue
+		}
+		line, err := client.ReadSlice('\n')
+		if len(line) > 0 {
+			if _, err := upstream.Write(line); err != nil {
+				return true
+			}
+			watched += len(line)
+			t.transferredUp(len(line))
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			break
+		} else if err != nil {
+			_ = upstream.CloseWrite()
+			<-downDone
+			return true
+		}
+		expectTLS = isSTARTTLSCommand(protocol, line)
+	}
+
+	if !stopDown() {
+		return true
+	}
+	return !forwardBuffered(t, client)
+}
+
+// checkSTARTTLSClientHello reads the ClientHello sent by a client after
+// STARTTLS, and decides whether it may be forwarded.
+func checkSTARTTLSClientHello(ctx *connectionContext, t *tunnel, client *bufio.Reader, origin string) bool {
+	timeout, maxData := *ctx.Opts.SniffTimeout, *ctx.Opts.SniffMaxBytes
+	if timeout <= 0 {
+		timeout = hostname.SniffDefaultTimeout
+	}
+	if maxData <= 0 {
+		maxData = hostname.SniffDefaultMaxData
+	}
+
+	var data []byte
+	var metadata *hostname.Metadata
+	strategy := hostname.NewIncrementalTLSSnifferStrategy()
+	chunk := make([]byte, client.Size())
+	_ = ctx.C.SetReadDeadline(time.Now().Add(timeout))
+	for progress := hostname.SniffNeedMore; progress == hostname.SniffNeedMore; {
+		n, err := client.Read(chunk[:min(maxData-int64(len(data)), int64(len(chunk)))])
+		data = append(data, chunk[:n]...)
+		atEOF := err != nil || int64(len(data)) >= maxData
+		metadata, progress = strategy.SniffMetadataIncremental(data, atEOF)
+		if atEOF {
+			break
+		}
+	}
+	_ = ctx.C.SetReadDeadline(time.Time{})
+	if t.aborted.Load() {
+		return true
+	}
+
+	if metadata != nil {
+		clientAddr := ctx.C.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+		tlsFingerprints.Observe(clientAddr, metadata)
+		host, _, _ := net.SplitHostPort(origin)
+		useHostName, err := ctx.HostNameVerifier.Check(metadata.HostName, origin)
+		if err != nil {
+			metricRejections.Add("hostname-mismatch", 1)
+		} else {
+			if useHostName {
+				host = metadata.HostName
+			}
+			if err = ctx.AccessList.Check(clientAddr, host, metadata); err != nil {
+				metricRejections.Add("access-rule", 1)
+			}
+		}
+		if err != nil {
+			log.Printf("discarding STARTTLS connection from %s to %s: %s%s",
+				ctx.C.RemoteAddr().String(), origin, err, describeFingerprints(metadata))
+			// Lets rejectClient tell that the client speaks TLS
+			ctx.Pending = data
+			rejectClient(ctx, origin, err)
+			return true
+		}
+		log.Printf("STARTTLS connection from %s to %s for %s", ctx.C.RemoteAddr().String(), origin, metadata.HostName)
+	}
+
+	if _, err := t.Upstream.Write(data); err != nil {
+		return true
+	}
+	t.transferredUp(len(data))
+	return !forwardBuffered(t, client)
+}
+
+// forwardBuffered sends to the upstream of t the client data read by r but not
+// consumed yet, and tells whether that succeeded.
+func forwardBuffered(t *tunnel, r *bufio.Reader) bool {
+	buffered, _ := r.Peek(r.Buffered())
+	if _, err := t.Upstream.Write(buffered); err != nil {
+		return false
+	}
+	t.transferredUp(len(buffered))
+	return true
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/hostname"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSTARTTLSPorts(t *testing.T) {
+	var ports starttlsPorts
+	require.NoError(t, ports.Set("smtp:25;587"))
+	require.NoError(t, ports.Set("imap:143"))
+	require.Equal(t, "smtp:25 imap:143 smtp:587", ports.String())
+	require.Equal(t, starttlsSMTP, ports.protocolFor("192.0.2.1:587"))
+	require.Equal(t, starttlsIMAP, ports.protocolFor("[2001:db8::1]:143"))
+	require.Empty(t, ports.protocolFor("192.0.2.1:443"))
+	require.Empty(t, ports.protocolFor("mail.example.com:25"))
+
+	require.NoError(t, ports.Set("postgres:5432"))
+	require.Equal(t, starttlsPostgres, ports.protocolFor("192.0.2.1:5432"))
+
+	for _, value := range []string{"smtp", "ftp:21", "mysql:3306", "smtp:", "smtp:0", "smtp:65536", "pop3:110;x"} {
+		t.Run(value, func(t *testing.T) {
+			var ports starttlsPorts
+			require.Error(t, ports.Set(value))
+		})
+	}
+}
+
+func TestIsSTARTTLSCommand(t *testing.T) {
+	tests := []struct {
+		Protocol string
+		Line     string
+		Expected bool
+	}{
+		{starttlsSMTP, "STARTTLS\r\n", true},
+		{starttlsSMTP, "starttls\n", true},
+		{starttlsSMTP, "EHLO client.example.com\r\n", false},
+		{starttlsSMTP, "A1 STARTTLS\r\n", false},
+		{starttlsIMAP, "A1 STARTTLS\r\n", true},
+		{starttlsIMAP, "STARTTLS\r\n", false},
+		{starttlsPOP3, "STLS\r\n", true},
+		{starttlsPOP3, "STARTTLS\r\n", false},
+	}
+	for _, test := range tests {
+		t.Run(test.Protocol+"/"+strings.TrimSpace(test.Line), func(t *testing.T) {
+			require.Equal(t, test.Expected, isSTARTTLSCommand(test.Protocol, []byte(test.Line)))
+		})
+	}
+}
+
+func TestRelaySTARTTLS(t *testing.T) {
+	tests := []struct {
+		Description string
+		AccessRule  string
+		ServerName  string
+		Rejected    bool
+	}{
+		{"Allowed", "reject:host=blocked.example.com", "mail.example.com", false},
+		{"Rejected", "reject:host=blocked.example.com", "blocked.example.com", true},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			client, proxyClient := tcpPair(t)
+			proxyUpstream, upstream := tcpPair(t)
+			opts := newOptions(flag.NewFlagSet("test", flag.PanicOnError))
+			require.NoError(t, opts.AccessRules.Set(test.AccessRule))
+			ctx := &connectionContext{
+				Opts:            opts,
+				C:               proxyClient,
+				HostNameSniffer: hostname.NewNullSniffer(),
+				AccessList:      newAccessList(*opts.AccessRules),
+			}
+
+			// A mail server which only knows STARTTLS
+			serverDone := make(chan string)
+			go func() {
+				defer close(serverDone)
+				r := bufio.NewReader(upstream)
+				_, _ = io.WriteString(upstream, "220 mail.example.com ESMTP\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.TrimSpace(line) == "STARTTLS" {
+						_, _ = io.WriteString(upstream, "220 Ready to start TLS\r\n")
+						break
+					}
+					_, _ = io.WriteString(upstream, "250 OK\r\n")
+				}
+				header := make([]byte, 5)
+				if _, err := io.ReadFull(r, header); err == nil {
+					serverDone <- string(header[:1])
+				}
+			}()
+
+			relayDone := make(chan bool)
+			go func() {
+				relayDone <- relaySTARTTLS(ctx, &tunnel{Client: proxyClient, Upstream: proxyUpstream}, "192.0.2.1:25", starttlsSMTP)
+			}()
+
+			r := bufio.NewReader(client)
+			expect := func(command, response string) {
+				if command != "" {
+					_, err := io.WriteString(client, command)
+					require.NoError(t, err)
+				}
+				line, err := r.ReadString('\n')
+				require.NoError(t, err)
+				require.Equal(t, response, line)
+			}
+			expect("", "220 mail.example.com ESMTP\r\n")
+			expect("EHLO client.example.com\r\n", "250 OK\r\n")
+			expect("STARTTLS\r\n", "220 Ready to start TLS\r\n")
+
+			handshakeErr := make(chan error, 1)
+			go func() {
+				handshakeErr <- tls.Client(client, &tls.Config{ServerName: test.ServerName}).Handshake()
+			}()
+			if test.Rejected {
+				require.ErrorContains(t, <-handshakeErr, "access denied")
+				client.Close()
+				require.True(t, <-relayDone)
+				require.NoError(t, proxyUpstream.CloseWrite())
+				require.Empty(t, <-serverDone)
+			} else {
+				require.False(t, <-relayDone)
+				require.Equal(t, "\x16", <-serverDone)
+			}
+		})
+	}
+}
+
+func TestRelayPostgresSSLRequest(t *testing.T) {
+	tests := []struct {
+		Description string
+		ServerName  string
+		Rejected    bool
+	}{
+		{"Allowed", "db.example.com", false},
+		{"Rejected", "blocked.example.com", true},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			client, proxyClient := tcpPair(t)
+			proxyUpstream, upstream := tcpPair(t)
+			opts := newOptions(flag.NewFlagSet("test", flag.PanicOnError))
+			require.NoError(t, opts.AccessRules.Set("reject:host=blocked.example.com"))
+			ctx := &connectionContext{
+				Opts:            opts,
+				C:               proxyClient,
+				HostNameSniffer: hostname.NewNullSniffer(),
+				AccessList:      newAccessList(*opts.AccessRules),
+			}
+
+			// A server which accepts TLS
+			serverDone := make(chan string)
+			go func() {
+				defer close(serverDone)
+				request := make([]byte, len(hostname.PostgresSSLRequest))
+				if _, err := io.ReadFull(upstream, request); err != nil || string(request) != hostname.PostgresSSLRequest {
+					return
+				}
+				_, _ = io.WriteString(upstream, "S")
+				header := make([]byte, 5)
+				if _, err := io.ReadFull(upstream, header); err == nil {
+					serverDone <- string(header[:1])
+				}
+			}()
+
+			relayDone := make(chan bool)
+			go func() {
+				relayDone <- relaySTARTTLS(ctx, &tunnel{Client: proxyClient, Upstream: proxyUpstream}, "192.0.2.1:5432", starttlsPostgres)
+			}()
+
+			_, err := io.WriteString(client, hostname.PostgresSSLRequest)
+			require.NoError(t, err)
+			response := make([]byte, 1)
+			_, err = io.ReadFull(client, response)
+			require.NoError(t, err)
+			require.Equal(t, "S", string(response))
+
+			handshakeErr := make(chan error, 1)
+			go func() {
+				handshakeErr <- tls.Client(client, &tls.Config{ServerName: test.ServerName}).Handshake()
+			}()
+			if test.Rejected {
+				require.ErrorContains(t, <-handshakeErr, "access denied")
+				client.Close()
+				require.True(t, <-relayDone)
+				require.NoError(t, proxyUpstream.CloseWrite())
+				require.Empty(t, <-serverDone)
+			} else {
+				require.False(t, <-relayDone)
+				require.Equal(t, "\x16", <-serverDone)
+			}
+		})
+	}
+}
+
+func TestRelaySTARTTLSIdleTimeout(t *testing.T) {
+	client, proxyClient := tcpPair(t)
+	proxyUpstream, upstream := tcpPair(t)
+	opts := newOptions(flag.NewFlagSet("test", flag.PanicOnError))
+	ctx := &connectionContext{
+		Opts:            opts,
+		C:               proxyClient,
+		HostNameSniffer: hostname.NewNullSniffer(),
+		AccessList:      newAccessList(*opts.AccessRules),
+	}
+	tun := &tunnel{Client: proxyClient, Upstream: proxyUpstream, IdleTimeout: 200 * time.Millisecond}
+
+	// The server greets, then neither side says anything else
+	_, err := io.WriteString(upstream, "220 mail.example.com ESMTP\r\n")
+	require.NoError(t, err)
+
+	relayDone := make(chan bool)
+	go func() {
+		relayDone <- relaySTARTTLS(ctx, tun, "192.0.2.1:25", starttlsSMTP)
+	}()
+	line, err := bufio.NewReader(client).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "220 mail.example.com ESMTP\r\n", line)
+
+	select {
+	case done := <-relayDone:
+		require.True(t, done)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the plaintext phase was not aborted")
+	}
+	require.True(t, tun.aborted.Load())
+	up, down := tun.Stats()
+	require.Zero(t, up)
+	require.EqualValues(t, len(line), down)
+}
+
+func TestRelaySTARTTLSSlowLines(t *testing.T) {
+	const idleTimeout = 400 * time.Millisecond
+	client, proxyClient := tcpPair(t)
+	proxyUpstream, upstream := tcpPair(t)
+	opts := newOptions(flag.NewFlagSet("test", flag.PanicOnError))
+	ctx := &connectionContext{
+		Opts:            opts,
+		C:               proxyClient,
+		HostNameSniffer: hostname.NewNullSniffer(),
+		AccessList:      newAccessList(*opts.AccessRules),
+	}
+	tun := &tunnel{Client: proxyClient, Upstream: proxyUpstream, IdleTimeout: idleTimeout}
+
+	relayDone := make(chan bool)
+	go func() {
+		relayDone <- relaySTARTTLS(ctx, tun, "192.0.2.1:25", starttlsSMTP)
+	}()
+
+	// A line typed by hand takes longer than the idle timeout
+	command := "EHLO client.example.com\r\n"
+	for i := range command {
+		_, err := io.WriteString(client, command[i:i+1])
+		require.NoError(t, err)
+		time.Sleep(idleTimeout / 4)
+	}
+	// Aborted relays leave the upstream open
+	require.NoError(t, upstream.SetReadDeadline(time.Now().Add(5*time.Second)))
+	line, err := bufio.NewReader(upstream).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, command, line)
+	require.False(t, tun.aborted.Load())
+
+	require.NoError(t, client.CloseWrite())
+	require.True(t, <-relayDone)
+}
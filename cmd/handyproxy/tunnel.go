@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/ratelimit"
+)
+
+// Upper bound for the amount of data copied between two updates of the byte
+// counters and of the time of the last activity, and checks of the rate limits.
+const maxTunnelChunk = 256 << 10
+
+// Chunks also end after this long, or a quarter of IdleTimeout if shorter, so
+// that the counters and the time of the last activity keep up with traffic too
+// slow to fill a chunk.
+const maxTunnelChunkPeriod = time.Second
+
+// tunnel copies data between a client and the upstream proxy, in both
+// directions, until both sides are done.
+//
+// Copying between two *net.TCPConn lets the kernel move data via splice,
+// without going through userspace. Wrapping either connection, for example to
+// count bytes, would silently disable this and fall back to copies through a
+// 32 KiB buffer. Instead, data is copied in chunks with io.CopyN, which hands an
+// *io.LimitedReader wrapping the source TCPConn to the destination's ReadFrom:
+// that is still eligible for splice. Counters and rate limits are handled
+// between chunks, which end after a given size or, via a read deadline on the
+// source, a given time.
+type tunnel struct {
+	Client   *net.TCPConn
+	Upstream *net.TCPConn
+	// Buckets limiting traffic sent by the client (Up) and to it (Down)
+	UpLimiters   []*ratelimit.TokenBucket
+	DownLimiters []*ratelimit.TokenBucket
+	// The tunnel is torn down after IdleTimeout without traffic in either
+	// direction, or MaxLifetime after it was set up. Zero disables them.
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+
+	started      time.Time
+	lastActivity atomic.Int64
+	aborted      atomic.Bool
+	bytesUp      atomic.Int64
+	bytesDown    atomic.Int64
+}
+
+func (t *tunnel) Run() {
+	defer t.watch()()
+
+	var wg sync.WaitGroup
+	copier := func(dst, src *net.TCPConn, limiters []*ratelimit.TokenBucket, counter, metric *atomic.Int64) {
+		defer wg.Done()
+		_ = t.copy(dst, src, limiters, counter, metric)
+		_ = dst.CloseWrite()
+	}
+	wg.Add(2)
+	go copier(t.Client, t.Upstream, t.DownLimiters, &t.bytesDown, &metricBytesDown)
+	go copier(t.Upstream, t.Client, t.UpLimiters, &t.bytesUp, &metricBytesUp)
+	wg.Wait()
+}
+
+// Stats returns the number of bytes sent by the client (up) and to it (down)
+// so far.
+func (t *tunnel) Stats() (up, down int64) {
+	return t.bytesUp.Load(), t.bytesDown.Load()
+}
+
+func (t *tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (t *tunnel) idleFor() time.Duration {
+	return time.Since(time.Unix(0, t.lastActivity.Load()))
+}
+
+// abort unblocks both copiers, which then return with a timeout error.
+func (t *tunnel) abort(reason string) {
+	if t.aborted.Swap(true) {
+		return
+	}
+	metricTunnelsAborted.Add(reason, 1)
+	now := time.Now()
+	_ = t.Client.SetDeadline(now)
+	_ = t.Upstream.SetDeadline(now)
+}
+
+// watch enforces IdleTimeout and MaxLifetime until the returned function is
+// called. The lifetime counts from the first call, so that it also covers
+// traffic relayed before Run, as done by relaySTARTTLS.
+func (t *tunnel) watch() (stop func()) {
+	if t.started.IsZero() {
+		t.started = time.Now()
+	}
+	t.touch()
+	var timer *time.Timer
+	if t.MaxLifetime > 0 {
+		timer = time.AfterFunc(t.MaxLifetime-time.Since(t.started), func() {
+			t.abort("lifetime")
+		})
+	}
+	done := make(chan struct{})
+	if t.IdleTimeout > 0 {
+		go t.watchIdle(done)
+	}
+	return func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		close(done)
+	}
+}
+
+// watchIdle aborts the tunnel once it has been idle for IdleTimeout, until done
+// is closed. The timeout is checked twice per period, so a tunnel is torn down
+// after being idle for at most 1.5 times the timeout.
+//
+// Write deadlines are not used for this, because a write timing out in the
+// middle of a chunk would drop the data already taken from the source, leaving
+// a hole in the stream.
+func (t *tunnel) watchIdle(done <-chan struct{}) {
+	ticker := time.NewTicker(t.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if t.idleFor() >= t.IdleTimeout {
+				t.abort("idle")
+				return
+			}
+		}
+	}
+}
+
+// copy copies from src to dst until EOF, counting bytes and waiting as
+// required by limiters.
+func (t *tunnel) copy(dst, src *net.TCPConn, limiters []*ratelimit.TokenBucket, counter, metric *atomic.Int64) error {
+	chunk := int64(maxTunnelChunk)
+	for _, limiter := range limiters {
+		chunk = min(chunk, int64(limiter.Burst()))
+	}
+	period := t.chunkPeriod()
+	for {
+		// A read deadline only expires before data is taken from src, so
+		// nothing is lost when it ends a chunk
+		_ = src.SetReadDeadline(time.Now().Add(period))
+		// Setting the deadline may have undone an abort
+		if t.aborted.Load() {
+			return os.ErrDeadlineExceeded
+		}
+		n, err := io.CopyN(dst, src, chunk)
+		if n > 0 {
+			t.transferred(n, counter, metric, limiters)
+		}
+		switch {
+		case err == io.EOF:
+			return nil
+		case errors.Is(err, os.ErrDeadlineExceeded) && !t.aborted.Load():
+			// The chunk took too long, start another one
+		case err != nil:
+			return err
+		}
+	}
+}
+
+// chunkPeriod returns how long copy may spend on a single chunk.
+func (t *tunnel) chunkPeriod() time.Duration {
+	if t.IdleTimeout > 0 {
+		return min(maxTunnelChunkPeriod, t.IdleTimeout/4)
+	}
+	return maxTunnelChunkPeriod
+}
+
+// transferred accounts for n bytes sent in one direction, and waits as required
+// by limiters.
+func (t *tunnel) transferred(n int64, counter, metric *atomic.Int64, limiters []*ratelimit.TokenBucket) {
+	counter.Add(n)
+	metric.Add(n)
+	t.touch()
+	var delay time.Duration
+	for _, limiter := range limiters {
+		delay = max(delay, limiter.Reserve(int(n)))
+	}
+	time.Sleep(delay)
+}
+
+// transferredUp and transferredDown are like transferred, for traffic sent by
+// the client and to it.
+func (t *tunnel) transferredUp(n int) {
+	t.transferred(int64(n), &t.bytesUp, &metricBytesUp, t.UpLimiters)
+}
+
+func (t *tunnel) transferredDown(n int) {
+	t.transferred(int64(n), &t.bytesDown, &metricBytesDown, t.DownLimiters)
+}
+
+// activityReader records activity on a tunnel whenever a read returns data,
+// for traffic which is not copied by the tunnel itself.
+type activityReader struct {
+	t *tunnel
+	r io.Reader
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.touch()
+	}
+	return n, err
+}
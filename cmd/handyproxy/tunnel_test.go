@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/ratelimit"
+	"github.com/stretchr/testify/require"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(tb, err)
+	defer ln.Close()
+
+	accepted := make(chan *net.TCPConn, 1)
+	go func() {
+		conn, _ := ln.AcceptTCP()
+		accepted <- conn
+	}()
+	dialed, err := net.DialTCP("tcp4", nil, ln.Addr().(*net.TCPAddr))
+	require.NoError(tb, err)
+	peer := <-accepted
+	require.NotNil(tb, peer)
+	tb.Cleanup(func() {
+		dialed.Close()
+		peer.Close()
+	})
+	return dialed, peer
+}
+
+// tunnelFixture connects a client and an upstream through a tunnel, using four
+// loopback sockets, as the proxy would.
+type tunnelFixture struct {
+	Client   *net.TCPConn
+	Upstream *net.TCPConn
+	Tunnel   *tunnel
+}
+
+func newTunnelFixture(tb testing.TB, configure func(*tunnel)) *tunnelFixture {
+	client, proxyClient := tcpPair(tb)
+	proxyUpstream, upstream := tcpPair(tb)
+	t := &tunnel{Client: proxyClient, Upstream: proxyUpstream}
+	if configure != nil {
+		configure(t)
+	}
+	return &tunnelFixture{client, upstream, t}
+}
+
+func TestTunnelCountsBytes(t *testing.T) {
+	fixture := newTunnelFixture(t, func(t *tunnel) {
+		t.IdleTimeout = time.Minute
+	})
+	done := make(chan struct{})
+	go func() {
+		fixture.Tunnel.Run()
+		close(done)
+	}()
+
+	up := make([]byte, 3*maxTunnelChunk+1)
+	go func() {
+		_, _ = fixture.Client.Write(up)
+		_ = fixture.Client.CloseWrite()
+	}()
+	received, err := io.ReadAll(fixture.Upstream)
+	require.NoError(t, err)
+	require.Len(t, received, len(up))
+
+	_, err = fixture.Upstream.Write([]byte("response"))
+	require.NoError(t, err)
+	require.NoError(t, fixture.Upstream.CloseWrite())
+	received, err = io.ReadAll(fixture.Client)
+	require.NoError(t, err)
+	require.Equal(t, "response", string(received))
+
+	<-done
+	bytesUp, bytesDown := fixture.Tunnel.Stats()
+	require.Equal(t, int64(len(up)), bytesUp)
+	require.Equal(t, int64(len(received)), bytesDown)
+}
+
+func TestTunnelSurvivesStalledReceiver(t *testing.T) {
+	const idleTimeout = time.Second
+	fixture := newTunnelFixture(t, func(t *tunnel) {
+		t.IdleTimeout = idleTimeout
+	})
+	done := make(chan struct{})
+	go func() {
+		fixture.Tunnel.Run()
+		close(done)
+	}()
+
+	// Enough data to fill the socket buffers, so that the tunnel blocks on
+	// writes while the upstream is not reading
+	up := make([]byte, 32<<20)
+	for i := range up {
+		up[i] = byte(i * 7 / 5)
+	}
+	go func() {
+		_, _ = fixture.Client.Write(up)
+		_ = fixture.Client.CloseWrite()
+	}()
+	time.Sleep(idleTimeout * 3 / 4)
+	received, err := io.ReadAll(fixture.Upstream)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(up, received), "received data differs from sent data")
+
+	require.NoError(t, fixture.Upstream.CloseWrite())
+	<-done
+	bytesUp, _ := fixture.Tunnel.Stats()
+	require.Equal(t, int64(len(up)), bytesUp)
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	fixture := newTunnelFixture(t, func(t *tunnel) {
+		t.IdleTimeout = 200 * time.Millisecond
+	})
+	done := make(chan struct{})
+	go func() {
+		fixture.Tunnel.Run()
+		close(done)
+	}()
+
+	_, err := fixture.Client.Write([]byte("request"))
+	require.NoError(t, err)
+	received := make([]byte, len("request"))
+	_, err = io.ReadFull(fixture.Upstream, received)
+	require.NoError(t, err)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "idle tunnel not torn down")
+	}
+	require.True(t, fixture.Tunnel.aborted.Load())
+}
+
+func TestTunnelSurvivesSlowTraffic(t *testing.T) {
+	const idleTimeout = 400 * time.Millisecond
+	fixture := newTunnelFixture(t, func(t *tunnel) {
+		t.IdleTimeout = idleTimeout
+	})
+	done := make(chan struct{})
+	go func() {
+		fixture.Tunnel.Run()
+		close(done)
+	}()
+
+	// Far less than a chunk per idle period, as typed by a user
+	up := []byte("slowly typed text")
+	go func() {
+		for i := range up {
+			_, _ = fixture.Client.Write(up[i : i+1])
+			time.Sleep(idleTimeout / 4)
+		}
+		_ = fixture.Client.CloseWrite()
+	}()
+	received, err := io.ReadAll(fixture.Upstream)
+	require.NoError(t, err)
+	require.Equal(t, string(up), string(received))
+	require.False(t, fixture.Tunnel.aborted.Load())
+
+	require.NoError(t, fixture.Upstream.CloseWrite())
+	<-done
+	bytesUp, _ := fixture.Tunnel.Stats()
+	require.Equal(t, int64(len(up)), bytesUp)
+}
+
+func TestTunnelCountsPartialChunks(t *testing.T) {
+	fixture := newTunnelFixture(t, nil)
+	done := make(chan struct{})
+	go func() {
+		fixture.Tunnel.Run()
+		close(done)
+	}()
+
+	// Much less than a chunk, with the connection left open
+	_, err := fixture.Client.Write([]byte("request"))
+	require.NoError(t, err)
+	received := make([]byte, len("request"))
+	_, err = io.ReadFull(fixture.Upstream, received)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		bytesUp, _ := fixture.Tunnel.Stats()
+		return bytesUp == int64(len(received))
+	}, 3*maxTunnelChunkPeriod, maxTunnelChunkPeriod/10)
+
+	require.NoError(t, fixture.Client.CloseWrite())
+	require.NoError(t, fixture.Upstream.CloseWrite())
+	<-done
+}
+
+// userspaceReader hides the TCPConn type, so that copies cannot use splice.
+type userspaceReader struct {
+	io.Reader
+}
+
+func cpuTime(tb testing.TB) time.Duration {
+	var usage syscall.Rusage
+	require.NoError(tb, syscall.Getrusage(syscall.RUSAGE_SELF, &usage))
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// BenchmarkTunnel pushes data from client to upstream through a tunnel over
+// loopback and reports, besides throughput, the CPU time used by the whole
+// process per MiB transferred. The userspace case copies through a buffer
+// instead of splice, as a baseline.
+func BenchmarkTunnel(b *testing.B) {
+	const payloadSize = 64 << 20
+
+	benchmarks := []struct {
+		Name      string
+		Configure func(*tunnel)
+		Userspace bool
+	}{
+		{"Plain", nil, false},
+		{"IdleTimeout", func(t *tunnel) { t.IdleTimeout = time.Minute }, false},
+		// Chunks end every few milliseconds
+		{"ShortIdleTimeout", func(t *tunnel) { t.IdleTimeout = 20 * time.Millisecond }, false},
+		{"Shaped", func(t *tunnel) {
+			t.UpLimiters = []*ratelimit.TokenBucket{ratelimit.NewTokenBucket(1<<40, maxTunnelChunk)}
+		}, false},
+		{"Userspace", nil, true},
+	}
+
+	for _, bench := range benchmarks {
+		b.Run(bench.Name, func(b *testing.B) {
+			payload := make([]byte, payloadSize)
+			b.SetBytes(payloadSize)
+			var cpu time.Duration
+			for range b.N {
+				b.StopTimer()
+				fixture := newTunnelFixture(b, bench.Configure)
+				start := cpuTime(b)
+				b.StartTimer()
+
+				done := make(chan struct{})
+				go func() {
+					if bench.Userspace {
+						_, _ = io.Copy(fixture.Tunnel.Upstream, userspaceReader{fixture.Tunnel.Client})
+						_ = fixture.Tunnel.Upstream.CloseWrite()
+					} else {
+						fixture.Tunnel.Run()
+					}
+					close(done)
+				}()
+				go func() {
+					_, _ = fixture.Client.Write(payload)
+					_ = fixture.Client.CloseWrite()
+				}()
+				n, err := io.Copy(io.Discard, userspaceReader{fixture.Upstream})
+				require.NoError(b, err)
+				require.Equal(b, int64(payloadSize), n)
+				if !bench.Userspace {
+					_ = fixture.Upstream.CloseWrite()
+				}
+				<-done
+
+				b.StopTimer()
+				cpu += cpuTime(b) - start
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(cpu.Nanoseconds())/float64(b.N)/(payloadSize>>20), "cpu-ns/MiB")
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/dialer"
+)
+
+type pooledConn struct {
+	Conn    *net.TCPConn
+	Created time.Time
+}
+
+// upstreamPool keeps a few idle connections to an upstream proxy, already
+// through the TCP handshake, so that a CONNECT can be sent as soon as a client
+// shows up. Connections are discarded once older than maxAge, or as soon as
+// the proxy closes them or sends unexpected data. A nil upstreamPool is always
+// empty.
+type upstreamPool struct {
+	address string
+	dialer  *dialer.Dialer
+	size    int
+	maxAge  time.Duration
+	wake    chan struct{}
+
+	mu   sync.Mutex
+	idle []pooledConn
+}
+
+func newUpstreamPool(opts *options, upstreamDialer *dialer.Dialer) *upstreamPool {
+	if *opts.UpstreamPoolSize <= 0 {
+		return nil
+	}
+	pool := &upstreamPool{
+		address: *opts.UpstreamProxy,
+		dialer:  upstreamDialer,
+		size:    *opts.UpstreamPoolSize,
+		maxAge:  *opts.UpstreamPoolMaxAge,
+		wake:    make(chan struct{}, 1),
+	}
+	go pool.run()
+	return pool
+}
+
+// Get returns an idle connection, or nil if none is available. The pool is
+// refilled in the background.
+func (pool *upstreamPool) Get() *net.TCPConn {
+	if pool == nil {
+		return nil
+	}
+	defer pool.refill()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	// The most recent connections are the least likely to have been dropped
+	for len(pool.idle) > 0 {
+		pc := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if pool.usable(pc) {
+			metricUpstreamPool.Add("hits", 1)
+			return pc.Conn
+		}
+		metricUpstreamPool.Add("discarded", 1)
+		_ = pc.Conn.Close()
+	}
+	metricUpstreamPool.Add("misses", 1)
+	return nil
+}
+
+func (pool *upstreamPool) refill() {
+	select {
+	case pool.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (pool *upstreamPool) usable(pc pooledConn) bool {
+	if pool.maxAge > 0 && time.Since(pc.Created) >= pool.maxAge {
+		return false
+	}
+	raw, err := pc.Conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	idle := false
+	if err = raw.Control(func(fd uintptr) {
+		idle = socketIdle(fd)
+	}); err != nil {
+		return false
+	}
+	return idle
+}
+
+// run keeps the pool full and drops stale connections, until the process
+// exits.
+func (pool *upstreamPool) run() {
+	period := time.Second
+	if pool.maxAge > 0 {
+		period = max(min(period, pool.maxAge/2), time.Millisecond)
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		pool.expire()
+		if err := pool.fill(); err != nil {
+			if !failing {
+				log.Printf("unable to fill the connection pool for %s: %s", pool.address, err)
+			}
+			failing = true
+			// Do not retry on every client connection while the proxy is down
+			<-ticker.C
+			continue
+		} else if failing {
+			log.Printf("connection pool for %s is working again", pool.address)
+			failing = false
+		}
+		select {
+		case <-pool.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (pool *upstreamPool) expire() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	kept := pool.idle[:0]
+	for _, pc := range pool.idle {
+		if pool.usable(pc) {
+			kept = append(kept, pc)
+		} else {
+			metricUpstreamPool.Add("discarded", 1)
+			_ = pc.Conn.Close()
+		}
+	}
+	clear(pool.idle[len(kept):])
+	pool.idle = kept
+}
+
+func (pool *upstreamPool) fill() error {
+	for {
+		pool.mu.Lock()
+		missing := pool.size - len(pool.idle)
+		pool.mu.Unlock()
+		if missing <= 0 {
+			return nil
+		}
+
+		conn, err := pool.dialer.Dial("tcp", pool.address)
+		if err != nil {
+			return err
+		}
+		pool.mu.Lock()
+		pool.idle = append(pool.idle, pooledConn{conn.(*net.TCPConn), time.Now()})
+		pool.mu.Unlock()
+	}
+}
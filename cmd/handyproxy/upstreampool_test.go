@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/resolver"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestUpstreamPool returns a pool of connections to a local listener, along
+// with the server side of each connection, in the order they are made. The
+// pool is not refilled in the background.
+func newTestUpstreamPool(t *testing.T, size int, maxAge time.Duration) (*upstreamPool, <-chan net.Conn) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+			accepted <- conn
+		}
+	}()
+
+	flags := flag.NewFlagSet("test", flag.PanicOnError)
+	opts := newOptions(flags)
+	require.NoError(t, flags.Parse([]string{"-upstream-proxy", ln.Addr().String()}))
+	pool := &upstreamPool{
+		address: *opts.UpstreamProxy,
+		dialer:  newUpstreamDialer(opts, resolver.New()),
+		size:    size,
+		maxAge:  maxAge,
+		wake:    make(chan struct{}, 1),
+	}
+	t.Cleanup(func() {
+		for _, pc := range pool.idle {
+			_ = pc.Conn.Close()
+		}
+	})
+	return pool, accepted
+}
+
+// requireSameConn checks that client and server are the two ends of the same
+// connection.
+func requireSameConn(t *testing.T, client *net.TCPConn, server net.Conn) {
+	_, err := client.Write([]byte("CONNECT"))
+	require.NoError(t, err)
+	buf := make([]byte, len("CONNECT"))
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(server, buf)
+	require.NoError(t, err)
+	require.Equal(t, "CONNECT", string(buf))
+}
+
+// requireClosed checks that the peer of server closed the connection, with a
+// FIN or, if it had unread data, a RST.
+func requireClosed(t *testing.T, server net.Conn) {
+	require.NoError(t, server.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err := server.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestUpstreamPoolReuse(t *testing.T) {
+	pool, accepted := newTestUpstreamPool(t, 2, 0)
+	require.NoError(t, pool.fill())
+	require.Len(t, pool.idle, 2)
+	first, second := <-accepted, <-accepted
+
+	// The most recent connection comes first
+	conn := pool.Get()
+	require.NotNil(t, conn)
+	defer conn.Close()
+	requireSameConn(t, conn, second)
+	conn = pool.Get()
+	require.NotNil(t, conn)
+	defer conn.Close()
+	requireSameConn(t, conn, first)
+	require.Nil(t, pool.Get())
+
+	// Connections taken from the pool are replaced
+	require.NoError(t, pool.fill())
+	require.Len(t, pool.idle, 2)
+	select {
+	case <-pool.wake:
+	default:
+		require.FailNow(t, "pool not woken up for refilling")
+	}
+}
+
+func TestUpstreamPoolMaxAge(t *testing.T) {
+	pool, accepted := newTestUpstreamPool(t, 1, 50*time.Millisecond)
+	require.NoError(t, pool.fill())
+	server := <-accepted
+	time.Sleep(60 * time.Millisecond)
+
+	require.Nil(t, pool.Get())
+	requireClosed(t, server)
+}
+
+func TestUpstreamPoolDropsDeadConnections(t *testing.T) {
+	pool, accepted := newTestUpstreamPool(t, 3, 0)
+	require.NoError(t, pool.fill())
+	closed, talkative, healthy := <-accepted, <-accepted, <-accepted
+
+	// Proxies may drop idle connections, or send unsolicited error responses
+	require.NoError(t, closed.Close())
+	_, err := talkative.Write([]byte("HTTP/1.1 408 Request Timeout\r\n\r\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		pool.expire()
+		return len(pool.idle) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	requireClosed(t, talkative)
+
+	conn := pool.Get()
+	require.NotNil(t, conn)
+	defer conn.Close()
+	requireSameConn(t, conn, healthy)
+}
+
+func TestUpstreamPoolGetSkipsDeadConnections(t *testing.T) {
+	pool, accepted := newTestUpstreamPool(t, 2, 0)
+	require.NoError(t, pool.fill())
+	healthy, closed := <-accepted, <-accepted
+	require.NoError(t, closed.Close())
+
+	// Wait for the FIN to arrive, without expire dropping the connection
+	time.Sleep(50 * time.Millisecond)
+	conn := pool.Get()
+	require.NotNil(t, conn)
+	defer conn.Close()
+	requireSameConn(t, conn, healthy)
+}
+
+func TestUpstreamPoolFillFails(t *testing.T) {
+	pool, _ := newTestUpstreamPool(t, 1, 0)
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	pool.address = ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	require.Error(t, pool.fill())
+	require.Empty(t, pool.idle)
+	require.Nil(t, pool.Get())
+}
+
+func TestNilUpstreamPool(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.PanicOnError)
+	opts := newOptions(flags)
+	require.NoError(t, flags.Parse(nil))
+	pool := newUpstreamPool(opts, nil)
+	require.Nil(t, pool)
+	require.Nil(t, pool.Get())
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/binary-manu/handyproxy/internal/resolver"
+)
+
+const (
+	verifyHostNameOff    = "off"
+	verifyHostNameIP     = "ip"
+	verifyHostNameReject = "reject"
+)
+
+// How long to wait for the addresses of a sniffed hostname
+const verifyHostNameTimeout = 5 * time.Second
+
+// Mismatches are not errors with the ip policy, but may be frequent
+var verifyLog = newRateLimitedLogger(0.1, 5)
+
+func validateVerifyHostName(policy string) error {
+	switch policy {
+	case verifyHostNameOff, verifyHostNameIP, verifyHostNameReject:
+		return nil
+	default:
+		return fmt.Errorf("invalid hostname verification policy %q, must be one of %q, %q or %q",
+			policy, verifyHostNameOff, verifyHostNameIP, verifyHostNameReject)
+	}
+}
+
+// domainPrefixes lists networks which are known to host a set of domains,
+// even if their addresses do not show up in DNS answers, as happens with CDNs
+// using geographic DNS.
+type domainPrefixes struct {
+	Patterns []string
+	Prefixes []netip.Prefix
+}
+
+// domainPrefixList implements flag.Value, so that -verify-hostname-cidr can be
+// repeated. Each value has the form PATTERN[;PATTERN...]:CIDR[;CIDR...], and
+// @FILE reads the CIDRs from FILE, one per line.
+type domainPrefixList []*domainPrefixes
+
+func (list *domainPrefixList) String() string {
+	if list == nil {
+		return ""
+	}
+	var s []string
+	for _, entry := range *list {
+		s = append(s, strings.Join(entry.Patterns, ";"))
+	}
+	return strings.Join(s, " ")
+}
+
+func (list *domainPrefixList) Set(s string) error {
+	patterns, cidrs, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("%q does not have the form PATTERN[;PATTERN...]:CIDR[;CIDR...]", s)
+	}
+	entry := &domainPrefixes{}
+	for _, pattern := range strings.Split(patterns, ";") {
+		if pattern = parseDomainPattern(pattern); pattern != "" {
+			entry.Patterns = append(entry.Patterns, pattern)
+		}
+	}
+	if len(entry.Patterns) == 0 {
+		return fmt.Errorf("no domain patterns in %q", s)
+	}
+	alternatives, err := parseAlternatives(cidrs)
+	if err != nil {
+		return fmt.Errorf("invalid CIDRs: %w", err)
+	}
+	for _, alternative := range alternatives {
+		prefix, err := netip.ParsePrefix(alternative)
+		if err != nil {
+			return err
+		}
+		entry.Prefixes = append(entry.Prefixes, prefix.Masked())
+	}
+	*list = append(*list, entry)
+	return nil
+}
+
+type hostNameMismatchError struct {
+	HostName string
+	Addr     netip.Addr
+}
+
+func (e *hostNameMismatchError) Error() string {
+	return fmt.Sprintf("original destination %s is not an address of %s", e.Addr, e.HostName)
+}
+
+// hostNameVerifier checks that sniffed hostnames match the original
+// destination of their connection, so that clients cannot reach arbitrary
+// addresses by sending the name of an allowed domain. A nil hostNameVerifier
+// accepts all hostnames.
+type hostNameVerifier struct {
+	policy   string
+	prefixes domainPrefixList
+	lookup   func(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+func newHostNameVerifier(opts *options, resolver *resolver.Resolver) *hostNameVerifier {
+	if *opts.VerifyHostName == verifyHostNameOff {
+		return nil
+	}
+	return &hostNameVerifier{
+		policy:   *opts.VerifyHostName,
+		prefixes: *opts.VerifyHostNameCIDRs,
+		lookup:   resolver.LookupNetIP,
+	}
+}
+
+// Check tells whether hostName can be used as the destination of a connection
+// whose original destination is origin, or returns an error if the connection
+// must be rejected. Origins that are not IP:port pairs are not checked.
+func (verifier *hostNameVerifier) Check(hostName, origin string) (bool, error) {
+	if verifier == nil {
+		return true, nil
+	}
+	addrPort, err := netip.ParseAddrPort(origin)
+	if err != nil {
+		return true, nil
+	}
+	addr := addrPort.Addr().Unmap()
+	if verifier.matches(hostName, addr) {
+		return true, nil
+	}
+
+	metricHostNameMismatches.Add(1)
+	err = &hostNameMismatchError{hostName, addr}
+	if verifier.policy == verifyHostNameReject {
+		return false, err
+	}
+	verifyLog.Printf("%s, connecting to the original destination", err)
+	return false, nil
+}
+
+func (verifier *hostNameVerifier) matches(hostName string, addr netip.Addr) bool {
+	for _, entry := range verifier.prefixes {
+		if matchDomainPatterns(hostName, entry.Patterns) &&
+			slices.ContainsFunc(entry.Prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+			return true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), verifyHostNameTimeout)
+	defer cancel()
+	addrs, err := verifier.lookup(ctx, hostName)
+	if err != nil {
+		verifyLog.Printf("unable to verify hostname %s: %s", hostName, err)
+		return false
+	}
+	return slices.Contains(addrs, addr)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostNameVerifier(t *testing.T) {
+	var prefixes domainPrefixList
+	require.NoError(t, prefixes.Set("cdn.example.net;*.example.org:203.0.113.0/24;2001:db8::/32"))
+	answers := map[string][]netip.Addr{
+		"www.example.com": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8:1::1")},
+	}
+	lookup := func(ctx context.Context, host string) ([]netip.Addr, error) {
+		if addrs, ok := answers[host]; ok {
+			return addrs, nil
+		}
+		if addr, err := netip.ParseAddr(host); err == nil {
+			return []netip.Addr{addr}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		Description string
+		HostName    string
+		Origin      string
+		Match       bool
+	}{
+		{"Address in DNS answers", "www.example.com", "192.0.2.1:443", true},
+		{"IPv6 address in DNS answers", "www.example.com", "[2001:db8:1::1]:443", true},
+		{"IPv4-mapped address", "www.example.com", "[::ffff:192.0.2.1]:443", true},
+		{"Address not in DNS answers", "www.example.com", "198.51.100.1:443", false},
+		{"Unknown host", "www.example.invalid", "192.0.2.1:443", false},
+		{"Address in domain CIDR", "cdn.example.net", "203.0.113.7:443", true},
+		{"Subdomain in domain CIDR", "static.example.org", "[2001:db8:5::1]:443", true},
+		{"Address outside of domain CIDR", "cdn.example.net", "198.51.100.1:443", false},
+		{"CIDR of another domain", "www.example.com", "203.0.113.7:443", false},
+		{"IP literal", "192.0.2.9", "192.0.2.9:443", true},
+		{"Origin is not an address", "www.example.com", "origin.example.com:443", true},
+	}
+	for _, policy := range []string{verifyHostNameIP, verifyHostNameReject} {
+		verifier := &hostNameVerifier{policy: policy, prefixes: prefixes, lookup: lookup}
+		for _, test := range tests {
+			t.Run(policy+"/"+test.Description, func(t *testing.T) {
+				useHostName, err := verifier.Check(test.HostName, test.Origin)
+				require.Equal(t, test.Match, useHostName)
+				if test.Match || policy == verifyHostNameIP {
+					require.NoError(t, err)
+				} else {
+					require.ErrorAs(t, err, new(*hostNameMismatchError))
+				}
+			})
+		}
+	}
+
+	useHostName, err := (*hostNameVerifier)(nil).Check("www.example.com", "198.51.100.1:443")
+	require.True(t, useHostName)
+	require.NoError(t, err)
+}
+
+func TestInvalidDomainPrefixes(t *testing.T) {
+	for _, value := range []string{
+		"example.com",
+		":192.0.2.0/24",
+		"example.com:",
+		"example.com:192.0.2.1",
+		"example.com:192.0.2.0/33",
+	} {
+		t.Run(value, func(t *testing.T) {
+			var prefixes domainPrefixList
+			require.Error(t, prefixes.Set(value))
+		})
+	}
+}
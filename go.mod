@@ -6,10 +6,12 @@ require (
 	github.com/akutz/memconn v0.1.0
 	github.com/go-gost/tls-dissector v0.0.1
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/net v0.47.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,70 @@
+// Package capture extracts client-to-server TCP payloads from captured
+// traffic, so that they can be replayed offline.
+package capture
+
+import (
+	"io"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// Segment is a chunk of stream data, together with the time it became
+// available to the receiver, relative to the start of the stream.
+type Segment struct {
+	Time time.Duration
+	Data []byte
+}
+
+// Stream holds the data sent by a client to a server, in order. Client and
+// Server are not valid for streams that do not come from a packet capture.
+type Stream struct {
+	Client   netip.AddrPort
+	Server   netip.AddrPort
+	Segments []Segment
+}
+
+// Len returns the total number of bytes in the stream.
+func (s *Stream) Len() int {
+	n := 0
+	for _, seg := range s.Segments {
+		n += len(seg.Data)
+	}
+	return n
+}
+
+// ReadFile is like Read, but reads from the named file.
+func ReadFile(path string) ([]*Stream, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read detects the format of the data in r and returns the streams it
+// contains. Supported formats are pcap and pcapng captures, from which all
+// client-to-server TCP streams are reassembled, hex dumps and raw bytes. The
+// last two yield a single stream, available all at once.
+func Read(r io.Reader) ([]*Stream, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case isPcap(data):
+		return readPcap(data)
+	case isPcapng(data):
+		return readPcapng(data)
+	}
+
+	decoded, ok, err := decodeHexDump(data)
+	if err != nil {
+		return nil, err
+	} else if ok {
+		data = decoded
+	}
+	return []*Stream{{Segments: []Segment{{Data: data}}}}, nil
+}
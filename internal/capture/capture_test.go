@@ -0,0 +1,280 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPacket struct {
+	Src, Dst netip.AddrPort
+	Seq      uint32
+	Flags    byte
+	Payload  string
+	Time     time.Duration
+}
+
+var (
+	testClient = netip.MustParseAddrPort("192.0.2.1:40000")
+	testServer = netip.MustParseAddrPort("192.0.2.2:443")
+	testEpoch  = time.Unix(1700000000, 0)
+)
+
+func makeTCP(pkt *testPacket) []byte {
+	tcp := make([]byte, 20, 20+len(pkt.Payload))
+	binary.BigEndian.PutUint16(tcp, pkt.Src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], pkt.Dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], pkt.Seq)
+	tcp[12] = 5 << 4
+	tcp[13] = pkt.Flags
+	return append(tcp, pkt.Payload...)
+}
+
+func makeIPv4Frame(pkt *testPacket) []byte {
+	tcp := makeTCP(pkt)
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	ip[8] = 64
+	ip[9] = ipProtocolTCP
+	src, dst := pkt.Src.Addr().As4(), pkt.Dst.Addr().As4()
+	copy(ip[12:], src[:])
+	copy(ip[16:], dst[:])
+	ip = append(ip, tcp...)
+
+	ether := make([]byte, 14, 14+len(ip))
+	binary.BigEndian.PutUint16(ether[12:], etherTypeIPv4)
+	return append(ether, ip...)
+}
+
+func makeIPv6Packet(pkt *testPacket) []byte {
+	tcp := makeTCP(pkt)
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = ipProtocolTCP
+	src, dst := pkt.Src.Addr().As16(), pkt.Dst.Addr().As16()
+	copy(ip[8:], src[:])
+	copy(ip[24:], dst[:])
+	return append(ip, tcp...)
+}
+
+func makePcap(linkType uint32, makeFrame func(*testPacket) []byte, packets []*testPacket) []byte {
+	frames, times := framesFromPackets(makeFrame, packets)
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header, pcapMagicMicro)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkType)
+	buf.Write(header)
+	for i, frame := range frames {
+		ts := testEpoch.Add(times[i])
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record, uint32(ts.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+		buf.Write(record)
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+func makePcapngBlock(blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	block := make([]byte, 8, 12+len(body))
+	binary.BigEndian.PutUint32(block, blockType)
+	binary.BigEndian.PutUint32(block[4:], uint32(12+len(body)))
+	block = append(block, body...)
+	return binary.BigEndian.AppendUint32(block, uint32(12+len(body)))
+}
+
+func makePcapng(linkType uint16, makeFrame func(*testPacket) []byte, packets []*testPacket) []byte {
+	frames, times := framesFromPackets(makeFrame, packets)
+	var buf bytes.Buffer
+
+	shb := make([]byte, 16)
+	binary.BigEndian.PutUint32(shb, pcapngByteOrderMagic)
+	binary.BigEndian.PutUint16(shb[4:], 1)
+	binary.BigEndian.PutUint64(shb[8:], ^uint64(0))
+	buf.Write(makePcapngBlock(pcapngMagic, shb))
+
+	// Nanosecond timestamps
+	idb := make([]byte, 8, 16)
+	binary.BigEndian.PutUint16(idb, linkType)
+	idb = binary.BigEndian.AppendUint16(idb, pcapngOptionIfTSResolution)
+	idb = binary.BigEndian.AppendUint16(idb, 1)
+	idb = append(idb, 9, 0, 0, 0)
+	buf.Write(makePcapngBlock(pcapngBlockInterfaceDescription, idb))
+
+	for i, frame := range frames {
+		ticks := uint64(testEpoch.Add(times[i]).UnixNano())
+		epb := make([]byte, 20, 20+len(frame))
+		binary.BigEndian.PutUint32(epb[4:], uint32(ticks>>32))
+		binary.BigEndian.PutUint32(epb[8:], uint32(ticks))
+		binary.BigEndian.PutUint32(epb[12:], uint32(len(frame)))
+		binary.BigEndian.PutUint32(epb[16:], uint32(len(frame)))
+		buf.Write(makePcapngBlock(pcapngBlockEnhancedPacket, append(epb, frame...)))
+	}
+	return buf.Bytes()
+}
+
+// A handshake, followed by client data sent out of order and partly
+// retransmitted, and by a server response which must be ignored.
+var testConversation = []*testPacket{
+	{testClient, testServer, 999, tcpFlagSYN, "", 0},
+	{testServer, testClient, 4999, tcpFlagSYN | tcpFlagACK, "", 10 * time.Millisecond},
+	{testClient, testServer, 1000, tcpFlagACK, "", 20 * time.Millisecond},
+	{testClient, testServer, 1005, tcpFlagACK, "world", 30 * time.Millisecond},
+	{testClient, testServer, 1000, tcpFlagACK, "hello", 40 * time.Millisecond},
+	{testClient, testServer, 1003, tcpFlagACK, "lowor", 50 * time.Millisecond},
+	{testClient, testServer, 1010, tcpFlagACK, "!", 60 * time.Millisecond},
+	{testServer, testClient, 5000, tcpFlagACK, "response", 70 * time.Millisecond},
+}
+
+var testExpectedSegments = []Segment{
+	{20 * time.Millisecond, []byte("hello")},
+	{20 * time.Millisecond, []byte("world")},
+	{40 * time.Millisecond, []byte("!")},
+}
+
+func framesFromPackets(makeFrame func(*testPacket) []byte, packets []*testPacket) ([][]byte, []time.Duration) {
+	frames := make([][]byte, len(packets))
+	times := make([]time.Duration, len(packets))
+	for i, pkt := range packets {
+		frames[i] = makeFrame(pkt)
+		times[i] = pkt.Time
+	}
+	return frames, times
+}
+
+func requireSingleStream(t *testing.T, data []byte) *Stream {
+	streams, err := Read(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Len(t, streams, 1)
+	return streams[0]
+}
+
+func TestReadPcap(t *testing.T) {
+	stream := requireSingleStream(t, makePcap(linkTypeEthernet, makeIPv4Frame, testConversation))
+	require.Equal(t, testClient, stream.Client)
+	require.Equal(t, testServer, stream.Server)
+	require.Equal(t, testExpectedSegments, stream.Segments)
+	require.Equal(t, 11, stream.Len())
+}
+
+func TestReadPcapng(t *testing.T) {
+	stream := requireSingleStream(t, makePcapng(linkTypeEthernet, makeIPv4Frame, testConversation))
+	require.Equal(t, testClient, stream.Client)
+	require.Equal(t, testServer, stream.Server)
+	require.Equal(t, testExpectedSegments, stream.Segments)
+}
+
+func TestReadPcapIPv6WithoutHandshake(t *testing.T) {
+	client := netip.MustParseAddrPort("[2001:db8::1]:40000")
+	server := netip.MustParseAddrPort("[2001:db8::2]:80")
+	packets := []*testPacket{
+		{client, server, 0xfffffffe, tcpFlagACK, "GET", 0},
+		{server, client, 7, tcpFlagACK, "HTTP", time.Millisecond},
+		{client, server, 1, tcpFlagACK, " / HTTP/1.1", 2 * time.Millisecond},
+	}
+	stream := requireSingleStream(t, makePcap(linkTypeRaw, makeIPv6Packet, packets))
+	require.Equal(t, client, stream.Client)
+	require.Equal(t, []Segment{
+		{0, []byte("GET")},
+		{2 * time.Millisecond, []byte(" / HTTP/1.1")},
+	}, stream.Segments)
+}
+
+func TestReassemblyStopsAtHole(t *testing.T) {
+	packets := []*testPacket{
+		{testClient, testServer, 999, tcpFlagSYN, "", 0},
+		{testClient, testServer, 1000, tcpFlagACK, "abc", 0},
+		{testClient, testServer, 1005, tcpFlagACK, "fgh", 0},
+	}
+	stream := requireSingleStream(t, makePcap(linkTypeEthernet, makeIPv4Frame, packets))
+	require.Equal(t, []Segment{{0, []byte("abc")}}, stream.Segments)
+}
+
+func TestReadTruncatedPcap(t *testing.T) {
+	data := makePcap(linkTypeEthernet, makeIPv4Frame, testConversation)
+	_, err := Read(bytes.NewReader(data[:len(data)-1]))
+	require.Error(t, err)
+}
+
+const testHTTPRequest = "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+
+func TestReadHexAndRaw(t *testing.T) {
+	tests := []struct {
+		Description string
+		Input       string
+		Expected    string
+	}{
+		{"Hex dump", "16 03 01\n00 2a", "\x16\x03\x01\x00\x2a"},
+		{"Hex dump without spaces", "474554", "GET"},
+		{"Raw data", "GET / HTTP/1.1\r\n\r\n", "GET / HTTP/1.1\r\n\r\n"},
+		{"Odd number of hex digits is raw data", "abc", "abc"},
+		{"xxd", "00000000: 4745 5420 2f20 4854 5450 2f31 2e31 0d0a  GET / HTTP/1.1..\n" +
+			"00000010: 486f 7374 3a20 7777 772e 6578 616d 706c  Host: www.exampl\n" +
+			"00000020: 652e 636f 6d0d 0a0d 0a                   e.com....\n",
+			testHTTPRequest},
+		{"xxd with text looking like hex", "00000000: 6361 6665                                cafe\n", "cafe"},
+		{"xxd with text ending in a space", "00000000: 6120                                     a \n", "a "},
+		{"hexdump -C", "00000000  47 45 54 20 2f 20 48 54  54 50 2f 31 2e 31 0d 0a  |GET / HTTP/1.1..|\n" +
+			"00000010  48 6f 73 74 3a 20 77 77  77 2e 65 78 61 6d 70 6c  |Host: www.exampl|\n" +
+			"00000020  65 2e 63 6f 6d 0d 0a 0d  0a                       |e.com....|\n" +
+			"00000029\n",
+			testHTTPRequest},
+		{"hexdump -C with repeated lines", "00000000  00 00 00 00 00 00 00 00  00 00 00 00 00 00 00 00  |................|\n" +
+			"*\n" +
+			"00000030  61 62 63                                          |abc|\n" +
+			"00000033\n",
+			strings.Repeat("\x00", 48) + "abc"},
+		{"od", "000000 47 45 54 20 2f 20 48 54 54 50 2f 31 2e 31 0d 0a  >GET / HTTP/1.1..<\n" +
+			"000010 48 6f 73 74 3a 20 77 77 77 2e 65 78 61 6d 70 6c  >Host: www.exampl<\n" +
+			"000020 65 2e 63 6f 6d 0d 0a 0d 0a                       >e.com....<\n" +
+			"000029\n",
+			testHTTPRequest},
+		{"Wireshark", "0000   47 45 54 20 2f 20 48 54 54 50 2f 31 2e 31 0d 0a   GET / HTTP/1.1..\r\n" +
+			"0010   48 6f 73 74 3a 20 77 77 77 2e 65 78 61 6d 70 6c   Host: www.exampl\r\n" +
+			"0020   65 2e 63 6f 6d 0d 0a 0d 0a                        e.com....\r\n",
+			testHTTPRequest},
+		{"Wireshark without text", "0000   47 45 54 20 2f 20 48 54 54 50 2f 31 2e 31 0d 0a\n" +
+			"0010   48 6f 73 74 3a 20 77 77 77 2e 65 78 61 6d 70 6c\n" +
+			"0020   65 2e 63 6f 6d 0d 0a 0d 0a\n",
+			testHTTPRequest},
+		{"Hex words starting with zero", "0000 0008 04d2 162f", "\x00\x00\x00\x08\x04\xd2\x16\x2f"},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			stream := requireSingleStream(t, []byte(test.Input))
+			require.Equal(t, []Segment{{0, []byte(test.Expected)}}, stream.Segments)
+		})
+	}
+}
+
+func TestReadInvalidHexDump(t *testing.T) {
+	tests := []struct {
+		Description string
+		Input       string
+	}{
+		{"Bad digits", "00000000: 4745 5420  GET \n00000004: 2f2g 4854  /.HT\n"},
+		{"Missing line", "00000000: 4745 5420  GET \n00000008: 5450 2f31  TP/1\n"},
+		{"Repeat without a final offset", "00000000  00 00  |..|\n*\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			_, err := Read(strings.NewReader(test.Input))
+			require.ErrorContains(t, err, "hex dump")
+		})
+	}
+}
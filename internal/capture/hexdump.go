@@ -0,0 +1,216 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Offsets are at least this long, which tells them apart from single bytes
+const hexDumpMinOffsetDigits = 4
+
+// decodeHexDump decodes data as either a sequence of hex digits, possibly
+// separated by whitespace, or a dump with an offset at the start of each line
+// and optionally the bytes as text at the end, as printed by xxd, hexdump -C,
+// od -A x -t x1z and Wireshark. It returns false if data is not a hex dump,
+// and an error if it looks like a dump with offsets but cannot be decoded.
+func decodeHexDump(data []byte) ([]byte, bool, error) {
+	bare, bareOK := decodeBareHex(data)
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, strings.TrimSuffix(line, "\r"))
+		}
+	}
+	if !hasOffsetColumn(lines) {
+		return bare, bareOK, nil
+	}
+	// A single line of hex digits is more likely bare bytes than a dump
+	if bareOK && len(lines) == 1 && !strings.Contains(lines[0], ":") {
+		return bare, true, nil
+	}
+	decoded, err := decodeOffsetHexDump(lines)
+	if err != nil {
+		if bareOK {
+			return bare, true, nil
+		}
+		return nil, true, fmt.Errorf("unable to decode hex dump: %w", err)
+	}
+	return decoded, true, nil
+}
+
+func decodeBareHex(data []byte) ([]byte, bool) {
+	digits := bytes.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, data)
+	if len(digits) == 0 {
+		return nil, false
+	}
+	decoded, err := hex.DecodeString(string(digits))
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// parseHexDumpOffset parses the first field of a line as an offset.
+func parseHexDumpOffset(line string) (int64, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	field := strings.TrimSuffix(fields[0], ":")
+	if len(field) < hexDumpMinOffsetDigits {
+		return 0, false
+	}
+	offset, err := strconv.ParseInt(field, 16, 64)
+	return offset, err == nil
+}
+
+// hasOffsetColumn tells whether lines start with offsets, the first of which
+// is zero. Lines made of a single "*" stand for repetitions of the previous one.
+func hasOffsetColumn(lines []string) bool {
+	if len(lines) == 0 {
+		return false
+	}
+	if offset, ok := parseHexDumpOffset(lines[0]); !ok || offset != 0 {
+		return false
+	}
+	for _, line := range lines[1:] {
+		if _, ok := parseHexDumpOffset(line); !ok && strings.TrimSpace(line) != "*" {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeOffsetHexDump(lines []string) ([]byte, error) {
+	var decoded, previous []byte
+	repeat := false
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "*" {
+			repeat = true
+			continue
+		}
+		offset, data, err := parseHexDumpLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if repeat {
+			// Identical lines are replaced by "*" up to the next offset
+			gap := offset - int64(len(decoded))
+			if len(previous) == 0 || gap < 0 || gap%int64(len(previous)) != 0 {
+				return nil, fmt.Errorf("line %d: offset %x does not follow a repeated line", i+1, offset)
+			}
+			for range gap / int64(len(previous)) {
+				decoded = append(decoded, previous...)
+			}
+			repeat = false
+		}
+		if offset != int64(len(decoded)) {
+			return nil, fmt.Errorf("line %d: offset %x, expected %x", i+1, offset, len(decoded))
+		}
+		decoded = append(decoded, data...)
+		previous = data
+	}
+	if repeat {
+		return nil, fmt.Errorf("repeated line without a final offset")
+	}
+	return decoded, nil
+}
+
+type hexDumpToken struct {
+	Start, End int
+}
+
+// parseHexDumpLine returns the offset of a line and the bytes on it, telling
+// them apart from the text at the end of the line, if any.
+func parseHexDumpLine(line string) (int64, []byte, error) {
+	offset, _ := parseHexDumpOffset(line)
+	line = strings.TrimLeft(line, " \t")
+	start := strings.IndexAny(line, " \t")
+	if start < 0 || strings.TrimSpace(line[start:]) == "" {
+		// Only an offset, as at the end of hexdump -C and od output
+		return offset, nil, nil
+	}
+	rest := line[start:]
+
+	// hexdump -C and od delimit the text, which therefore can be dropped.
+	// Trailing spaces are only trimmed here, as they may belong to the text.
+	delimited := false
+	for _, text := range []struct{ Open, Close string }{{"|", "|"}, {">", "<"}} {
+		if strings.HasSuffix(strings.TrimRight(rest, " \t"), text.Close) {
+			if i := strings.Index(rest, "  "+text.Open); i >= 0 {
+				rest, delimited = rest[:i], true
+				break
+			}
+		}
+	}
+
+	var tokens []hexDumpToken
+	for i := 0; i < len(rest); {
+		if rest[i] == ' ' || rest[i] == '\t' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(rest) && rest[j] != ' ' && rest[j] != '\t' {
+			j++
+		}
+		tokens = append(tokens, hexDumpToken{i, j})
+		i = j
+	}
+	groups := 0
+	for groups < len(tokens) && isHexGroup(rest[tokens[groups].Start:tokens[groups].End]) {
+		groups++
+	}
+
+	used := groups
+	if !delimited {
+		// Otherwise, the text is separated from the bytes by at least two
+		// spaces, and holds one character per byte. Text which looks like hex
+		// digits makes the number of groups ambiguous, but only one split
+		// satisfies both conditions.
+		used = -1
+		for k := groups; k > 0; k-- {
+			size := 0
+			for _, token := range tokens[:k] {
+				size += (token.End - token.Start) / 2
+			}
+			after := rest[tokens[k-1].End:]
+			if len(after) >= size+2 && strings.TrimLeft(after[:len(after)-size], " \t") == "" {
+				used = k
+				break
+			}
+		}
+		if used < 0 {
+			if groups < len(tokens) {
+				return 0, nil, fmt.Errorf("unexpected %q", rest[tokens[groups].Start:tokens[groups].End])
+			}
+			used = groups
+		}
+	} else if groups < len(tokens) {
+		return 0, nil, fmt.Errorf("unexpected %q", rest[tokens[groups].Start:tokens[groups].End])
+	}
+
+	var data []byte
+	for _, token := range tokens[:used] {
+		group, _ := hex.DecodeString(rest[token.Start:token.End])
+		data = append(data, group...)
+	}
+	return offset, data, nil
+}
+
+func isHexGroup(s string) bool {
+	if len(s)%2 != 0 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
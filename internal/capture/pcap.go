@@ -0,0 +1,186 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var errTruncated = errors.New("truncated capture file")
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+	pcapngMagic    = 0x0a0d0d0a
+
+	pcapngByteOrderMagic = 0x1a2b3c4d
+
+	pcapngBlockInterfaceDescription = 1
+	pcapngBlockSimplePacket         = 3
+	pcapngBlockEnhancedPacket       = 6
+
+	pcapngOptionEnd            = 0
+	pcapngOptionIfTSResolution = 9
+)
+
+func isPcap(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if magic := order.Uint32(data); magic == pcapMagicMicro || magic == pcapMagicNano {
+			return true
+		}
+	}
+	return false
+}
+
+func isPcapng(data []byte) bool {
+	return len(data) >= 4 && binary.BigEndian.Uint32(data) == pcapngMagic
+}
+
+func readPcap(data []byte) ([]*Stream, error) {
+	const globalHeaderLen = 24
+	const recordHeaderLen = 16
+
+	if len(data) < globalHeaderLen {
+		return nil, errTruncated
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(data)
+	if magic != pcapMagicMicro && magic != pcapMagicNano {
+		order = binary.BigEndian
+		magic = order.Uint32(data)
+	}
+	fractionUnit := time.Microsecond
+	if magic == pcapMagicNano {
+		fractionUnit = time.Nanosecond
+	}
+	linkType := order.Uint32(data[20:]) & 0xffff
+
+	var asm assembler
+	for data = data[globalHeaderLen:]; len(data) > 0; {
+		if len(data) < recordHeaderLen {
+			return nil, errTruncated
+		}
+		ts := time.Unix(int64(order.Uint32(data)), 0).Add(time.Duration(order.Uint32(data[4:])) * fractionUnit)
+		capLen := int(order.Uint32(data[8:]))
+		data = data[recordHeaderLen:]
+		if capLen > len(data) {
+			return nil, errTruncated
+		}
+		asm.addFrame(linkType, ts, data[:capLen])
+		data = data[capLen:]
+	}
+	return asm.streams(), nil
+}
+
+type pcapngInterface struct {
+	linkType uint32
+	// Timestamps are in units of 10^-tsExp seconds, or 2^-tsExp if tsBinary
+	tsBinary bool
+	tsExp    uint8
+}
+
+func readPcapng(data []byte) ([]*Stream, error) {
+	const blockHeaderLen = 8
+
+	var order binary.ByteOrder = binary.LittleEndian
+	var interfaces []pcapngInterface
+	var asm assembler
+
+	for len(data) > 0 {
+		if len(data) < blockHeaderLen+4 {
+			return nil, errTruncated
+		}
+		blockType := binary.BigEndian.Uint32(data)
+		if blockType == pcapngMagic {
+			// A new section, possibly with a different byte order
+			if binary.LittleEndian.Uint32(data[8:]) == pcapngByteOrderMagic {
+				order = binary.LittleEndian
+			} else {
+				order = binary.BigEndian
+			}
+			interfaces = nil
+		} else {
+			blockType = order.Uint32(data)
+		}
+		blockLen := int(order.Uint32(data[4:]))
+		if blockLen < blockHeaderLen+4 || blockLen > len(data) {
+			return nil, errTruncated
+		}
+		body := data[blockHeaderLen : blockLen-4]
+		data = data[blockLen:]
+
+		switch blockType {
+		case pcapngBlockInterfaceDescription:
+			if len(body) < 8 {
+				return nil, errTruncated
+			}
+			iface := pcapngInterface{
+				linkType: uint32(order.Uint16(body)),
+				tsExp:    6,
+			}
+			if res, ok := pcapngFindOption(order, body[8:], pcapngOptionIfTSResolution); ok && len(res) > 0 {
+				iface.tsBinary = res[0]&0x80 != 0
+				iface.tsExp = res[0] & 0x7f
+			}
+			interfaces = append(interfaces, iface)
+		case pcapngBlockEnhancedPacket:
+			if len(body) < 20 {
+				return nil, errTruncated
+			}
+			ifIndex := int(order.Uint32(body))
+			if ifIndex >= len(interfaces) {
+				return nil, fmt.Errorf("packet refers to unknown interface %d", ifIndex)
+			}
+			iface := interfaces[ifIndex]
+			ticks := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			capLen := int(order.Uint32(body[12:]))
+			if 20+capLen > len(body) {
+				return nil, errTruncated
+			}
+			asm.addFrame(iface.linkType, iface.timestamp(ticks), body[20:20+capLen])
+		case pcapngBlockSimplePacket:
+			if len(interfaces) == 0 {
+				return nil, fmt.Errorf("packet refers to unknown interface 0")
+			}
+			if len(body) < 4 {
+				return nil, errTruncated
+			}
+			capLen := min(int(order.Uint32(body)), len(body)-4)
+			// Simple packets carry no timestamp, keep them in capture order
+			asm.addFrame(interfaces[0].linkType, asm.lastTime, body[4:4+capLen])
+		}
+	}
+	return asm.streams(), nil
+}
+
+func (iface *pcapngInterface) timestamp(ticks uint64) time.Time {
+	var perSecond uint64
+	if iface.tsBinary {
+		perSecond = 1 << min(iface.tsExp, 63)
+	} else {
+		perSecond = uint64(math.Pow10(int(min(iface.tsExp, 19))))
+	}
+	secs, frac := ticks/perSecond, ticks%perSecond
+	return time.Unix(int64(secs), int64(float64(frac)/float64(perSecond)*1e9))
+}
+
+func pcapngFindOption(order binary.ByteOrder, options []byte, code uint16) ([]byte, bool) {
+	for len(options) >= 4 {
+		optCode := order.Uint16(options)
+		optLen := int(order.Uint16(options[2:]))
+		if optCode == pcapngOptionEnd || 4+optLen > len(options) {
+			break
+		}
+		if optCode == code {
+			return options[4 : 4+optLen], true
+		}
+		// Option values are padded to 32 bits
+		options = options[min(4+(optLen+3)&^3, len(options)):]
+	}
+	return nil, false
+}
@@ -0,0 +1,296 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVLAN = 0x8100
+	etherTypeQinQ = 0x88a8
+	ipProtocolTCP = 6
+	tcpFlagSYN    = 0x02
+	tcpFlagACK    = 0x10
+)
+
+type tcpPacket struct {
+	src, dst netip.AddrPort
+	seq      uint32
+	flags    byte
+	payload  []byte
+}
+
+type flowKey struct {
+	src, dst netip.AddrPort
+}
+
+type capturedSegment struct {
+	seq  uint32
+	time time.Time
+	data []byte
+}
+
+type flow struct {
+	isnKnown bool
+	isn      uint32
+	start    time.Time
+	segments []capturedSegment
+}
+
+type conversation struct {
+	client, server netip.AddrPort
+	clientKnown    bool
+	flows          map[netip.AddrPort]*flow // keyed by sender
+}
+
+// assembler collects TCP segments from captured frames and rebuilds the
+// client-to-server byte streams.
+type assembler struct {
+	conversations []*conversation
+	byKey         map[flowKey]*conversation
+	lastTime      time.Time
+}
+
+func (asm *assembler) addFrame(linkType uint32, ts time.Time, frame []byte) {
+	asm.lastTime = ts
+	ip, ok := decodeLink(linkType, frame)
+	if !ok {
+		return
+	}
+	pkt, ok := decodeIP(ip)
+	if !ok {
+		return
+	}
+
+	if asm.byKey == nil {
+		asm.byKey = make(map[flowKey]*conversation)
+	}
+	conv := asm.byKey[flowKey{pkt.src, pkt.dst}]
+	if conv == nil {
+		conv = &conversation{
+			client: pkt.src,
+			server: pkt.dst,
+			flows:  make(map[netip.AddrPort]*flow),
+		}
+		asm.conversations = append(asm.conversations, conv)
+		asm.byKey[flowKey{pkt.src, pkt.dst}] = conv
+		asm.byKey[flowKey{pkt.dst, pkt.src}] = conv
+	}
+	fl := conv.flows[pkt.src]
+	if fl == nil {
+		fl = &flow{}
+		conv.flows[pkt.src] = fl
+	}
+
+	if pkt.flags&tcpFlagSYN != 0 {
+		fl.isnKnown = true
+		fl.isn = pkt.seq + 1
+		if !conv.clientKnown {
+			conv.clientKnown = true
+			if pkt.flags&tcpFlagACK == 0 {
+				conv.client, conv.server = pkt.src, pkt.dst
+			} else {
+				conv.client, conv.server = pkt.dst, pkt.src
+			}
+		}
+		return
+	}
+	if fl.start.IsZero() {
+		fl.start = ts
+	}
+	if len(pkt.payload) > 0 {
+		fl.segments = append(fl.segments, capturedSegment{pkt.seq, ts, pkt.payload})
+	}
+}
+
+func (asm *assembler) streams() []*Stream {
+	var streams []*Stream
+	for _, conv := range asm.conversations {
+		fl := conv.flows[conv.client]
+		if fl == nil || len(fl.segments) == 0 {
+			continue
+		}
+		streams = append(streams, &Stream{
+			Client:   conv.client,
+			Server:   conv.server,
+			Segments: fl.reassemble(),
+		})
+	}
+	return streams
+}
+
+// reassemble orders the segments of a flow by sequence number. Where segments
+// overlap, as with retransmissions, data comes from the one which arrived
+// first. Reassembly stops at the first hole in the stream. Data becomes
+// available only after all the data preceding it, which determines the
+// timestamps of the returned segments.
+func (fl *flow) reassemble() []Segment {
+	base := fl.segments[0].seq
+	if fl.isnKnown {
+		base = fl.isn
+	}
+	offsets := make([]int64, len(fl.segments))
+	minOffset := int64(0)
+	for i := range fl.segments {
+		// Serial number arithmetic copes with sequence numbers wrapping around
+		offsets[i] = int64(int32(fl.segments[i].seq - base))
+		minOffset = min(minOffset, offsets[i])
+	}
+	if !fl.isnKnown {
+		for i := range offsets {
+			offsets[i] -= minOffset
+		}
+	}
+
+	var result []Segment
+	var cursor int64
+	var available time.Time
+	for {
+		next := -1
+		for i, seg := range fl.segments {
+			if offsets[i] > cursor || offsets[i]+int64(len(seg.data)) <= cursor {
+				continue
+			}
+			if next < 0 || seg.time.Before(fl.segments[next].time) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		seg := &fl.segments[next]
+		if seg.time.After(available) {
+			available = seg.time
+		}
+		start := fl.start
+		if start.IsZero() || start.After(available) {
+			start = available
+		}
+		result = append(result, Segment{
+			Time: available.Sub(start),
+			Data: seg.data[cursor-offsets[next]:],
+		})
+		cursor = offsets[next] + int64(len(seg.data))
+	}
+	return result
+}
+
+func decodeLink(linkType uint32, frame []byte) ([]byte, bool) {
+	switch linkType {
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return nil, false
+		}
+		return frame[4:], true
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:])
+		frame = frame[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(frame) < 4 {
+				return nil, false
+			}
+			etherType = binary.BigEndian.Uint16(frame[2:])
+			frame = frame[4:]
+		}
+		return frame, etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, false
+		}
+		return frame[16:], true
+	case linkTypeSLL2:
+		if len(frame) < 20 {
+			return nil, false
+		}
+		return frame[20:], true
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return frame, true
+	}
+	return nil, false
+}
+
+func decodeIP(packet []byte) (pkt tcpPacket, ok bool) {
+	if len(packet) < 1 {
+		return
+	}
+
+	var src, dst netip.Addr
+	var tcp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return
+		}
+		headerLen := int(packet[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(packet[2:]))
+		fragment := binary.BigEndian.Uint16(packet[6:])
+		// Fragments are not reassembled
+		if packet[9] != ipProtocolTCP || fragment&0x3fff != 0 ||
+			headerLen < 20 || totalLen < headerLen || totalLen > len(packet) {
+			return
+		}
+		src = netip.AddrFrom4([4]byte(packet[12:16]))
+		dst = netip.AddrFrom4([4]byte(packet[16:20]))
+		tcp = packet[headerLen:totalLen]
+	case 6:
+		if len(packet) < 40 {
+			return
+		}
+		payloadLen := int(binary.BigEndian.Uint16(packet[4:]))
+		if 40+payloadLen > len(packet) {
+			return
+		}
+		src = netip.AddrFrom16([16]byte(packet[8:24]))
+		dst = netip.AddrFrom16([16]byte(packet[24:40]))
+		nextHeader := packet[6]
+		tcp = packet[40 : 40+payloadLen]
+		// Skip hop-by-hop, routing and destination options
+		for nextHeader == 0 || nextHeader == 43 || nextHeader == 60 {
+			if len(tcp) < 8 {
+				return
+			}
+			extLen := (int(tcp[1]) + 1) * 8
+			if extLen > len(tcp) {
+				return
+			}
+			nextHeader = tcp[0]
+			tcp = tcp[extLen:]
+		}
+		if nextHeader != ipProtocolTCP {
+			return
+		}
+	default:
+		return
+	}
+
+	if len(tcp) < 20 {
+		return
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcp) {
+		return
+	}
+	pkt = tcpPacket{
+		src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(tcp)),
+		dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(tcp[2:])),
+		seq:     binary.BigEndian.Uint32(tcp[4:]),
+		flags:   tcp[13],
+		payload: tcp[dataOffset:],
+	}
+	return pkt, true
+}
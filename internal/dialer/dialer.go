@@ -0,0 +1,278 @@
+// Package dialer connects to hosts with several addresses, racing connection
+// attempts across address families as described by RFC 8305 (Happy Eyeballs
+// version 2).
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAttemptDelay is how long to wait for an attempt before starting
+	// the next one in parallel, as recommended by RFC 8305.
+	DefaultAttemptDelay = 250 * time.Millisecond
+	// DefaultFailurePenalty is how long addresses which failed to connect are
+	// tried after all others.
+	DefaultFailurePenalty = 30 * time.Second
+)
+
+// Resolver looks up the addresses of a host.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Dialer connects to all addresses of a host in turn, starting a new attempt
+// whenever the previous one fails or takes longer than the attempt delay,
+// until one succeeds. It is safe for concurrent use.
+type Dialer struct {
+	resolver       Resolver
+	dial           dialFunc
+	timeout        time.Duration
+	attemptTimeout time.Duration
+	attemptDelay   time.Duration
+	failurePenalty time.Duration
+	now            func() time.Time
+
+	mu     sync.Mutex
+	failed map[netip.AddrPort]time.Time
+}
+
+type Option func(dialer *Dialer)
+
+// WithAttemptTimeout bounds each connection attempt, so that a single
+// unresponsive address does not use the whole timeout.
+func WithAttemptTimeout(timeout time.Duration) Option {
+	return func(dialer *Dialer) {
+		if timeout > 0 {
+			dialer.attemptTimeout = timeout
+		}
+	}
+}
+
+// WithAttemptDelay sets how long to wait before starting the next attempt in
+// parallel with the pending ones.
+func WithAttemptDelay(delay time.Duration) Option {
+	return func(dialer *Dialer) {
+		if delay > 0 {
+			dialer.attemptDelay = delay
+		}
+	}
+}
+
+// WithFailurePenalty sets how long failed addresses are tried last.
+func WithFailurePenalty(penalty time.Duration) Option {
+	return func(dialer *Dialer) {
+		if penalty > 0 {
+			dialer.failurePenalty = penalty
+		}
+	}
+}
+
+// New returns a Dialer which resolves hosts using resolver and connects using
+// base. The Timeout of base bounds the whole operation, across all attempts.
+func New(base *net.Dialer, resolver Resolver, opts ...Option) *Dialer {
+	attemptDialer := *base
+	attemptDialer.Timeout = 0
+	return newWithDial(attemptDialer.DialContext, base.Timeout, resolver, time.Now, opts...)
+}
+
+func newWithDial(dial dialFunc, timeout time.Duration, resolver Resolver, now func() time.Time, opts ...Option) *Dialer {
+	dialer := &Dialer{
+		resolver:       resolver,
+		dial:           dial,
+		timeout:        timeout,
+		attemptDelay:   DefaultAttemptDelay,
+		failurePenalty: DefaultFailurePenalty,
+		now:            now,
+		failed:         make(map[netip.AddrPort]time.Time),
+	}
+	for _, opt := range opts {
+		opt(dialer)
+	}
+	return dialer
+}
+
+func (dialer *Dialer) Dial(network, address string) (net.Conn, error) {
+	return dialer.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address, whose host part can be a name or an IP
+// literal. network must be tcp, tcp4 or tcp6.
+func (dialer *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// The timeout covers name resolution too
+	if dialer.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.timeout)
+		defer cancel()
+	}
+	addrs, err := dialer.resolve(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.race(ctx, network, dialer.order(addrs))
+}
+
+func (dialer *Dialer) resolve(ctx context.Context, network, address string) ([]netip.AddrPort, error) {
+	var want func(netip.Addr) bool
+	switch network {
+	case "tcp":
+		want = func(netip.Addr) bool { return true }
+	case "tcp4":
+		want = netip.Addr.Is4
+	case "tcp6":
+		want = netip.Addr.Is6
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, network, portString)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := dialer.resolver.LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []netip.AddrPort
+	for _, ip := range ips {
+		if ip = ip.Unmap(); want(ip) {
+			addrs = append(addrs, netip.AddrPortFrom(ip, uint16(port)))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, &net.AddrError{Err: "no suitable address found", Addr: host}
+	}
+	return addrs, nil
+}
+
+// order interleaves address families, starting with the family of the first
+// address, as recommended by RFC 8305. Addresses which failed recently are
+// moved to the end, keeping their relative order.
+func (dialer *Dialer) order(addrs []netip.AddrPort) []netip.AddrPort {
+	var first, second []netip.AddrPort
+	for _, addr := range addrs {
+		if addr.Addr().Is4() == addrs[0].Addr().Is4() {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	ordered := make([]netip.AddrPort, 0, len(addrs))
+	for i := 0; i < max(len(first), len(second)); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	now := dialer.now()
+	var good, penalized []netip.AddrPort
+	for _, addr := range ordered {
+		if until, ok := dialer.failed[addr]; !ok {
+			good = append(good, addr)
+		} else if now.Before(until) {
+			penalized = append(penalized, addr)
+		} else {
+			delete(dialer.failed, addr)
+			good = append(good, addr)
+		}
+	}
+	return append(good, penalized...)
+}
+
+func (dialer *Dialer) report(addr netip.AddrPort, err error) {
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	if err == nil {
+		delete(dialer.failed, addr)
+	} else {
+		dialer.failed[addr] = dialer.now().Add(dialer.failurePenalty)
+	}
+}
+
+type attemptResult struct {
+	addr netip.AddrPort
+	conn net.Conn
+	err  error
+}
+
+// race starts an attempt for each address in turn, returning the first
+// connection established. Attempts still pending at that point are cancelled,
+// and connections they establish anyway are closed.
+func (dialer *Dialer) race(ctx context.Context, network string, addrs []netip.AddrPort) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	results := make(chan attemptResult)
+	pending := 0
+	defer func() {
+		cancel()
+		go func() {
+			for ; pending > 0; pending-- {
+				if result := <-results; result.conn != nil {
+					_ = result.conn.Close()
+				}
+			}
+		}()
+	}()
+
+	start := func(addr netip.AddrPort) {
+		pending++
+		go func() {
+			attemptCtx := ctx
+			if dialer.attemptTimeout > 0 {
+				var attemptCancel context.CancelFunc
+				attemptCtx, attemptCancel = context.WithTimeout(ctx, dialer.attemptTimeout)
+				defer attemptCancel()
+			}
+			conn, err := dialer.dial(attemptCtx, network, addr.String())
+			results <- attemptResult{addr, conn, err}
+		}()
+	}
+
+	delay := time.NewTimer(dialer.attemptDelay)
+	defer delay.Stop()
+	var errs []error
+	next := 0
+	startNext := func() {
+		if next < len(addrs) {
+			start(addrs[next])
+			next++
+			delay.Reset(dialer.attemptDelay)
+		}
+	}
+
+	startNext()
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+			dialer.report(result.addr, result.err)
+			if result.err == nil {
+				return result.conn, nil
+			}
+			errs = append(errs, result.err)
+			startNext()
+		case <-delay.C:
+			startNext()
+		case <-ctx.Done():
+			return nil, fmt.Errorf("dial %s: %w", network, errors.Join(append(errs, ctx.Err())...))
+		}
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,200 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type staticResolver []netip.Addr
+
+func (r staticResolver) LookupNetIP(context.Context, string) ([]netip.Addr, error) {
+	return r, nil
+}
+
+// stuckResolver never answers.
+type stuckResolver struct{}
+
+func (stuckResolver) LookupNetIP(ctx context.Context, _ string) ([]netip.Addr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// fakeNetwork connects successfully to the addresses in up, refuses
+// connections to those in down and never answers the others.
+type fakeNetwork struct {
+	up   map[string]bool
+	down map[string]bool
+
+	mu       sync.Mutex
+	attempts []string
+}
+
+func (network *fakeNetwork) dial(ctx context.Context, _, address string) (net.Conn, error) {
+	network.mu.Lock()
+	network.attempts = append(network.attempts, address)
+	network.mu.Unlock()
+	switch {
+	case network.up[address]:
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	case network.down[address]:
+		return nil, errors.New("connection refused")
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (network *fakeNetwork) Attempts() []string {
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	return append([]string(nil), network.attempts...)
+}
+
+func addrs(s ...string) []netip.Addr {
+	var result []netip.Addr
+	for _, a := range s {
+		result = append(result, netip.MustParseAddr(a))
+	}
+	return result
+}
+
+func TestOrderInterleavesFamilies(t *testing.T) {
+	tests := []struct {
+		Description string
+		Addrs       []netip.Addr
+		Expected    []string
+	}{
+		{"IPv6 first", addrs("2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2", "192.0.2.3"),
+			[]string{"[2001:db8::1]:80", "192.0.2.1:80", "[2001:db8::2]:80", "192.0.2.2:80", "192.0.2.3:80"}},
+		{"IPv4 first", addrs("192.0.2.1", "2001:db8::1", "192.0.2.2"),
+			[]string{"192.0.2.1:80", "[2001:db8::1]:80", "192.0.2.2:80"}},
+		{"Single family", addrs("192.0.2.1", "192.0.2.2"),
+			[]string{"192.0.2.1:80", "192.0.2.2:80"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			dialer := newWithDial(nil, 0, nil, time.Now)
+			var input []netip.AddrPort
+			for _, addr := range test.Addrs {
+				input = append(input, netip.AddrPortFrom(addr, 80))
+			}
+			var ordered []string
+			for _, addr := range dialer.order(input) {
+				ordered = append(ordered, addr.String())
+			}
+			require.Equal(t, test.Expected, ordered)
+		})
+	}
+}
+
+func TestDialSkipsUnresponsiveAddress(t *testing.T) {
+	network := &fakeNetwork{up: map[string]bool{"192.0.2.2:80": true}}
+	dialer := newWithDial(network.dial, time.Minute, staticResolver(addrs("192.0.2.1", "192.0.2.2")), time.Now,
+		WithAttemptDelay(10*time.Millisecond))
+
+	start := time.Now()
+	conn, err := dialer.Dial("tcp", "proxy.example:80")
+	require.NoError(t, err)
+	_ = conn.Close()
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, []string{"192.0.2.1:80", "192.0.2.2:80"}, network.Attempts())
+}
+
+func TestDialMovesOnAfterFailure(t *testing.T) {
+	network := &fakeNetwork{
+		up:   map[string]bool{"192.0.2.2:80": true},
+		down: map[string]bool{"192.0.2.1:80": true},
+	}
+	// The delay is long enough that only a failure can start the next attempt
+	dialer := newWithDial(network.dial, time.Minute, staticResolver(addrs("192.0.2.1", "192.0.2.2")), time.Now,
+		WithAttemptDelay(time.Hour))
+
+	conn, err := dialer.Dial("tcp", "proxy.example:80")
+	require.NoError(t, err)
+	_ = conn.Close()
+	require.Equal(t, []string{"192.0.2.1:80", "192.0.2.2:80"}, network.Attempts())
+}
+
+func TestDialPenalizesFailedAddresses(t *testing.T) {
+	network := &fakeNetwork{
+		up:   map[string]bool{"192.0.2.2:80": true},
+		down: map[string]bool{"192.0.2.1:80": true},
+	}
+	now := time.Unix(1700000000, 0)
+	dialer := newWithDial(network.dial, time.Minute, staticResolver(addrs("192.0.2.1", "192.0.2.2")),
+		func() time.Time { return now }, WithFailurePenalty(time.Minute))
+
+	for _, expected := range [][]string{
+		{"192.0.2.1:80", "192.0.2.2:80"},
+		// The failed address is now tried last
+		{"192.0.2.1:80", "192.0.2.2:80", "192.0.2.2:80"},
+	} {
+		conn, err := dialer.Dial("tcp", "proxy.example:80")
+		require.NoError(t, err)
+		_ = conn.Close()
+		require.Equal(t, expected, network.Attempts())
+	}
+
+	now = now.Add(time.Minute)
+	conn, err := dialer.Dial("tcp", "proxy.example:80")
+	require.NoError(t, err)
+	_ = conn.Close()
+	require.Equal(t, "192.0.2.1:80", network.Attempts()[3])
+}
+
+func TestDialAttemptTimeout(t *testing.T) {
+	network := &fakeNetwork{}
+	dialer := newWithDial(network.dial, time.Minute, staticResolver(addrs("192.0.2.1", "192.0.2.2")), time.Now,
+		WithAttemptDelay(time.Hour), WithAttemptTimeout(10*time.Millisecond))
+
+	start := time.Now()
+	_, err := dialer.Dial("tcp", "proxy.example:80")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+	require.Len(t, network.Attempts(), 2)
+}
+
+func TestDialTimeoutCoversResolution(t *testing.T) {
+	network := &fakeNetwork{}
+	dialer := newWithDial(network.dial, 10*time.Millisecond, stuckResolver{}, time.Now)
+
+	start := time.Now()
+	_, err := dialer.Dial("tcp", "proxy.example:80")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+	require.Empty(t, network.Attempts())
+}
+
+func TestDialFiltersFamilies(t *testing.T) {
+	network := &fakeNetwork{up: map[string]bool{"192.0.2.1:80": true}}
+	dialer := newWithDial(network.dial, time.Minute, staticResolver(addrs("2001:db8::1", "192.0.2.1")), time.Now)
+
+	conn, err := dialer.Dial("tcp4", "proxy.example:80")
+	require.NoError(t, err)
+	_ = conn.Close()
+	require.Equal(t, []string{"192.0.2.1:80"}, network.Attempts())
+
+	_, err = newWithDial(network.dial, time.Minute, staticResolver(addrs("192.0.2.1")), time.Now).
+		Dial("tcp6", "proxy.example:80")
+	require.Error(t, err)
+}
+
+func TestDialLoopback(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	dialer := New(&net.Dialer{Timeout: time.Second}, staticResolver(addrs("127.0.0.1")))
+	conn, err := dialer.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	require.IsType(t, &net.TCPConn{}, conn)
+	_ = conn.Close()
+}
@@ -0,0 +1,244 @@
+// Package dnsmap remembers which hostname each address was handed out for in
+// DNS answers, so that connections to that address can be attributed to the
+// name even when their protocol does not carry it.
+package dnsmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMinTTL is the minimum time an address is remembered for, since
+	// clients often keep using addresses after their DNS TTL expires.
+	DefaultMinTTL = 5 * time.Minute
+	// DefaultMaxTTL caps the time an address is remembered for.
+	DefaultMaxTTL = 24 * time.Hour
+)
+
+// Expired entries are dropped when the map grows beyond this size
+const mapSweepThreshold = 4096
+
+// Fake pools larger than this are only partly used
+const maxFakePoolSize = 1 << 24
+
+type mapEntry struct {
+	name    string
+	expires time.Time
+}
+
+// fakePool hands out the addresses of a prefix in turn, reusing the least
+// recently allocated one once all are taken.
+type fakePool struct {
+	prefix netip.Prefix
+	size   uint64
+	next   uint64
+	names  map[string]netip.Addr
+	addrs  map[netip.Addr]string
+}
+
+// Map associates addresses with hostnames. It is safe for concurrent use. A
+// nil Map knows no addresses.
+type Map struct {
+	now    func() time.Time
+	minTTL time.Duration
+	maxTTL time.Duration
+	fake4  *fakePool
+	fake6  *fakePool
+
+	mu      sync.Mutex
+	entries map[netip.Addr]mapEntry
+}
+
+type Option func(m *Map)
+
+// WithMinTTL sets the minimum time an address is remembered for.
+func WithMinTTL(ttl time.Duration) Option {
+	return func(m *Map) {
+		if ttl > 0 {
+			m.minTTL = ttl
+		}
+	}
+}
+
+// WithMaxTTL caps the time an address is remembered for.
+func WithMaxTTL(ttl time.Duration) Option {
+	return func(m *Map) {
+		if ttl > 0 {
+			m.maxTTL = ttl
+		}
+	}
+}
+
+// WithFakePrefix enables handing out synthetic addresses from prefix, which
+// should be reserved for this purpose, like 198.18.0.0/15. At most one prefix
+// per address family is used.
+func WithFakePrefix(prefix netip.Prefix) Option {
+	return func(m *Map) {
+		prefix = prefix.Masked()
+		hostBits := prefix.Addr().BitLen() - prefix.Bits()
+		size := uint64(maxFakePoolSize)
+		if hostBits < 24 {
+			size = 1 << hostBits
+		}
+		pool := &fakePool{
+			prefix: prefix,
+			size:   size,
+			next:   1,
+			names:  make(map[string]netip.Addr),
+			addrs:  make(map[netip.Addr]string),
+		}
+		if prefix.Addr().Is4() {
+			m.fake4 = pool
+		} else {
+			m.fake6 = pool
+		}
+	}
+}
+
+// New returns an empty Map.
+func New(opts ...Option) *Map {
+	return newWithClock(time.Now, opts...)
+}
+
+func newWithClock(now func() time.Time, opts ...Option) *Map {
+	m := &Map{
+		now:     now,
+		minTTL:  DefaultMinTTL,
+		maxTTL:  DefaultMaxTTL,
+		entries: make(map[netip.Addr]mapEntry),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// ValidateFakePrefix tells whether prefix can be used with WithFakePrefix.
+func ValidateFakePrefix(prefix netip.Prefix) error {
+	// Room for the network address, plus at least two hosts
+	if prefix.Addr().BitLen()-prefix.Bits() < 2 {
+		return fmt.Errorf("fake address prefix %s is too small", prefix)
+	}
+	return nil
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Add remembers that addr was given out as an address of name, for ttl
+// bounded by the map limits.
+func (m *Map) Add(name string, addr netip.Addr, ttl time.Duration) {
+	if m == nil {
+		return
+	}
+	ttl = min(max(ttl, m.minTTL), m.maxTTL)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[addr.Unmap()] = mapEntry{normalizeName(name), m.now().Add(ttl)}
+	if len(m.entries) > mapSweepThreshold {
+		m.sweep()
+	}
+}
+
+// sweep drops expired entries. It must be called with the lock held.
+func (m *Map) sweep() {
+	now := m.now()
+	for addr, entry := range m.entries {
+		if !now.Before(entry.expires) {
+			delete(m.entries, addr)
+		}
+	}
+}
+
+// Lookup returns the hostname addr was given out for, if it is still known.
+func (m *Map) Lookup(addr netip.Addr) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	addr = addr.Unmap()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pool := m.fakePoolFor(addr); pool != nil {
+		name, ok := pool.addrs[addr]
+		return name, ok
+	}
+	entry, ok := m.entries[addr]
+	if !ok || !m.now().Before(entry.expires) {
+		return "", false
+	}
+	return entry.name, true
+}
+
+// IsFake tells whether addr belongs to a fake prefix, whether or not it has been
+// given out.
+func (m *Map) IsFake(addr netip.Addr) bool {
+	return m != nil && m.fakePoolFor(addr.Unmap()) != nil
+}
+
+func (m *Map) fakePoolFor(addr netip.Addr) *fakePool {
+	for _, pool := range []*fakePool{m.fake4, m.fake6} {
+		if pool != nil && pool.prefix.Contains(addr) {
+			return pool
+		}
+	}
+	return nil
+}
+
+// Faking tells whether the map hands out synthetic addresses.
+func (m *Map) Faking() bool {
+	return m != nil && (m.fake4 != nil || m.fake6 != nil)
+}
+
+// FakeAddr returns the synthetic address given out for name, allocating one if
+// needed. It returns false if there is no fake prefix for the requested
+// address family.
+func (m *Map) FakeAddr(name string, ipv6 bool) (netip.Addr, bool) {
+	if m == nil {
+		return netip.Addr{}, false
+	}
+	pool := m.fake4
+	if ipv6 {
+		pool = m.fake6
+	}
+	if pool == nil {
+		return netip.Addr{}, false
+	}
+	name = normalizeName(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if addr, ok := pool.names[name]; ok {
+		return addr, true
+	}
+
+	addr := offsetAddr(pool.prefix.Addr(), pool.next)
+	// Skip the network address, and the broadcast address of IPv4 pools
+	pool.next++
+	if end := pool.size; pool.next == end || !ipv6 && pool.next == end-1 {
+		pool.next = 1
+	}
+	if previous, ok := pool.addrs[addr]; ok {
+		delete(pool.names, previous)
+	}
+	pool.names[name] = addr
+	pool.addrs[addr] = name
+	return addr, true
+}
+
+// offsetAddr adds offset to base, the address of a prefix with enough host
+// bits for it.
+func offsetAddr(base netip.Addr, offset uint64) netip.Addr {
+	bytes := base.As16()
+	low := binary.BigEndian.Uint64(bytes[8:])
+	binary.BigEndian.PutUint64(bytes[8:], low+offset)
+	addr := netip.AddrFrom16(bytes)
+	if base.Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
@@ -0,0 +1,219 @@
+package dnsmap
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (clock *testClock) Now() time.Time {
+	return clock.now
+}
+
+func TestMapHonoursTTL(t *testing.T) {
+	clock := &testClock{time.Unix(0, 0)}
+	m := newWithClock(clock.Now, WithMinTTL(time.Minute), WithMaxTTL(time.Hour))
+	m.Add("WWW.Example.com.", netip.MustParseAddr("192.0.2.1"), 10*time.Second)
+	m.Add("long.example.com", netip.MustParseAddr("::ffff:192.0.2.2"), 48*time.Hour)
+
+	name, ok := m.Lookup(netip.MustParseAddr("::ffff:192.0.2.1"))
+	require.True(t, ok)
+	require.Equal(t, "www.example.com", name)
+
+	// The minimum TTL applies
+	clock.now = clock.now.Add(59 * time.Second)
+	_, ok = m.Lookup(netip.MustParseAddr("192.0.2.1"))
+	require.True(t, ok)
+	clock.now = clock.now.Add(time.Second)
+	_, ok = m.Lookup(netip.MustParseAddr("192.0.2.1"))
+	require.False(t, ok)
+
+	// And so does the maximum
+	name, ok = m.Lookup(netip.MustParseAddr("192.0.2.2"))
+	require.True(t, ok)
+	require.Equal(t, "long.example.com", name)
+	clock.now = clock.now.Add(time.Hour)
+	_, ok = m.Lookup(netip.MustParseAddr("192.0.2.2"))
+	require.False(t, ok)
+
+	_, ok = m.Lookup(netip.MustParseAddr("192.0.2.3"))
+	require.False(t, ok)
+}
+
+func TestNilMap(t *testing.T) {
+	var m *Map
+	m.Add("www.example.com", netip.MustParseAddr("192.0.2.1"), time.Minute)
+	_, ok := m.Lookup(netip.MustParseAddr("192.0.2.1"))
+	require.False(t, ok)
+	require.False(t, m.Faking())
+	require.False(t, m.IsFake(netip.MustParseAddr("198.18.0.1")))
+	_, ok = m.FakeAddr("www.example.com", false)
+	require.False(t, ok)
+}
+
+func TestFakeAddrs(t *testing.T) {
+	m := New(WithFakePrefix(netip.MustParsePrefix("198.18.0.5/30")), WithFakePrefix(netip.MustParsePrefix("fd00::/120")))
+	require.True(t, m.Faking())
+
+	fake := func(name string, ipv6 bool) string {
+		addr, ok := m.FakeAddr(name, ipv6)
+		require.True(t, ok)
+		return addr.String()
+	}
+	require.Equal(t, "198.18.0.5", fake("a.example.com", false))
+	require.Equal(t, "198.18.0.6", fake("b.example.com", false))
+	require.Equal(t, "198.18.0.5", fake("A.example.com.", false))
+	// The pool is exhausted, the oldest address is reused
+	require.Equal(t, "198.18.0.5", fake("c.example.com", false))
+	require.Equal(t, "fd00::1", fake("a.example.com", true))
+
+	name, ok := m.Lookup(netip.MustParseAddr("198.18.0.5"))
+	require.True(t, ok)
+	require.Equal(t, "c.example.com", name)
+	name, ok = m.Lookup(netip.MustParseAddr("fd00::1"))
+	require.True(t, ok)
+	require.Equal(t, "a.example.com", name)
+	_, ok = m.Lookup(netip.MustParseAddr("198.18.0.7"))
+	require.False(t, ok)
+	require.True(t, m.IsFake(netip.MustParseAddr("198.18.0.7")))
+	require.True(t, m.IsFake(netip.MustParseAddr("::ffff:198.18.0.5")))
+	require.False(t, m.IsFake(netip.MustParseAddr("198.18.0.8")))
+	require.Equal(t, "198.18.0.6", fake("a.example.com", false))
+
+	m = New(WithFakePrefix(netip.MustParsePrefix("198.18.0.0/15")))
+	_, ok = m.FakeAddr("www.example.com", true)
+	require.False(t, ok)
+
+	require.Error(t, ValidateFakePrefix(netip.MustParsePrefix("198.18.0.0/31")))
+	require.NoError(t, ValidateFakePrefix(netip.MustParsePrefix("198.18.0.0/30")))
+}
+
+// serveUpstream answers A queries for any name with a CNAME followed by addr,
+// on a local UDP socket.
+func serveUpstream(t *testing.T, addr string) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil {
+				continue
+			}
+			q := query.Questions[0]
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+				Questions: query.Questions,
+			}
+			if q.Type == dnsmessage.TypeA {
+				target := dnsmessage.MustNewName("target.example.")
+				response.Answers = []dnsmessage.Resource{
+					{
+						Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+						Body:   &dnsmessage.CNAMEResource{CNAME: target},
+					},
+					{
+						Header: dnsmessage.ResourceHeader{Name: target, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+						Body:   &dnsmessage.AResource{A: netip.MustParseAddr(addr).As4()},
+					},
+				}
+			}
+			packed, err := response.Pack()
+			if err == nil {
+				_, _ = conn.WriteTo(packed, client)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// startServer runs server on a local UDP socket and returns its address.
+func startServer(t *testing.T, server *Server) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() { _ = server.Serve(conn) }()
+	return conn.LocalAddr().String()
+}
+
+func query(t *testing.T, server, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	packed, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	require.NoError(t, err)
+	conn, err := net.Dial("udp4", server)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = conn.Write(packed)
+	require.NoError(t, err)
+	buf := make([]byte, maxMessageSize)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	var response dnsmessage.Message
+	require.NoError(t, response.Unpack(buf[:n]))
+	require.Equal(t, uint16(1234), response.ID)
+	return &response
+}
+
+func TestServerForwardsAndLearns(t *testing.T) {
+	m := New()
+	server := startServer(t, NewServer(m, []string{"127.0.0.1:1", serveUpstream(t, "192.0.2.1")}))
+
+	response := query(t, server, "www.example.com.", dnsmessage.TypeA)
+	require.Equal(t, dnsmessage.RCodeSuccess, response.RCode)
+	require.Len(t, response.Answers, 2)
+	name, ok := m.Lookup(netip.MustParseAddr("192.0.2.1"))
+	require.True(t, ok)
+	require.Equal(t, "www.example.com", name)
+
+	response = query(t, server, "www.example.com.", dnsmessage.TypeMX)
+	require.Equal(t, dnsmessage.RCodeSuccess, response.RCode)
+	require.Empty(t, response.Answers)
+}
+
+func TestServerFailsWithoutUpstream(t *testing.T) {
+	server := startServer(t, NewServer(New(), nil))
+	response := query(t, server, "www.example.com.", dnsmessage.TypeA)
+	require.Equal(t, dnsmessage.RCodeServerFailure, response.RCode)
+}
+
+func TestServerFakeAddrs(t *testing.T) {
+	m := New(WithFakePrefix(netip.MustParsePrefix("198.18.0.0/15")))
+	server := startServer(t, NewServer(m, []string{serveUpstream(t, "192.0.2.1")}))
+
+	response := query(t, server, "ssh.example.com.", dnsmessage.TypeA)
+	require.Equal(t, dnsmessage.RCodeSuccess, response.RCode)
+	require.Len(t, response.Answers, 1)
+	require.Equal(t, &dnsmessage.AResource{A: [4]byte{198, 18, 0, 1}}, response.Answers[0].Body)
+	require.Equal(t, uint32(fakeTTL), response.Answers[0].Header.TTL)
+	name, ok := m.Lookup(netip.MustParseAddr("198.18.0.1"))
+	require.True(t, ok)
+	require.Equal(t, "ssh.example.com", name)
+
+	// No IPv6 prefix, so no IPv6 addresses either
+	response = query(t, server, "ssh.example.com.", dnsmessage.TypeAAAA)
+	require.Equal(t, dnsmessage.RCodeSuccess, response.RCode)
+	require.Empty(t, response.Answers)
+
+	// Other queries are still forwarded
+	response = query(t, server, "ssh.example.com.", dnsmessage.TypeMX)
+	require.Equal(t, dnsmessage.RCodeSuccess, response.RCode)
+	_, ok = m.Lookup(netip.MustParseAddr("192.0.2.1"))
+	require.False(t, ok)
+}
@@ -0,0 +1,197 @@
+package dnsmap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// Timeout for forwarding a query to a single upstream server
+	forwardTimeout = 2 * time.Second
+	// TTL of synthetic answers, short so that clients keep asking and the
+	// addresses they use stay allocated
+	fakeTTL = 10
+	// Largest UDP DNS message
+	maxMessageSize = 65535
+)
+
+// Server is a DNS server which forwards queries to upstream servers, and
+// records the addresses in their answers into a Map. If the Map has fake
+// prefixes, A and AAAA queries are answered with synthetic addresses instead.
+// Only UDP is supported.
+type Server struct {
+	m        *Map
+	upstream []string
+}
+
+// NewServer returns a Server recording addresses into m, and forwarding
+// queries to the upstream servers, given as IP or IP:port, in order.
+func NewServer(m *Map, upstream []string) *Server {
+	server := &Server{m: m}
+	for _, addr := range upstream {
+		if _, err := netip.ParseAddr(addr); err == nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		server.upstream = append(server.upstream, addr)
+	}
+	return server
+}
+
+// Serve answers queries received on conn until reading from it fails.
+func (server *Server) Serve(conn net.PacketConn) error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query := slices.Clone(buf[:n])
+		go func() {
+			if response := server.handle(query); response != nil {
+				_, _ = conn.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+// handle returns the response to query, or nil if it must be dropped.
+func (server *Server) handle(query []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	if server.m.Faking() && question.Class == dnsmessage.ClassINET &&
+		(question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeAAAA) {
+		// Also answers queries for the family without a fake prefix, with no
+		// addresses, so that clients do not bypass the fake ones
+		addr, ok := server.m.FakeAddr(question.Name.String(), question.Type == dnsmessage.TypeAAAA)
+		return reply(header, question, dnsmessage.RCodeSuccess, addr, ok)
+	}
+
+	response, err := server.forward(query, header.ID)
+	if err != nil {
+		return reply(header, question, dnsmessage.RCodeServerFailure, netip.Addr{}, false)
+	}
+	server.learn(response)
+	return response
+}
+
+// reply builds a response to a query, holding addr as the only answer if
+// hasAddr is true.
+func reply(header dnsmessage.Header, question dnsmessage.Question, rcode dnsmessage.RCode, addr netip.Addr, hasAddr bool) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	if hasAddr {
+		resourceHeader := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: fakeTTL}
+		if addr.Is4() {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: resourceHeader, Body: &dnsmessage.AResource{A: addr.As4()}})
+		} else {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: resourceHeader, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	response, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// forward tries upstream servers in order until one answers.
+func (server *Server) forward(query []byte, id uint16) ([]byte, error) {
+	err := errors.New("no upstream DNS servers")
+	for _, upstream := range server.upstream {
+		var response []byte
+		if response, err = exchange(upstream, query, id); err == nil {
+			return response, nil
+		}
+	}
+	return nil, err
+}
+
+func exchange(upstream string, query []byte, id uint16) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var header dnsmessage.Header
+		if header, err = new(dnsmessage.Parser).Start(buf[:n]); err == nil && header.ID == id && header.Response {
+			return slices.Clone(buf[:n]), nil
+		}
+	}
+}
+
+// learn records the addresses in a response as belonging to the name in its
+// question, which is what clients asked for, rather than to the target of any
+// CNAME.
+func (server *Server) learn(response []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(response); err != nil {
+		return
+	}
+	question, err := p.Question()
+	if err != nil || p.SkipAllQuestions() != nil {
+		return
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		switch {
+		case h.Class != dnsmessage.ClassINET:
+			err = p.SkipAnswer()
+		case h.Type == dnsmessage.TypeA:
+			var r dnsmessage.AResource
+			if r, err = p.AResource(); err == nil {
+				server.m.Add(question.Name.String(), netip.AddrFrom4(r.A), time.Duration(h.TTL)*time.Second)
+			}
+		case h.Type == dnsmessage.TypeAAAA:
+			var r dnsmessage.AAAAResource
+			if r, err = p.AAAAResource(); err == nil {
+				server.m.Add(question.Name.String(), netip.AddrFrom16(r.AAAA), time.Duration(h.TTL)*time.Second)
+			}
+		default:
+			err = p.SkipAnswer()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package hostname
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+)
+
+const StrategyNameAddressMap = "dns"
+
+// AddressLookupFunc returns the hostname an address is known to belong to,
+// for example because a DNS answer gave it out.
+type AddressLookupFunc func(addr netip.Addr) (string, bool)
+
+type addressMapSniffer struct {
+	origin  netip.AddrPort
+	lookup  AddressLookupFunc
+	sniffer *Sniffer
+}
+
+func (sniffer *addressMapSniffer) SniffMetadata(c net.Conn) (*Metadata, error) {
+	metadata, err := sniffer.sniffer.SniffMetadata(c)
+	if err == nil {
+		return metadata, nil
+	}
+	if errors.As(err, new(*FatalError)) {
+		return nil, err
+	}
+	if name, ok := sniffer.lookup(sniffer.origin.Addr()); ok {
+		return &Metadata{
+			Protocol: ProtocolUnknown,
+			Strategy: StrategyNameAddressMap,
+			HostName: name,
+		}, nil
+	}
+	return nil, fmt.Errorf("%w, and no hostname is known for %s", err, sniffer.origin.Addr())
+}
+
+func (sniffer *addressMapSniffer) GetBufferedData() io.WriterTo {
+	return sniffer.sniffer.GetBufferedData()
+}
+
+func (sniffer *addressMapSniffer) Release() {
+	sniffer.sniffer.Release()
+}
+
+// NewAddressMapSniffer returns a sniffer which runs sniffer first and, if that
+// fails, looks up the hostname of origin, the original destination of the
+// connection, so that protocols which do not carry a hostname get one too.
+// Names found in the data sent by the client take precedence, as they tell
+// apart the hosts sharing an address. Fatal errors are returned as they are,
+// since the connection cannot be forwarded after them.
+func NewAddressMapSniffer(origin netip.AddrPort, lookup AddressLookupFunc, sniffer *Sniffer) *Sniffer {
+	return NewSnifferFromInterface(&addressMapSniffer{origin, lookup, sniffer})
+}
@@ -0,0 +1,104 @@
+package hostname
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressMapSniffer(t *testing.T) {
+	names := map[netip.Addr]string{netip.MustParseAddr("192.0.2.1"): "ssh.example.com"}
+	lookup := func(addr netip.Addr) (string, bool) {
+		name, ok := names[addr]
+		return name, ok
+	}
+	tests := []struct {
+		Description string
+		Origin      string
+		Request     string
+		Expected    *Metadata
+	}{
+		{
+			"Name from the map",
+			"192.0.2.1:22",
+			"SSH-2.0-OpenSSH_9.6\r\n",
+			&Metadata{Protocol: ProtocolUnknown, Strategy: StrategyNameAddressMap, HostName: "ssh.example.com"},
+		},
+		{
+			"Name from the client data",
+			"192.0.2.1:80",
+			"GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n",
+			&Metadata{Protocol: ProtocolHTTP, Strategy: StrategyNameHTTP, HostName: "www.example.com", HTTPMethod: "GET", HTTPPath: "/"},
+		},
+		{
+			"Unknown address",
+			"192.0.2.2:22",
+			"SSH-2.0-OpenSSH_9.6\r\n",
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			sniffer := NewAddressMapSniffer(netip.MustParseAddrPort(test.Origin), lookup,
+				NewSequentialSniffer(WithSequentialSnifferStrategy(NewIncrementalHTTPSnifferStrategy())))
+			defer sniffer.Release()
+			var metadata *Metadata
+			var err error
+			restOfRequest := streamRequestViaConn(strings.NewReader(test.Request), func(c net.Conn) {
+				metadata, err = sniffer.SniffMetadata(c)
+			})
+			if test.Expected == nil {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.Expected, metadata)
+			checkRebuiltRequest(t, strings.NewReader(test.Request), sniffer, restOfRequest)
+		})
+	}
+
+	// Without a sniffer for the client data, the map is enough
+	sniffer := NewAddressMapSniffer(netip.MustParseAddrPort("192.0.2.1:22"), lookup, NewNullSniffer())
+	hostName, err := sniffer.SniffHostName(nil)
+	require.NoError(t, err)
+	require.Equal(t, "ssh.example.com", hostName)
+}
+
+// failingSniffer fails with err without reading anything.
+type failingSniffer struct {
+	err error
+}
+
+func (sniffer *failingSniffer) SniffMetadata(c net.Conn) (*Metadata, error) {
+	return nil, sniffer.err
+}
+
+func (sniffer *failingSniffer) GetBufferedData() io.WriterTo {
+	return noBufferedData{}
+}
+
+func (sniffer *failingSniffer) Release() {}
+
+func TestAddressMapSnifferKeepsFatalErrors(t *testing.T) {
+	lookup := func(addr netip.Addr) (string, bool) {
+		return "ssh.example.com", true
+	}
+	fatal := WrapFatal(errors.New("client data lost"))
+	sniffer := NewAddressMapSniffer(netip.MustParseAddrPort("192.0.2.1:22"), lookup,
+		NewSnifferFromInterface(&failingSniffer{fatal}))
+	metadata, err := sniffer.SniffMetadata(nil)
+	require.Nil(t, metadata)
+	require.ErrorIs(t, err, fatal)
+
+	// Other errors still fall back to the map
+	sniffer = NewAddressMapSniffer(netip.MustParseAddrPort("192.0.2.1:22"), lookup,
+		NewSnifferFromInterface(&failingSniffer{errors.New("no hostname")}))
+	hostName, err := sniffer.SniffHostName(nil)
+	require.NoError(t, err)
+	require.Equal(t, "ssh.example.com", hostName)
+}
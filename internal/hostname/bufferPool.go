@@ -0,0 +1,46 @@
+package hostname
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Buffers which grew larger than this are left to the garbage collector, so
+// that a few clients sending lots of data cannot pin memory in the pool
+const maxPooledBufferSize = 64 << 10
+
+// Sniffers get their buffers from here, and put them back when released, so
+// that connections can share them over time
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buffer *bytes.Buffer) {
+	if buffer == nil || buffer.Cap() > maxPooledBufferSize {
+		return
+	}
+	buffer.Reset()
+	bufferPool.Put(buffer)
+}
+
+// noBufferedData is returned by sniffers which have no data to give back
+type noBufferedData struct{}
+
+func (noBufferedData) WriteTo(io.Writer) (int64, error) {
+	return 0, nil
+}
+
+// bufferedDataOrNothing avoids returning a nil *bytes.Buffer as an io.WriterTo
+func bufferedDataOrNothing(buffer *bytes.Buffer) io.WriterTo {
+	if buffer == nil {
+		return noBufferedData{}
+	}
+	return buffer
+}
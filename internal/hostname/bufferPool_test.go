@@ -0,0 +1,100 @@
+package hostname
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+
+	dissector "github.com/go-gost/tls-dissector"
+	"github.com/stretchr/testify/require"
+)
+
+var snifferEngines = []struct {
+	Name    string
+	Factory func() *Sniffer
+}{
+	{"Parallel", func() *Sniffer {
+		return NewParallelSniffer(
+			WithParallelSnifferStrategy(NewTLSSnifferStrategy()),
+			WithParallelSnifferStrategy(NewHTTPSnifferStrategy()),
+		)
+	}},
+	{"Sequential", func() *Sniffer {
+		return NewSequentialSniffer(
+			WithSequentialSnifferStrategy(NewIncrementalTLSSnifferStrategy()),
+			WithSequentialSnifferStrategy(NewIncrementalHTTPSnifferStrategy()),
+		)
+	}},
+}
+
+var poolTestClientHello = must(hex.DecodeString(makeHexStringFromClientHello(
+	&dissector.ClientHelloHandshake{
+		Version:            tls.VersionTLS12,
+		CipherSuites:       tlsTestCipherSuites,
+		CompressionMethods: tlsTestCompressionMethods,
+		Extensions: []dissector.Extension{&dissector.ServerNameExtension{
+			NameType: tlsSNINameTypeHostName,
+			Name:     "www.tlsname.test.com"}},
+	},
+	1,
+)))
+
+func TestSnifferRelease(t *testing.T) {
+	for _, engine := range snifferEngines {
+		t.Run(engine.Name, func(t *testing.T) {
+			sniffer := engine.Factory()
+			streamRequestViaConn(bytes.NewReader(poolTestClientHello), func(c net.Conn) {
+				_, _ = sniffer.SniffHostName(c)
+			})
+			sniffer.Release()
+			sniffer.Release()
+
+			var bufferedData bytes.Buffer
+			must(sniffer.GetBufferedData().WriteTo(&bufferedData))
+			require.Zero(t, bufferedData.Len())
+			require.Panics(t, func() { _, _ = sniffer.SniffHostName(nil) })
+		})
+	}
+}
+
+func TestOversizedBuffersAreNotPooled(t *testing.T) {
+	buffer := getBuffer()
+	buffer.Grow(2 * maxPooledBufferSize)
+	putBuffer(buffer)
+	// Pools may drop items at any time, so only the negative case can be
+	// checked reliably
+	for range 100 {
+		require.NotSame(t, buffer, getBuffer())
+	}
+}
+
+// Each goroutine plays a client performing a TLS handshake. Without Release,
+// every sniffer allocates its own buffer.
+func BenchmarkConcurrentHandshakes(b *testing.B) {
+	const concurrentHandshakes = 2048
+	for _, engine := range snifferEngines {
+		for _, release := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/Release=%v", engine.Name, release), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetParallelism(max(concurrentHandshakes/runtime.GOMAXPROCS(0), 1))
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						streamRequestViaConn(bytes.NewReader(poolTestClientHello), func(c net.Conn) {
+							sniffer := engine.Factory()
+							_, _ = sniffer.SniffHostName(c)
+							_, _ = sniffer.GetBufferedData().WriteTo(io.Discard)
+							if release {
+								sniffer.Release()
+							}
+						})
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package hostname
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	dissector "github.com/go-gost/tls-dissector"
+)
+
+const (
+	tlsExtensionServerName          = 0x0000
+	tlsExtensionSignatureAlgorithms = 0x000d
+)
+
+// ja3 returns the JA3 fingerprint of a ClientHello: the MD5 hash of its
+// version, cipher suites, extensions, supported groups and point formats, with
+// GREASE values left out.
+func ja3(clientHello *dissector.ClientHelloHandshake) string {
+	var fields [5][]string
+	fields[0] = []string{strconv.Itoa(int(clientHello.Version))}
+	for _, suite := range clientHello.CipherSuites {
+		if !isGREASE(uint16(suite)) {
+			fields[1] = append(fields[1], strconv.Itoa(int(suite)))
+		}
+	}
+	for _, ext := range clientHello.Extensions {
+		if !isGREASE(ext.Type()) {
+			fields[2] = append(fields[2], strconv.Itoa(int(ext.Type())))
+		}
+	}
+	if data, ok := tlsExtensionData(clientHello, tlsExtensionSupportedGroups); ok {
+		groups, _ := tlsVector(data, 2)
+		for _, group := range tlsUint16s(groups) {
+			if !isGREASE(group) {
+				fields[3] = append(fields[3], strconv.Itoa(int(group)))
+			}
+		}
+	}
+	if data, ok := tlsExtensionData(clientHello, tlsExtensionECPointFormats); ok {
+		formats, _ := tlsVector(data, 1)
+		for _, format := range formats {
+			fields[4] = append(fields[4], strconv.Itoa(int(format)))
+		}
+	}
+
+	joined := make([]string, len(fields))
+	for i, field := range fields {
+		joined[i] = strings.Join(field, "-")
+	}
+	hash := md5.Sum([]byte(strings.Join(joined, ",")))
+	return hex.EncodeToString(hash[:])
+}
+
+// ja4 returns the JA4 fingerprint of a ClientHello received over TCP. Unlike
+// JA3, it does not depend on the order of cipher suites and extensions, which
+// some clients shuffle on every connection.
+func ja4(clientHello *dissector.ClientHelloHandshake, version uint16, alpn string) string {
+	var ciphers, extensions, signatureAlgorithms []string
+	for _, suite := range clientHello.CipherSuites {
+		if !isGREASE(uint16(suite)) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", uint16(suite)))
+		}
+	}
+	sni := "i"
+	nExtensions := 0
+	for _, ext := range clientHello.Extensions {
+		switch extType := ext.Type(); {
+		case isGREASE(extType):
+			continue
+		case extType == tlsExtensionServerName:
+			sni = "d"
+		case extType != tlsExtensionALPN:
+			extensions = append(extensions, fmt.Sprintf("%04x", extType))
+		}
+		nExtensions++
+	}
+	if data, ok := tlsExtensionData(clientHello, tlsExtensionSignatureAlgorithms); ok {
+		algorithms, _ := tlsVector(data, 2)
+		for _, algorithm := range tlsUint16s(algorithms) {
+			signatureAlgorithms = append(signatureAlgorithms, fmt.Sprintf("%04x", algorithm))
+		}
+	}
+	slices.Sort(ciphers)
+	slices.Sort(extensions)
+	extensionsAndAlgorithms := strings.Join(extensions, ",")
+	if len(signatureAlgorithms) > 0 {
+		extensionsAndAlgorithms += "_" + strings.Join(signatureAlgorithms, ",")
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		ja4Version(version), sni, min(len(ciphers), 99), min(nExtensions, 99), ja4ALPN(alpn),
+		ja4Hash(len(ciphers), strings.Join(ciphers, ",")),
+		ja4Hash(len(extensions), extensionsAndAlgorithms))
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last characters of the first protocol offered,
+// falling back to its hex representation if they are not alphanumeric.
+func ja4ALPN(alpn string) string {
+	isAlphanumeric := func(c byte) bool {
+		return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+	switch {
+	case alpn == "":
+		return "00"
+	case isAlphanumeric(alpn[0]) && isAlphanumeric(alpn[len(alpn)-1]):
+		return alpn[:1] + alpn[len(alpn)-1:]
+	default:
+		hexALPN := hex.EncodeToString([]byte(alpn))
+		return hexALPN[:1] + hexALPN[len(hexALPN)-1:]
+	}
+}
+
+// ja4Hash returns the truncated SHA-256 hash JA4 uses for lists, or zeros for
+// empty lists.
+func ja4Hash(count int, list string) string {
+	if count == 0 {
+		return "000000000000"
+	}
+	hash := sha256.Sum256([]byte(list))
+	return hex.EncodeToString(hash[:6])
+}
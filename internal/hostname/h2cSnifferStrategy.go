@@ -0,0 +1,243 @@
+package hostname
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+const StrategyNameH2C = "h2c"
+
+// Sent by HTTP/2 clients with prior knowledge, before their first frame
+const h2cPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	h2cFrameHeaderLen = 9
+	// Clients cannot send larger frames before learning the server settings
+	h2cMaxFrameSize = 16384
+	// Default size of the HPACK dynamic table, which clients use until the
+	// server acknowledges a different one
+	h2cHeaderTableSize = 4096
+)
+
+const (
+	h2cFrameHeaders      = 0x1
+	h2cFramePriority     = 0x2
+	h2cFrameSettings     = 0x4
+	h2cFramePing         = 0x6
+	h2cFrameWindowUpdate = 0x8
+	h2cFrameContinuation = 0x9
+)
+
+const (
+	h2cFlagAck        = 0x1
+	h2cFlagEndHeaders = 0x4
+	h2cFlagPadded     = 0x8
+	h2cFlagPriority   = 0x20
+)
+
+var errH2CIncomplete = errors.New("incomplete HTTP/2 connection preface")
+
+type h2cFrame struct {
+	Type     uint8
+	Flags    uint8
+	StreamID uint32
+	Payload  []byte
+}
+
+// nextH2CFrame splits the first frame from data.
+func nextH2CFrame(data []byte) (h2cFrame, []byte, error) {
+	if len(data) < h2cFrameHeaderLen {
+		return h2cFrame{}, nil, errH2CIncomplete
+	}
+	length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+	if length > h2cMaxFrameSize {
+		return h2cFrame{}, nil, fmt.Errorf("HTTP/2 frame too large: %d bytes", length)
+	}
+	if len(data) < h2cFrameHeaderLen+length {
+		return h2cFrame{}, nil, errH2CIncomplete
+	}
+	frame := h2cFrame{
+		Type:     data[3],
+		Flags:    data[4],
+		StreamID: binary.BigEndian.Uint32(data[5:9]) & 0x7fffffff,
+		Payload:  data[h2cFrameHeaderLen : h2cFrameHeaderLen+length],
+	}
+	return frame, data[h2cFrameHeaderLen+length:], nil
+}
+
+// parseH2C looks for the request headers in the data sent by an HTTP/2 client
+// with prior knowledge: the connection preface, then a SETTINGS frame, and
+// then the HEADERS frame opening the first stream, possibly followed by
+// CONTINUATION frames. It returns errH2CIncomplete if data ends before that.
+func parseH2C(data []byte) (*Metadata, error) {
+	if !bytes.HasPrefix(data, []byte(h2cPreface)) {
+		if bytes.HasPrefix([]byte(h2cPreface), data) {
+			return nil, errH2CIncomplete
+		}
+		return nil, fmt.Errorf("not an HTTP/2 connection preface")
+	}
+	data = data[len(h2cPreface):]
+
+	frame, data, err := nextH2CFrame(data)
+	if err != nil {
+		return nil, err
+	}
+	if frame.Type != h2cFrameSettings || frame.Flags&h2cFlagAck != 0 || frame.StreamID != 0 || len(frame.Payload)%6 != 0 {
+		return nil, fmt.Errorf("HTTP/2 connection preface not followed by SETTINGS")
+	}
+
+	// Frames which do not belong to streams may come before the first request
+	for {
+		if frame, data, err = nextH2CFrame(data); err != nil {
+			return nil, err
+		}
+		if frame.Type == h2cFrameHeaders {
+			break
+		}
+		switch frame.Type {
+		case h2cFrameSettings, h2cFramePing, h2cFrameWindowUpdate, h2cFramePriority:
+		default:
+			return nil, fmt.Errorf("unexpected HTTP/2 frame of type %d before HEADERS", frame.Type)
+		}
+	}
+	if frame.StreamID == 0 || frame.StreamID%2 == 0 {
+		return nil, fmt.Errorf("HTTP/2 HEADERS on invalid stream %d", frame.StreamID)
+	}
+
+	block := frame.Payload
+	padding := 0
+	if frame.Flags&h2cFlagPadded != 0 {
+		if len(block) < 1 {
+			return nil, fmt.Errorf("truncated HTTP/2 HEADERS frame")
+		}
+		padding, block = int(block[0]), block[1:]
+	}
+	if frame.Flags&h2cFlagPriority != 0 {
+		if len(block) < 5 {
+			return nil, fmt.Errorf("truncated HTTP/2 HEADERS frame")
+		}
+		block = block[5:]
+	}
+	if padding > len(block) {
+		return nil, fmt.Errorf("invalid padding in HTTP/2 HEADERS frame")
+	}
+	block = block[:len(block)-padding]
+	// The capacity limit makes appending CONTINUATION frames copy, rather than
+	// overwrite them
+	block = block[:len(block):len(block)]
+	for endHeaders := frame.Flags&h2cFlagEndHeaders != 0; !endHeaders; {
+		streamID := frame.StreamID
+		if frame, data, err = nextH2CFrame(data); err != nil {
+			return nil, err
+		}
+		if frame.Type != h2cFrameContinuation || frame.StreamID != streamID {
+			return nil, fmt.Errorf("HTTP/2 HEADERS not followed by CONTINUATION")
+		}
+		block = append(block, frame.Payload...)
+		endHeaders = frame.Flags&h2cFlagEndHeaders != 0
+	}
+
+	fields, err := hpack.NewDecoder(h2cHeaderTableSize, nil).DecodeFull(block)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode HTTP/2 headers: %w", err)
+	}
+	return metadataFromH2CHeaders(fields)
+}
+
+func metadataFromH2CHeaders(fields []hpack.HeaderField) (*Metadata, error) {
+	metadata := &Metadata{
+		Protocol: ProtocolH2C,
+		Strategy: StrategyNameH2C,
+	}
+	var authority, host string
+	for _, field := range fields {
+		switch field.Name {
+		case ":authority":
+			authority = field.Value
+		case "host":
+			host = field.Value
+		case ":method":
+			metadata.HTTPMethod = field.Value
+		case ":path":
+			metadata.HTTPPath = field.Value
+			if u, err := url.ParseRequestURI(field.Value); err == nil {
+				metadata.HTTPPath = u.Path
+			}
+		}
+	}
+	// Clients may send a Host header instead of :authority
+	if authority == "" {
+		authority = host
+	}
+	if authority == "" {
+		return nil, fmt.Errorf("HTTP/2 :authority pseudo-header is missing")
+	}
+	var err error
+	if metadata.HostName, metadata.Port, err = parseAuthority(authority); err != nil {
+		return nil, fmt.Errorf("invalid HTTP/2 :authority: %w", err)
+	}
+	return metadata, nil
+}
+
+func sniffMetadataFromH2C(r io.Reader) (*Metadata, error) {
+	data := make([]byte, len(h2cPreface), len(h2cPreface)+h2cFrameHeaderLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("unable to read HTTP/2 connection preface: %w", err)
+	}
+	for {
+		metadata, err := parseH2C(data)
+		if !errors.Is(err, errH2CIncomplete) {
+			return metadata, err
+		}
+		// Read one more frame
+		header := len(data)
+		data = append(data, make([]byte, h2cFrameHeaderLen)...)
+		if _, err = io.ReadFull(r, data[header:]); err != nil {
+			return nil, fmt.Errorf("unable to read HTTP/2 frame: %w", err)
+		}
+		length := int(data[header])<<16 | int(data[header+1])<<8 | int(data[header+2])
+		if length > h2cMaxFrameSize {
+			return nil, fmt.Errorf("HTTP/2 frame too large: %d bytes", length)
+		}
+		data = append(data, make([]byte, length)...)
+		if _, err = io.ReadFull(r, data[header+h2cFrameHeaderLen:]); err != nil {
+			return nil, fmt.Errorf("unable to read HTTP/2 frame: %w", err)
+		}
+	}
+}
+
+// sniffMetadataFromH2CIncremental gives up as soon as the data does not start
+// like the HTTP/2 connection preface.
+func sniffMetadataFromH2CIncremental(data []byte, atEOF bool) (*Metadata, SniffProgress) {
+	metadata, err := parseH2C(data)
+	switch {
+	case err == nil:
+		return metadata, SniffFound
+	case errors.Is(err, errH2CIncomplete) && !atEOF:
+		return nil, SniffNeedMore
+	default:
+		return nil, SniffNotMine
+	}
+}
+
+var h2cSingleton = NewSniffStrategyFromMetadataInterface(metadataSnifferStrategyFunction(sniffMetadataFromH2C))
+
+// NewH2CSnifferStrategy returns a strategy finding the :authority of the first
+// request sent by HTTP/2 clients with prior knowledge, like cleartext gRPC
+// clients, which do not start with an HTTP/1.1 request.
+func NewH2CSnifferStrategy() *SniffStrategy {
+	return h2cSingleton
+}
+
+var h2cIncrementalSingleton = NewIncrementalSniffStrategyFromInterface(
+	incrementalSniffStrategyFunction(sniffMetadataFromH2CIncremental))
+
+func NewIncrementalH2CSnifferStrategy() *IncrementalSniffStrategy {
+	return h2cIncrementalSingleton
+}
@@ -0,0 +1,226 @@
+package hostname
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// captureH2CRequest returns what a net/http client using HTTP/2 with prior
+// knowledge sends, up to the end of the headers of its first request.
+func captureH2CRequest(url string) string {
+	client, server := net.Pipe()
+	defer server.Close()
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{
+		Protocols: protocols,
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return client, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+	go func() {
+		if rsp, err := transport.RoundTrip(must(http.NewRequest("GET", url, nil))); err == nil {
+			rsp.Body.Close()
+		}
+	}()
+
+	var captured bytes.Buffer
+	r := io.TeeReader(server, &captured)
+	must(io.ReadFull(r, make([]byte, len(h2cPreface))))
+	framer := http2.NewFramer(nil, r)
+	for {
+		frame := must(framer.ReadFrame())
+		if frame.Header().Type == http2.FrameHeaders || frame.Header().Type == http2.FrameContinuation {
+			if frame.Header().Flags.Has(http2.FlagHeadersEndHeaders) {
+				return captured.String()
+			}
+		}
+	}
+}
+
+// makeH2CRequest returns the connection preface followed by the frames written
+// by writeFrames.
+func makeH2CRequest(writeFrames func(framer *http2.Framer)) string {
+	var request bytes.Buffer
+	request.WriteString(h2cPreface)
+	writeFrames(http2.NewFramer(&request, nil))
+	return request.String()
+}
+
+func encodeH2CHeaders(fields ...string) []byte {
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	for i := 0; i < len(fields); i += 2 {
+		must(struct{}{}, encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]}))
+	}
+	return block.Bytes()
+}
+
+func makeH2CRequestWithHeaders(streamID uint32, fields ...string) string {
+	return makeH2CRequest(func(framer *http2.Framer) {
+		must(struct{}{}, framer.WriteSettings())
+		must(struct{}{}, framer.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      streamID,
+			BlockFragment: encodeH2CHeaders(fields...),
+			EndStream:     true,
+			EndHeaders:    true,
+		}))
+	})
+}
+
+var h2cTestTable = []*testData{
+	// Bad
+	{
+		"HTTP/1.1 request",
+		"GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n",
+		require.Empty, require.Error,
+	},
+	{
+		"Preface only",
+		h2cPreface,
+		require.Empty, require.Error,
+	},
+	{
+		"Preface not followed by SETTINGS",
+		makeH2CRequest(func(framer *http2.Framer) {
+			must(struct{}{}, framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: encodeH2CHeaders(":method", "GET", ":authority", "www.example.com"),
+				EndHeaders:    true,
+			}))
+		}),
+		require.Empty, require.Error,
+	},
+	{
+		"DATA before HEADERS",
+		makeH2CRequest(func(framer *http2.Framer) {
+			must(struct{}{}, framer.WriteSettings())
+			must(struct{}{}, framer.WriteData(1, false, []byte("DATA")))
+		}),
+		require.Empty, require.Error,
+	},
+	{
+		"HEADERS on an even stream",
+		makeH2CRequestWithHeaders(2, ":method", "GET", ":authority", "www.example.com"),
+		require.Empty, require.Error,
+	},
+	{
+		"HEADERS without :authority",
+		makeH2CRequestWithHeaders(1, ":method", "GET", ":path", "/"),
+		require.Empty, require.Error,
+	},
+	{
+		"HEADERS with invalid HPACK",
+		makeH2CRequest(func(framer *http2.Framer) {
+			must(struct{}{}, framer.WriteSettings())
+			must(struct{}{}, framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: []byte{0xff, 0xff, 0xff, 0xff},
+				EndHeaders:    true,
+			}))
+		}),
+		require.Empty, require.Error,
+	},
+	// Good
+	{
+		"Real request from net/http",
+		captureH2CRequest("http://www.example.com:8080/my/page.htm"),
+		withExpected("www.example.com:8080"), require.NoError,
+	},
+	{
+		"Host header instead of :authority",
+		makeH2CRequestWithHeaders(1, ":method", "GET", ":path", "/", "host", "www.example.com"),
+		withExpected("www.example.com"), require.NoError,
+	},
+	{
+		"Control frames before HEADERS",
+		makeH2CRequest(func(framer *http2.Framer) {
+			must(struct{}{}, framer.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 0}))
+			must(struct{}{}, framer.WriteWindowUpdate(0, 1<<20))
+			must(struct{}{}, framer.WritePing(false, [8]byte{}))
+			must(struct{}{}, framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: encodeH2CHeaders(":method", "GET", ":authority", "www.example.com"),
+				EndHeaders:    true,
+			}))
+		}),
+		withExpected("www.example.com"), require.NoError,
+	},
+	{
+		"Padded HEADERS with priority",
+		makeH2CRequest(func(framer *http2.Framer) {
+			must(struct{}{}, framer.WriteSettings())
+			must(struct{}{}, framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: encodeH2CHeaders(":method", "GET", ":authority", "www.example.com:8080"),
+				EndHeaders:    true,
+				PadLength:     10,
+				Priority:      http2.PriorityParam{StreamDep: 0, Weight: 15},
+			}))
+		}),
+		withExpected("www.example.com:8080"), require.NoError,
+	},
+	{
+		"HEADERS followed by CONTINUATION",
+		makeH2CRequest(func(framer *http2.Framer) {
+			block := encodeH2CHeaders(":method", "POST", ":path", "/upload", ":authority", "www.example.com")
+			must(struct{}{}, framer.WriteSettings())
+			must(struct{}{}, framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block[:3]}))
+			must(struct{}{}, framer.WriteContinuation(1, false, block[3:7]))
+			must(struct{}{}, framer.WriteContinuation(1, true, block[7:]))
+			must(struct{}{}, framer.WriteData(1, true, []byte("DATA")))
+		}),
+		withExpected("www.example.com"), require.NoError,
+	},
+}
+
+func TestH2CSniffStrategy(t *testing.T) {
+	for _, test := range h2cTestTable {
+		t.Run(test.Description, func(t *testing.T) {
+			strategy := NewH2CSnifferStrategy()
+			hostName, err := strategy.SniffHostName(test.ReaderForRequest())
+			test.ErrorCheck(t, err)
+			test.HostnameCheck(t, hostName)
+		})
+	}
+}
+
+func TestIncrementalH2CSniffStrategy(t *testing.T) {
+	strategy := NewIncrementalH2CSnifferStrategy()
+	for _, test := range h2cTestTable {
+		t.Run(test.Description, func(t *testing.T) {
+			var metadata *Metadata
+			progress := SniffNeedMore
+			// Strategies must wait for more data at every point of the request
+			for i := 0; i <= len(test.Request) && progress == SniffNeedMore; i++ {
+				metadata, progress = strategy.SniffMetadataIncremental([]byte(test.Request[:i]), i == len(test.Request))
+			}
+			var err error
+			var hostName string
+			if progress == SniffFound {
+				hostName = metadata.Authority()
+			} else {
+				err = io.EOF
+			}
+			test.ErrorCheck(t, err)
+			test.HostnameCheck(t, hostName)
+		})
+	}
+}
+
+func TestH2CMetadata(t *testing.T) {
+	metadata, err := NewH2CSnifferStrategy().SniffMetadata(
+		bytes.NewReader([]byte(captureH2CRequest("http://www.example.com/my/page.htm?x=1"))))
+	require.NoError(t, err)
+	require.Equal(t, &Metadata{Protocol: ProtocolH2C, Strategy: "h2c", HostName: "www.example.com",
+		HTTPMethod: "GET", HTTPPath: "/my/page.htm"}, metadata)
+}
@@ -1,11 +1,16 @@
 package hostname
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net"
 	"strings"
+	"testing"
 
+	dissector "github.com/go-gost/tls-dissector"
 	"github.com/stretchr/testify/require"
 )
 
@@ -59,3 +64,19 @@ func must[T any](res T, err error) T {
 	}
 	return res
 }
+
+// captureClientHello returns the first TLS record sent by a crypto/tls client
+// with the given configuration.
+func captureClientHello(t *testing.T, config *tls.Config) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		defer client.Close()
+		_ = tls.Client(client, config).Handshake()
+	}()
+	record, err := dissector.ReadRecord(server)
+	require.NoError(t, err)
+	var recordBytes bytes.Buffer
+	must(record.WriteTo(&recordBytes))
+	return recordBytes.Bytes()
+}
@@ -2,24 +2,75 @@ package hostname
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+
+	"golang.org/x/net/http/httpguts"
 )
 
-func httpHostNameSniffer(r io.Reader) (string, error) {
+const StrategyNameHTTP = "http"
+
+func httpMetadataSniffer(r io.Reader) (*Metadata, error) {
 	req, err := http.ReadRequest(bufio.NewReader(r))
 	if err != nil {
-		return "", fmt.Errorf("unable to parse HTTP request: %w", err)
+		return nil, fmt.Errorf("unable to parse HTTP request: %w", err)
+	}
+	if req.Host == "" {
+		return nil, fmt.Errorf("HTTP Host header is missing")
+	}
+	metadata := &Metadata{
+		Protocol:   ProtocolHTTP,
+		Strategy:   StrategyNameHTTP,
+		HTTPMethod: req.Method,
+		HTTPPath:   req.URL.Path,
+	}
+	// For absolute-form requests, as sent to explicit proxies, this is the
+	// host from the request URI, which takes precedence over the Host header
+	if metadata.HostName, metadata.Port, err = parseAuthority(req.Host); err != nil {
+		return nil, fmt.Errorf("invalid HTTP Host: %w", err)
+	}
+	return metadata, nil
+}
+
+// httpMetadataSnifferIncremental only parses the request once its header is
+// complete, and gives up as soon as the data cannot start with a method.
+func httpMetadataSnifferIncremental(data []byte, atEOF bool) (*Metadata, SniffProgress) {
+	method, _, found := bytes.Cut(data, []byte(" "))
+	if found && len(method) == 0 {
+		return nil, SniffNotMine
+	}
+	for _, c := range method {
+		if !httpguts.IsTokenRune(rune(c)) {
+			return nil, SniffNotMine
+		}
 	}
-	if req.Host != "" {
-		return req.Host, nil
+	if !atEOF && !bytes.Contains(data, []byte("\n\r\n")) && !bytes.Contains(data, []byte("\n\n")) {
+		return nil, SniffNeedMore
+	}
+
+	metadata, err := httpMetadataSniffer(bytes.NewReader(data))
+	switch {
+	case err == nil:
+		return metadata, SniffFound
+	case !atEOF && (errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)):
+		return nil, SniffNeedMore
+	default:
+		return nil, SniffNotMine
 	}
-	return "", fmt.Errorf("HTTP Host header is missing")
 }
 
-var httpSingleton = NewSniffStrategyFromInterface(snifferStrategyFunction(httpHostNameSniffer))
+var httpSingleton = NewSniffStrategyFromMetadataInterface(metadataSnifferStrategyFunction(httpMetadataSniffer))
 
 func NewHTTPSnifferStrategy() *SniffStrategy {
 	return httpSingleton
 }
+
+var httpIncrementalSingleton = NewIncrementalSniffStrategyFromInterface(
+	incrementalSniffStrategyFunction(httpMetadataSnifferIncremental))
+
+func NewIncrementalHTTPSnifferStrategy() *IncrementalSniffStrategy {
+	return httpIncrementalSingleton
+}
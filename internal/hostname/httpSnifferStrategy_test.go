@@ -78,6 +78,26 @@ var httpTestTable = []*testData{
 		"POST / HTTP/1.1\r\nContent-Length: 8\r\n\r\nDATA",
 		require.Empty, require.Error,
 	},
+	{
+		"GET request, Host header with invalid port",
+		"GET / HTTP/1.1\r\nHost: www.example.com:http\r\n\r\n",
+		require.Empty, require.Error,
+	},
+	{
+		"GET request, Host header with port 0",
+		"GET / HTTP/1.1\r\nHost: www.example.com:0\r\n\r\n",
+		require.Empty, require.Error,
+	},
+	{
+		"GET request, Host header with IPv6 address without brackets",
+		"GET / HTTP/1.1\r\nHost: 2001:db8::1\r\n\r\n",
+		require.Empty, require.Error,
+	},
+	{
+		"GET request, Host header with invalid characters",
+		"GET / HTTP/1.1\r\nHost: www.exa*mple.com\r\n\r\n",
+		require.Empty, require.Error,
+	},
 	// Good
 	{
 		"GET request, Host header",
@@ -124,6 +144,31 @@ var httpTestTable = []*testData{
 		makeHTTPRequest("PUT", "http://www.foo.bar:8080/my/page.htm", "Sample payload"),
 		withExpected("www.foo.bar:8080"), require.NoError,
 	},
+	{
+		"GET request, Host header in uppercase with trailing dot",
+		"GET / HTTP/1.1\r\nHost: WWW.Example.COM.:8080\r\n\r\n",
+		withExpected("www.example.com:8080"), require.NoError,
+	},
+	{
+		"GET request, Host header with Unicode name",
+		"GET / HTTP/1.1\r\nHost: b\xc3\xbccher.example\r\n\r\n",
+		withExpected("xn--bcher-kva.example"), require.NoError,
+	},
+	{
+		"GET request, Host header with IPv6 address",
+		"GET / HTTP/1.1\r\nHost: [2001:DB8::1]:8080\r\n\r\n",
+		withExpected("[2001:db8::1]:8080"), require.NoError,
+	},
+	{
+		"GET request, absolute-form URI",
+		"GET http://www.example.com:8080/my/page.htm HTTP/1.1\r\nHost: www.example.com:8080\r\n\r\n",
+		withExpected("www.example.com:8080"), require.NoError,
+	},
+	{
+		"GET request, absolute-form URI overriding the Host header",
+		"GET http://www.example.com/ HTTP/1.1\r\nHost: other.example.com:8080\r\n\r\n",
+		withExpected("www.example.com"), require.NoError,
+	},
 }
 
 func TestHTTPSniffStrategy(t *testing.T) {
@@ -0,0 +1,86 @@
+package hostname
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// SniffProgress tells what an incremental strategy made of the data seen so
+// far.
+type SniffProgress int
+
+const (
+	// SniffNeedMore means that the data is compatible with the protocol
+	// handled by the strategy, but is not enough to find the hostname.
+	SniffNeedMore SniffProgress = iota
+	// SniffFound means that the hostname was found.
+	SniffFound
+	// SniffNotMine means that the data does not belong to the protocol handled
+	// by the strategy, or that it carries no hostname.
+	SniffNotMine
+)
+
+type IncrementalSniffStrategy struct {
+	incrementalSniffStrategyInterface
+}
+
+// IncrementalSniffStrategyInterface looks for a hostname, and other metadata,
+// in the data a client has sent so far. It is called again with all the data received, each time
+// more arrives, until it returns something other than SniffNeedMore. atEOF is
+// true when no more data will follow. Implementations must not retain data,
+// and must be safe for concurrent use.
+type IncrementalSniffStrategyInterface interface {
+	SniffMetadataIncremental(data []byte, atEOF bool) (*Metadata, SniffProgress)
+}
+
+type incrementalSniffStrategyInterface = IncrementalSniffStrategyInterface
+
+func NewIncrementalSniffStrategyFromInterface(strategyInterface IncrementalSniffStrategyInterface) *IncrementalSniffStrategy {
+	return &IncrementalSniffStrategy{strategyInterface}
+}
+
+type incrementalSniffStrategyFunction func(data []byte, atEOF bool) (*Metadata, SniffProgress)
+
+func (sniffer incrementalSniffStrategyFunction) SniffMetadataIncremental(data []byte, atEOF bool) (*Metadata, SniffProgress) {
+	return sniffer(data, atEOF)
+}
+
+var errNeedMoreData = errors.New("more data needed")
+
+// needMoreReader returns errNeedMoreData, rather than io.EOF, once the data is
+// exhausted, unless the real stream has ended too.
+type needMoreReader struct {
+	bytes.Reader
+	atEOF bool
+}
+
+func (r *needMoreReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF && !r.atEOF {
+		err = errNeedMoreData
+	}
+	return n, err
+}
+
+// NewIncrementalSniffStrategyFromReaderStrategy adapts a SniffStrategy so that
+// it can be used by sequential sniffers. The strategy is run from scratch on
+// all the data each time more arrives, and must wrap the errors returned by
+// its reader, so that running out of data can be told apart from a failure.
+func NewIncrementalSniffStrategyFromReaderStrategy(strategy *SniffStrategy) *IncrementalSniffStrategy {
+	return NewIncrementalSniffStrategyFromInterface(incrementalSniffStrategyFunction(
+		func(data []byte, atEOF bool) (*Metadata, SniffProgress) {
+			r := needMoreReader{atEOF: atEOF}
+			r.Reset(data)
+			metadata, err := strategy.SniffMetadata(&r)
+			switch {
+			case err == nil && metadata.HostName != "":
+				return metadata, SniffFound
+			case errors.Is(err, errNeedMoreData):
+				return nil, SniffNeedMore
+			default:
+				return nil, SniffNotMine
+			}
+		},
+	))
+}
@@ -0,0 +1,136 @@
+package hostname
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Metadata is what a strategy learned about a connection from the data sent
+// by its client.
+type Metadata struct {
+	Protocol Protocol
+	// Name of the strategy which produced the metadata. It is empty for
+	// strategies built with NewSniffStrategyFromInterface.
+	Strategy string
+	// With ECH, this is the public name of the client-facing server, not the
+	// name of the origin the client wants to reach
+	HostName string
+	// Port given by the client along with the hostname, 0 if there was none
+	Port uint16
+
+	// Protocols offered via ALPN, in the client's order of preference
+	ALPN []string
+	// Highest TLS version offered by the client
+	TLSVersion uint16
+	// Whether the ClientHello uses Encrypted Client Hello. If so, the real
+	// server name is encrypted, and PublicName is the name sent in clear.
+	// Clients may also send fake ECH extensions, which cannot be told apart.
+	ECH        bool
+	PublicName string
+
+	HTTPMethod string
+	HTTPPath   string
+
+	// Fingerprints of the TLS client implementation, see
+	// https://github.com/salesforce/ja3 and https://github.com/FoxIO-LLC/ja4
+	JA3 string
+	JA4 string
+}
+
+// Authority returns the hostname, followed by the port if there is one.
+func (metadata *Metadata) Authority() string {
+	if metadata.Port == 0 {
+		return metadata.HostName
+	}
+	return net.JoinHostPort(metadata.HostName, strconv.Itoa(int(metadata.Port)))
+}
+
+// Hostnames are looked up as typed, save for the mapping to punycode, so that
+// underscores and other characters found in real names are kept
+var hostNameProfile = idna.New(
+	idna.MapForLookup(),
+	idna.StrictDomainName(false),
+	idna.VerifyDNSLength(true),
+	idna.Transitional(false),
+)
+
+// normalizeHostName returns host in the form it is looked up with: lowercase,
+// with internationalized labels converted to punycode and without the
+// trailing dot. IP addresses are returned in their canonical form, without
+// brackets.
+func normalizeHostName(host string) (string, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Zone() != "" {
+			return "", fmt.Errorf("IPv6 address %q has a zone", host)
+		}
+		return addr.String(), nil
+	}
+	ascii, err := hostNameProfile.ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return "", fmt.Errorf("invalid hostname %q: %w", host, err)
+	}
+	for _, c := range []byte(ascii) {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "", fmt.Errorf("invalid hostname %q: invalid character %q", host, c)
+		}
+	}
+	return ascii, nil
+}
+
+// parseAuthority separates the port from a host[:port] string, as sent by
+// clients to name the server they want, and normalizes the host. IPv6
+// addresses must be enclosed in brackets, and ports must be numbers between 1
+// and 65535.
+func parseAuthority(authority string) (string, uint16, error) {
+	host, portString := authority, ""
+	if i := strings.LastIndexByte(authority, ':'); i >= 0 && !strings.HasSuffix(authority, "]") {
+		host, portString = authority[:i], authority[i+1:]
+	}
+	if strings.HasPrefix(host, "[") {
+		if !strings.HasSuffix(host, "]") {
+			return "", 0, fmt.Errorf("unterminated IPv6 address in %q", authority)
+		}
+		host = host[1 : len(host)-1]
+		if addr, err := netip.ParseAddr(host); err != nil || !addr.Is6() {
+			return "", 0, fmt.Errorf("invalid IPv6 address in %q", authority)
+		}
+	} else if strings.Contains(host, ":") {
+		return "", 0, fmt.Errorf("IPv6 address in %q is not enclosed in brackets", authority)
+	}
+
+	var port uint64
+	if portString != "" {
+		var err error
+		if port, err = strconv.ParseUint(portString, 10, 16); err != nil || port == 0 {
+			return "", 0, fmt.Errorf("invalid port in %q", authority)
+		}
+	}
+	host, err := normalizeHostName(host)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, uint16(port), nil
+}
+
+// splitAuthority separates the port from a host[:port] string. Strings which
+// cannot be split are returned unchanged as the host, with no port, save for
+// the brackets around IPv6 addresses.
+func splitAuthority(authority string) (string, uint16) {
+	host, portString, err := net.SplitHostPort(authority)
+	if err != nil {
+		if len(authority) > 2 && authority[0] == '[' && authority[len(authority)-1] == ']' {
+			return authority[1 : len(authority)-1], 0
+		}
+		return authority, 0
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil || port == 0 {
+		return authority, 0
+	}
+	return host, uint16(port)
+}
@@ -0,0 +1,263 @@
+package hostname
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	dissector "github.com/go-gost/tls-dissector"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPMetadata(t *testing.T) {
+	tests := []struct {
+		Description string
+		Request     string
+		Expected    Metadata
+	}{
+		{"Host without port", "GET /index.html?x=1 HTTP/1.1\r\nHost: www.example.com\r\n\r\n",
+			Metadata{Protocol: ProtocolHTTP, Strategy: "http", HostName: "www.example.com",
+				HTTPMethod: "GET", HTTPPath: "/index.html"}},
+		{"Host with port", "POST /submit HTTP/1.1\r\nHost: www.example.com:8080\r\n\r\n",
+			Metadata{Protocol: ProtocolHTTP, Strategy: "http", HostName: "www.example.com", Port: 8080,
+				HTTPMethod: "POST", HTTPPath: "/submit"}},
+		{"IPv6 host", "GET / HTTP/1.1\r\nHost: [2001:db8::1]\r\n\r\n",
+			Metadata{Protocol: ProtocolHTTP, Strategy: "http", HostName: "2001:db8::1",
+				HTTPMethod: "GET", HTTPPath: "/"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			metadata, err := NewHTTPSnifferStrategy().SniffMetadata(bytes.NewReader([]byte(test.Request)))
+			require.NoError(t, err)
+			require.Equal(t, &test.Expected, metadata)
+
+			incremental, progress := NewIncrementalHTTPSnifferStrategy().SniffMetadataIncremental([]byte(test.Request), false)
+			require.Equal(t, SniffFound, progress)
+			require.Equal(t, metadata, incremental)
+		})
+	}
+}
+
+func TestTLSMetadata(t *testing.T) {
+	hello := captureClientHello(t, &tls.Config{
+		ServerName: "www.example.com",
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+
+	metadata, err := NewTLSSnifferStrategy().SniffMetadata(bytes.NewReader(hello))
+	require.NoError(t, err)
+	require.Equal(t, ProtocolTLS, metadata.Protocol)
+	require.Equal(t, "tls", metadata.Strategy)
+	require.Equal(t, "www.example.com", metadata.HostName)
+	require.Zero(t, metadata.Port)
+	require.Equal(t, []string{"h2", "http/1.1"}, metadata.ALPN)
+	require.EqualValues(t, tls.VersionTLS13, metadata.TLSVersion)
+	require.Len(t, metadata.JA3, 32)
+	require.Regexp(t, `^t13d\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`, metadata.JA4)
+
+	incremental, progress := NewIncrementalTLSSnifferStrategy().SniffMetadataIncremental(hello, false)
+	require.Equal(t, SniffFound, progress)
+	require.Equal(t, metadata, incremental)
+}
+
+func TestJA3(t *testing.T) {
+	const grease = 0x1a1a
+	hello := dissector.ClientHelloHandshake{
+		Version:            tls.VersionTLS12,
+		CipherSuites:       []dissector.CipherSuite{grease, 0x1301, 0xc02f},
+		CompressionMethods: tlsTestCompressionMethods,
+		Extensions: []dissector.Extension{
+			dissector.NewExtension(grease, nil),
+			&dissector.ServerNameExtension{Name: "www.example.com"},
+			// x25519 and secp256r1, after a GREASE group
+			dissector.NewExtension(tlsExtensionSupportedGroups, []byte{0, 6, 0x1a, 0x1a, 0, 29, 0, 23}),
+			// Uncompressed points only
+			dissector.NewExtension(tlsExtensionECPointFormats, []byte{1, 0}),
+		},
+	}
+	expected := md5.Sum([]byte("771,4865-49199,0-10-11,29-23,0"))
+	require.Equal(t, hex.EncodeToString(expected[:]), ja3(&hello))
+}
+
+func TestJA4(t *testing.T) {
+	const grease = 0x2a2a
+	u16s := func(values ...uint16) []byte {
+		var data []byte
+		for _, value := range values {
+			data = append(data, byte(value>>8), byte(value))
+		}
+		return data
+	}
+	vector := func(lengthSize int, data []byte) []byte {
+		if lengthSize == 1 {
+			return append([]byte{byte(len(data))}, data...)
+		}
+		return append([]byte{byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+
+	// The example from the JA4 specification, with cipher suites and
+	// extensions shuffled
+	var suites []dissector.CipherSuite
+	for _, suite := range []uint16{grease, 0xcca9, 0x1301, 0x002f, 0x1302, 0xc02c, 0x0035, 0x009c, 0x1303,
+		0xc013, 0x009d, 0xc014, 0xc02b, 0xc02f, 0xc030, 0xcca8} {
+		suites = append(suites, dissector.CipherSuite(suite))
+	}
+	extensions := []dissector.Extension{dissector.NewExtension(grease, nil)}
+	for _, extType := range []uint16{0x0033, 0x0005, 0x000a, 0x4469, 0x000b, 0x0012, 0x0015, 0x0017,
+		0x001b, 0x0023, 0x002d, 0xff01} {
+		extensions = append(extensions, dissector.NewExtension(extType, nil))
+	}
+	extensions = append(extensions,
+		&dissector.ServerNameExtension{Name: "www.example.com"},
+		dissector.NewExtension(tlsExtensionALPN, vector(2, vector(1, []byte("h2")))),
+		dissector.NewExtension(tlsExtensionSupportedVersions, vector(1, u16s(grease, tls.VersionTLS13, tls.VersionTLS12))),
+		dissector.NewExtension(tlsExtensionSignatureAlgorithms,
+			vector(2, u16s(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601))),
+	)
+	hello := dissector.ClientHelloHandshake{
+		Version:            tls.VersionTLS12,
+		CipherSuites:       suites,
+		CompressionMethods: tlsTestCompressionMethods,
+		Extensions:         extensions,
+	}
+
+	metadata, err := metadataFromClientHello(&hello)
+	require.NoError(t, err)
+	require.Equal(t, "t13d1516h2_8daaf6152771_e5627efa2ab1", metadata.JA4)
+}
+
+func TestECHMetadata(t *testing.T) {
+	tests := []struct {
+		Description string
+		Extension   dissector.Extension
+		ECH         bool
+	}{
+		{"No ECH", nil, false},
+		// Type, HPKE KDF and AEAD, config ID, then an empty encapsulated key
+		// and payload
+		{"Outer ECH", dissector.NewExtension(tlsExtensionECH, []byte{0, 0, 1, 0, 1, 42, 0, 0, 0, 0}), true},
+		{"Inner ECH", dissector.NewExtension(tlsExtensionECH, []byte{1}), false},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			hello := dissector.ClientHelloHandshake{
+				Version:            tls.VersionTLS12,
+				CipherSuites:       []dissector.CipherSuite{0x1301},
+				CompressionMethods: tlsTestCompressionMethods,
+				Extensions:         []dissector.Extension{&dissector.ServerNameExtension{Name: "public.example.com"}},
+			}
+			if test.Extension != nil {
+				hello.Extensions = append(hello.Extensions, test.Extension)
+			}
+			metadata, err := metadataFromClientHello(&hello)
+			require.NoError(t, err)
+			require.Equal(t, "public.example.com", metadata.HostName)
+			require.Equal(t, test.ECH, metadata.ECH)
+			if test.ECH {
+				require.Equal(t, "public.example.com", metadata.PublicName)
+			} else {
+				require.Empty(t, metadata.PublicName)
+			}
+		})
+	}
+}
+
+func TestJA4ALPN(t *testing.T) {
+	require.Equal(t, "00", ja4ALPN(""))
+	require.Equal(t, "h1", ja4ALPN("http/1.1"))
+	require.Equal(t, "3a", ja4ALPN("\x30\x9a"))
+}
+
+func TestAdaptedStrategyMetadata(t *testing.T) {
+	strategy := NewSniffStrategyFromInterface(snifferStrategyFunction(func(io.Reader) (string, error) {
+		return "www.example.com:8443", nil
+	}))
+	metadata, err := strategy.SniffMetadata(nil)
+	require.NoError(t, err)
+	require.Equal(t, &Metadata{HostName: "www.example.com", Port: 8443}, metadata)
+	hostName, err := strategy.SniffHostName(nil)
+	require.NoError(t, err)
+	require.Equal(t, "www.example.com:8443", hostName)
+
+	strategy = NewSniffStrategyFromInterface(snifferStrategyFunction(func(io.Reader) (string, error) {
+		return "", nil
+	}))
+	_, err = strategy.SniffMetadata(nil)
+	require.Error(t, err)
+}
+
+func TestAuthority(t *testing.T) {
+	tests := []struct {
+		Authority string
+		HostName  string
+		Port      uint16
+		Rebuilt   string
+	}{
+		{"www.example.com", "www.example.com", 0, "www.example.com"},
+		{"www.example.com:80", "www.example.com", 80, "www.example.com:80"},
+		{"[2001:db8::1]:443", "2001:db8::1", 443, "[2001:db8::1]:443"},
+		{"[2001:db8::1]", "2001:db8::1", 0, "2001:db8::1"},
+		{"www.example.com:http", "www.example.com:http", 0, "www.example.com:http"},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%q", test.Authority), func(t *testing.T) {
+			metadata := Metadata{}
+			metadata.HostName, metadata.Port = splitAuthority(test.Authority)
+			require.Equal(t, test.HostName, metadata.HostName)
+			require.Equal(t, test.Port, metadata.Port)
+			require.Equal(t, test.Rebuilt, metadata.Authority())
+		})
+	}
+}
+
+func TestParseAuthority(t *testing.T) {
+	tests := []struct {
+		Authority string
+		HostName  string
+		Port      uint16
+		Valid     bool
+	}{
+		{"www.example.com", "www.example.com", 0, true},
+		{"www.example.com:443", "www.example.com", 443, true},
+		{"WWW.Example.COM.", "www.example.com", 0, true},
+		{"www.example.com.:8080", "www.example.com", 8080, true},
+		{"my_host.example.com", "my_host.example.com", 0, true},
+		{"Bücher.example", "xn--bcher-kva.example", 0, true},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", 0, true},
+		{"192.0.2.1:80", "192.0.2.1", 80, true},
+		{"[2001:DB8::1]", "2001:db8::1", 0, true},
+		{"[2001:db8::1]:443", "2001:db8::1", 443, true},
+		{"", "", 0, false},
+		{".", "", 0, false},
+		{":80", "", 0, false},
+		{"www.example.com:", "www.example.com", 0, true},
+		{"www.example.com:http", "", 0, false},
+		{"www.example.com:0", "", 0, false},
+		{"www.example.com:65536", "", 0, false},
+		{"2001:db8::1", "", 0, false},
+		{"[2001:db8::1", "", 0, false},
+		{"[192.0.2.1]", "", 0, false},
+		{"[fe80::1%eth0]", "", 0, false},
+		{"www..example.com", "", 0, false},
+		{"www.exa mple.com", "", 0, false},
+		{"www.example.com/path", "", 0, false},
+		{strings.Repeat("a", 64) + ".example.com", "", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%q", test.Authority), func(t *testing.T) {
+			hostName, port, err := parseAuthority(test.Authority)
+			if test.Valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+			require.Equal(t, test.HostName, hostName)
+			require.Equal(t, test.Port, port)
+		})
+	}
+}
@@ -1,7 +1,6 @@
 package hostname
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"net"
@@ -9,14 +8,16 @@ import (
 
 type nullSniffer struct{}
 
-func (sniffer *nullSniffer) SniffHostName(net.Conn) (string, error) {
-	return "", fmt.Errorf("null sniffer always fails")
+func (sniffer *nullSniffer) SniffMetadata(net.Conn) (*Metadata, error) {
+	return nil, fmt.Errorf("null sniffer always fails")
 }
 
 func (sniffer *nullSniffer) GetBufferedData() io.WriterTo {
-	return &bytes.Buffer{}
+	return noBufferedData{}
 }
 
+func (sniffer *nullSniffer) Release() {}
+
 var nullSingleton = NewSnifferFromInterface(&nullSniffer{})
 
 func NewNullSniffer() *Sniffer {
@@ -16,4 +16,8 @@ func TestNullSniffer(t *testing.T) {
 	require.NotNil(t, sniffer.GetBufferedData())
 	must(sniffer.GetBufferedData().WriteTo(&bufferedData))
 	require.Equal(t, 0, bufferedData.Len())
+	require.Zero(t, testing.AllocsPerRun(100, func() {
+		_, _ = sniffer.GetBufferedData().WriteTo(&bufferedData)
+	}))
+	sniffer.Release()
 }
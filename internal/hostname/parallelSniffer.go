@@ -16,20 +16,22 @@ type parallelSniffer struct {
 	sniffers     []*SniffStrategy
 	timeout      time.Duration
 	maxData      int64
-	bufferedData bytes.Buffer
+	bufferedData *bytes.Buffer
+	released     bool
 }
 
-func (sniffer *parallelSniffer) SniffHostName(c net.Conn) (rHostName string, rError error) {
-	if sniffer.bufferedData.Len() > 0 {
+func (sniffer *parallelSniffer) SniffMetadata(c net.Conn) (rMetadata *Metadata, rError error) {
+	if sniffer.bufferedData != nil || sniffer.released {
 		panic("parallelSniffer instances cannot be reused")
 	}
+	sniffer.bufferedData = getBuffer()
 
 	nSniffers := len(sniffer.sniffers)
 
 	var reader io.Reader = c
 	// Ensure bytes used for detection are buffered so that they can then be sent
 	// to the destination
-	reader = io.TeeReader(reader, &sniffer.bufferedData)
+	reader = io.TeeReader(reader, sniffer.bufferedData)
 
 	// Each strategy gets its own reader so that they can run in parallel
 	readersForStrategies := make([]io.Reader, nSniffers)
@@ -46,12 +48,15 @@ func (sniffer *parallelSniffer) SniffHostName(c net.Conn) (rHostName string, rEr
 			}
 		}
 	}()
-	hostNamesFound := make(chan string, nSniffers)
+	metadataFound := make(chan *Metadata, nSniffers)
 	for i, strategy := range sniffer.sniffers {
 		readersForStrategies[i], writersForStrategies[i] = io.Pipe()
 		go func() {
-			name, _ := strategy.SniffHostName(readersForStrategies[i])
-			hostNamesFound <- name
+			metadata, err := strategy.SniffMetadata(readersForStrategies[i])
+			if err != nil || metadata.HostName == "" {
+				metadata = nil
+			}
+			metadataFound <- metadata
 			// Keep dumping data, otherwise the MultiWriter will stall
 			_, _ = io.Copy(io.Discard, readersForStrategies[i])
 		}()
@@ -63,12 +68,12 @@ func (sniffer *parallelSniffer) SniffHostName(c net.Conn) (rHostName string, rEr
 	defer func() {
 		err := <-readSync
 		if errors.As(err, new(*FatalError)) {
-			rHostName = ""
+			rMetadata = nil
 			rError = err
 		}
 		err = c.SetReadDeadline(time.Time{})
 		if err != nil {
-			rHostName = ""
+			rMetadata = nil
 			rError = WrapFatal(fmt.Errorf("failed to disable read deadline on TCP conn: %w", err))
 		}
 	}()
@@ -95,28 +100,34 @@ func (sniffer *parallelSniffer) SniffHostName(c net.Conn) (rHostName string, rEr
 
 	for {
 		select {
-		case hn := <-hostNamesFound:
-			if hn != "" {
+		case metadata := <-metadataFound:
+			if metadata != nil {
 				// If this fails, the code will simply stall until the reading goroutine
 				// ends on its own
 				_ = c.SetReadDeadline(time.Now())
-				return hn, nil
+				return metadata, nil
 			}
 			nSniffers--
 			if nSniffers <= 0 {
 				// Same as above
 				_ = c.SetReadDeadline(time.Now())
-				return "", fmt.Errorf("all hostname sniffers failed")
+				return nil, fmt.Errorf("all hostname sniffers failed")
 			}
 		case err := <-readSync:
-			return "", err
+			return nil, err
 		}
 	}
 
 }
 
 func (sniffer *parallelSniffer) GetBufferedData() io.WriterTo {
-	return &sniffer.bufferedData
+	return bufferedDataOrNothing(sniffer.bufferedData)
+}
+
+func (sniffer *parallelSniffer) Release() {
+	putBuffer(sniffer.bufferedData)
+	sniffer.bufferedData = nil
+	sniffer.released = true
 }
 
 type ParallelSnifferOption func(sniffer *parallelSniffer)
@@ -187,6 +187,27 @@ func TestParallelSnifferWithTLSStrategyOnly(t *testing.T) {
 	tableTestHelper(t, factory, tlsTestTable)
 }
 
+func TestParallelSnifferWithH2CStrategyOnly(t *testing.T) {
+	factory := func() *Sniffer {
+		return NewParallelSniffer(WithParallelSnifferStrategy(NewH2CSnifferStrategy()))
+	}
+	tableTestHelper(t, factory, h2cTestTable)
+}
+
+func TestParallelSnifferWithXMPPStrategyOnly(t *testing.T) {
+	factory := func() *Sniffer {
+		return NewParallelSniffer(WithParallelSnifferStrategy(NewXMPPSnifferStrategy()))
+	}
+	tableTestHelper(t, factory, xmppTestTable)
+}
+
+func TestParallelSnifferWithPostgresStrategyOnly(t *testing.T) {
+	factory := func() *Sniffer {
+		return NewParallelSniffer(WithParallelSnifferStrategy(NewPostgresSnifferStrategy()))
+	}
+	tableTestHelper(t, factory, postgresTestTable)
+}
+
 func TestParallelSnifferWithTLSAndHTTPStrategies(t *testing.T) {
 	factory := func() *Sniffer {
 		return NewParallelSniffer(
@@ -0,0 +1,63 @@
+package hostname
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const StrategyNamePostgres = "postgres"
+
+// PostgresSSLRequest is the message, a length and a request code, which
+// PostgreSQL clients send to ask the server to switch to TLS.
+const PostgresSSLRequest = "\x00\x00\x00\x08\x04\xd2\x16\x2f"
+
+// sniffMetadataFromPostgres reads the SNI from the ClientHello following an
+// SSLRequest. Clients only send it after the server agrees to use TLS, so
+// this only works if something answers the SSLRequest before the data is
+// sniffed, or on captures of whole sessions.
+func sniffMetadataFromPostgres(r io.Reader) (*Metadata, error) {
+	request := make([]byte, len(PostgresSSLRequest))
+	if _, err := io.ReadFull(r, request); err != nil {
+		return nil, fmt.Errorf("unable to read PostgreSQL SSLRequest: %w", err)
+	}
+	if string(request) != PostgresSSLRequest {
+		return nil, fmt.Errorf("not a PostgreSQL SSLRequest")
+	}
+	metadata, err := sniffMetadataFromTLS(r)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Protocol, metadata.Strategy = ProtocolPostgres, StrategyNamePostgres
+	return metadata, nil
+}
+
+func sniffMetadataFromPostgresIncremental(data []byte, atEOF bool) (*Metadata, SniffProgress) {
+	if len(data) < len(PostgresSSLRequest) {
+		if !atEOF && bytes.HasPrefix([]byte(PostgresSSLRequest), data) {
+			return nil, SniffNeedMore
+		}
+		return nil, SniffNotMine
+	}
+	if string(data[:len(PostgresSSLRequest)]) != PostgresSSLRequest {
+		return nil, SniffNotMine
+	}
+	metadata, progress := sniffMetadataFromTLSIncremental(data[len(PostgresSSLRequest):], atEOF)
+	if progress == SniffFound {
+		metadata.Protocol, metadata.Strategy = ProtocolPostgres, StrategyNamePostgres
+	}
+	return metadata, progress
+}
+
+var postgresSingleton = NewSniffStrategyFromMetadataInterface(metadataSnifferStrategyFunction(sniffMetadataFromPostgres))
+
+func NewPostgresSnifferStrategy() *SniffStrategy {
+	return postgresSingleton
+}
+
+var postgresIncrementalSingleton = NewIncrementalSniffStrategyFromInterface(
+	incrementalSniffStrategyFunction(sniffMetadataFromPostgresIncremental))
+
+func NewIncrementalPostgresSnifferStrategy() *IncrementalSniffStrategy {
+	return postgresIncrementalSingleton
+}
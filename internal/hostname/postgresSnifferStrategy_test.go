@@ -0,0 +1,98 @@
+package hostname
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"testing"
+
+	dissector "github.com/go-gost/tls-dissector"
+	"github.com/stretchr/testify/require"
+)
+
+var postgresTestClientHello = &dissector.ClientHelloHandshake{
+	Version:            tls.VersionTLS12,
+	CipherSuites:       tlsTestCipherSuites,
+	CompressionMethods: tlsTestCompressionMethods,
+	Extensions: []dissector.Extension{&dissector.ServerNameExtension{
+		NameType: tlsSNINameTypeHostName,
+		Name:     "db.example.com"}},
+}
+
+var postgresTestTable = []*testDataHexRequest{
+	// Bad
+	{&testData{
+		"Empty request",
+		"",
+		require.Empty, require.Error,
+	}},
+	{&testData{
+		"SSLRequest only",
+		hex.EncodeToString([]byte(PostgresSSLRequest)),
+		require.Empty, require.Error,
+	}},
+	{&testData{
+		"ClientHello without SSLRequest",
+		makeHexStringFromClientHello(postgresTestClientHello, 1),
+		require.Empty, require.Error,
+	}},
+	{&testData{
+		"GSSENCRequest and ClientHello",
+		"0000000804d21630" + makeHexStringFromClientHello(postgresTestClientHello, 1),
+		require.Empty, require.Error,
+	}},
+	{&testData{
+		"StartupMessage",
+		"0000001d00030000" + hex.EncodeToString([]byte("user\x00postgres\x00database\x00db\x00\x00")),
+		require.Empty, require.Error,
+	}},
+	{&testData{
+		"SSLRequest and ClientHello without SNI",
+		hex.EncodeToString([]byte(PostgresSSLRequest)) + makeHexStringFromClientHello(
+			&dissector.ClientHelloHandshake{
+				Version:            tls.VersionTLS12,
+				CipherSuites:       tlsTestCipherSuites,
+				CompressionMethods: tlsTestCompressionMethods,
+			},
+			1,
+		),
+		require.Empty, require.Error,
+	}},
+	// Good
+	{&testData{
+		"SSLRequest and ClientHello, 1 record",
+		hex.EncodeToString([]byte(PostgresSSLRequest)) + makeHexStringFromClientHello(postgresTestClientHello, 1),
+		withExpected("db.example.com"), require.NoError,
+	}},
+	{&testData{
+		"SSLRequest and ClientHello, 4 records",
+		hex.EncodeToString([]byte(PostgresSSLRequest)) + makeHexStringFromClientHello(postgresTestClientHello, 4),
+		withExpected("db.example.com"), require.NoError,
+	}},
+}
+
+func TestPostgresSniffStrategy(t *testing.T) {
+	for _, test := range postgresTestTable {
+		t.Run(test.Description, func(t *testing.T) {
+			strategy := NewPostgresSnifferStrategy()
+			hostName, err := strategy.SniffHostName(test.ReaderForRequest())
+			test.ErrorCheck(t, err)
+			test.HostnameCheck(t, hostName)
+		})
+	}
+}
+
+func TestPostgresMetadata(t *testing.T) {
+	hello := captureClientHello(t, &tls.Config{ServerName: "db.example.com", NextProtos: []string{"postgresql"}})
+	data := append([]byte(PostgresSSLRequest), hello...)
+
+	metadata, progress := NewIncrementalPostgresSnifferStrategy().SniffMetadataIncremental(data, false)
+	require.Equal(t, SniffFound, progress)
+	require.Equal(t, ProtocolPostgres, metadata.Protocol)
+	require.Equal(t, "postgres", metadata.Strategy)
+	require.Equal(t, "db.example.com", metadata.HostName)
+	require.Equal(t, []string{"postgresql"}, metadata.ALPN)
+	require.NotEmpty(t, metadata.JA4)
+
+	_, progress = NewIncrementalPostgresSnifferStrategy().SniffMetadataIncremental(data[:len(PostgresSSLRequest)], false)
+	require.Equal(t, SniffNeedMore, progress)
+}
@@ -0,0 +1,62 @@
+package hostname
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+)
+
+// Protocol is the application protocol spoken by a client, as far as its first
+// bytes tell.
+type Protocol int
+
+const (
+	ProtocolUnknown Protocol = iota
+	ProtocolHTTP
+	ProtocolTLS
+	// HTTP/2 with prior knowledge, without TLS
+	ProtocolH2C
+	ProtocolXMPP
+	// PostgreSQL, switching to TLS
+	ProtocolPostgres
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolHTTP:
+		return "http"
+	case ProtocolTLS:
+		return "tls"
+	case ProtocolH2C:
+		return "h2c"
+	case ProtocolXMPP:
+		return "xmpp"
+	case ProtocolPostgres:
+		return "postgres"
+	default:
+		return "unknown"
+	}
+}
+
+// DetectProtocol looks at data sent by a client, usually the data buffered
+// while sniffing, and tells which protocol it speaks. HTTP is only recognized
+// once the whole request header is available, while TLS only needs the header
+// of the first record, which must carry a ClientHello, and HTTP/2 the
+// connection preface.
+func DetectProtocol(data []byte) Protocol {
+	const (
+		recordTypeHandshake      = 0x16
+		handshakeTypeClientHello = 0x01
+	)
+	if len(data) >= 6 && data[0] == recordTypeHandshake && data[1] == 0x03 && data[5] == handshakeTypeClientHello {
+		return ProtocolTLS
+	}
+	// Also a valid HTTP/1.x request line
+	if bytes.HasPrefix(data, []byte(h2cPreface)) {
+		return ProtocolH2C
+	}
+	if _, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data))); err == nil {
+		return ProtocolHTTP
+	}
+	return ProtocolUnknown
+}
@@ -0,0 +1,29 @@
+package hostname
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		Description string
+		Data        string
+		Expected    Protocol
+	}{
+		{"Empty", "", ProtocolUnknown},
+		{"HTTP request", makeHTTPRequest("GET", "http://www.example.com/", ""), ProtocolHTTP},
+		{"HTTP request without Host", "GET / HTTP/1.0\r\n\r\n", ProtocolHTTP},
+		{"Incomplete HTTP request", "GET / HTTP/1.1\r\nHost: www.example.com\r\n", ProtocolUnknown},
+		{"TLS ClientHello", "\x16\x03\x01\x02\x00\x01\x00\x01\xfc", ProtocolTLS},
+		{"TLS record without a ClientHello", "\x16\x03\x03\x00\x04\x02\x00\x00\x00", ProtocolUnknown},
+		{"Truncated TLS record", "\x16\x03\x01", ProtocolUnknown},
+		{"HTTP/2 connection preface", h2cPreface + "\x00\x00\x00\x04\x00\x00\x00\x00\x00", ProtocolH2C},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			require.Equal(t, test.Expected, DetectProtocol([]byte(test.Data)))
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package hostname
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Upper bound for a single read from the connection
+const sequentialSnifferReadSize = 4096
+
+// sequentialSniffer runs all strategies in the goroutine calling SniffMetadata.
+// After each read from the connection, the strategies which are still
+// undecided are handed all the data received so far.
+type sequentialSniffer struct {
+	strategies   []*IncrementalSniffStrategy
+	timeout      time.Duration
+	maxData      int64
+	bufferedData *bytes.Buffer
+	released     bool
+}
+
+func (sniffer *sequentialSniffer) SniffMetadata(c net.Conn) (rMetadata *Metadata, rError error) {
+	if sniffer.bufferedData != nil || sniffer.released {
+		panic("sequentialSniffer instances cannot be reused")
+	}
+	sniffer.bufferedData = getBuffer()
+
+	if err := c.SetReadDeadline(time.Now().Add(sniffer.timeout)); err != nil {
+		return nil, WrapFatal(fmt.Errorf("failed to set read deadline on TCP conn: %w", err))
+	}
+	defer func() {
+		err := c.SetReadDeadline(time.Time{})
+		if err != nil {
+			rMetadata = nil
+			rError = WrapFatal(fmt.Errorf("failed to disable read deadline on TCP conn: %w", err))
+		}
+	}()
+
+	for {
+		readSize := min(sniffer.maxData-int64(sniffer.bufferedData.Len()), sequentialSnifferReadSize)
+		sniffer.bufferedData.Grow(int(readSize))
+		free := sniffer.bufferedData.AvailableBuffer()[:readSize]
+		n, readErr := c.Read(free)
+		sniffer.bufferedData.Write(free[:n])
+		// Once the deadline or the data limit are reached, strategies get a
+		// last chance to decide with what they have
+		atEOF := readErr != nil || int64(sniffer.bufferedData.Len()) >= sniffer.maxData
+
+		if n > 0 || atEOF {
+			if metadata, done := sniffer.runStrategies(atEOF); metadata != nil {
+				return metadata, nil
+			} else if done {
+				return nil, fmt.Errorf("all hostname sniffers failed")
+			}
+		}
+
+		// As for parallelSniffer, errors other than timeouts and the client
+		// closing the connection are fatal, as they may have caused a loss of
+		// data.
+		if netErr := new(*net.OpError); readErr == io.EOF || errors.As(readErr, netErr) && (*netErr).Timeout() {
+			return nil, errTimeoutOrDataLimitExceeded
+		} else if readErr != nil {
+			return nil, WrapFatal(readErr)
+		} else if atEOF {
+			return nil, errTimeoutOrDataLimitExceeded
+		}
+	}
+}
+
+// runStrategies feeds the buffered data to undecided strategies, and drops
+// those which do not recognize it. It returns the metadata found, if any, and
+// whether all strategies have made a decision.
+func (sniffer *sequentialSniffer) runStrategies(atEOF bool) (*Metadata, bool) {
+	data := sniffer.bufferedData.Bytes()
+	undecided := sniffer.strategies[:0]
+	for _, strategy := range sniffer.strategies {
+		metadata, progress := strategy.SniffMetadataIncremental(data, atEOF)
+		switch progress {
+		case SniffFound:
+			return metadata, true
+		case SniffNeedMore:
+			undecided = append(undecided, strategy)
+		}
+	}
+	sniffer.strategies = undecided
+	return nil, len(undecided) == 0
+}
+
+func (sniffer *sequentialSniffer) GetBufferedData() io.WriterTo {
+	return bufferedDataOrNothing(sniffer.bufferedData)
+}
+
+func (sniffer *sequentialSniffer) Release() {
+	putBuffer(sniffer.bufferedData)
+	sniffer.bufferedData = nil
+	sniffer.released = true
+}
+
+type SequentialSnifferOption func(sniffer *sequentialSniffer)
+
+func WithSequentialSnifferStrategy(strategy *IncrementalSniffStrategy) SequentialSnifferOption {
+	if strategy == nil {
+		panic("cannot add nil IncrementalSniffStrategy to sequentialSniffer")
+	}
+	return func(sniffer *sequentialSniffer) {
+		sniffer.strategies = append(sniffer.strategies, strategy)
+	}
+}
+
+func WithSequentialMaxData(max int64) SequentialSnifferOption {
+	return func(sniffer *sequentialSniffer) {
+		if max > 0 {
+			sniffer.maxData = max
+		}
+	}
+}
+
+func WithSequentialTimeout(timeout time.Duration) SequentialSnifferOption {
+	return func(sniffer *sequentialSniffer) {
+		if timeout > 0 {
+			sniffer.timeout = timeout
+		}
+	}
+}
+
+// NewSequentialSniffer returns a Sniffer which needs no goroutines of its own,
+// unlike the one returned by NewParallelSniffer. Strategies are tried in the
+// order they are given.
+func NewSequentialSniffer(opts ...SequentialSnifferOption) *Sniffer {
+	sniffer := sequentialSniffer{
+		maxData: SniffDefaultMaxData,
+		timeout: SniffDefaultTimeout,
+	}
+	for _, opts := range opts {
+		opts(&sniffer)
+	}
+	if len(sniffer.strategies) <= 0 {
+		panic("sequentialSniffer not configured with any IncrementalSniffStrategy")
+	}
+
+	return NewSnifferFromInterface(&sniffer)
+}
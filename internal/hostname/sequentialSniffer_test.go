@@ -0,0 +1,226 @@
+package hostname
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newIncrementalStub(hostName string, progress SniffProgress) *IncrementalSniffStrategy {
+	return NewIncrementalSniffStrategyFromInterface(incrementalSniffStrategyFunction(
+		func([]byte, bool) (*Metadata, SniffProgress) {
+			if progress != SniffFound {
+				return nil, progress
+			}
+			return &Metadata{HostName: hostName}, progress
+		},
+	))
+}
+
+func TestSequentialSnifferWithAFailingStub(t *testing.T) {
+	sniffer := NewSequentialSniffer(WithSequentialSnifferStrategy(newIncrementalStub("", SniffNotMine)))
+	var hostname string
+	var err error
+	streamRequestViaConn(bytes.NewReader([]byte("data")), func(c net.Conn) {
+		hostname, err = sniffer.SniffHostName(c)
+	})
+	require.Empty(t, hostname)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errTimeoutOrDataLimitExceeded)
+}
+
+func TestSequentialSnifferWithASuccessfulAndAFailingStub(t *testing.T) {
+	expectedHost := "www.example.com"
+	sniffer := NewSequentialSniffer(
+		WithSequentialSnifferStrategy(newIncrementalStub("", SniffNotMine)),
+		WithSequentialSnifferStrategy(newIncrementalStub(expectedHost, SniffFound)),
+	)
+	var hostname string
+	var err error
+	streamRequestViaConn(bytes.NewReader([]byte("data")), func(c net.Conn) {
+		hostname, err = sniffer.SniffHostName(c)
+	})
+	require.Equal(t, expectedHost, hostname)
+	require.NoError(t, err)
+}
+
+func TestSequentialSnifferWithDeadlineExceeded(t *testing.T) {
+	sniffer := NewSequentialSniffer(WithSequentialSnifferStrategy(newIncrementalStub("", SniffNeedMore)))
+	var hostname string
+	var err error
+	streamRequestViaConn(bytes.NewReader([]byte("data")), func(c net.Conn) {
+		hostname, err = sniffer.SniffHostName(c)
+	})
+	require.Empty(t, hostname)
+	require.ErrorIs(t, errTimeoutOrDataLimitExceeded, err)
+}
+
+func TestSequentialSnifferWithMaxDataExceeded(t *testing.T) {
+	const testMaxData = 16
+	const testMaxTime = time.Minute
+	testBytes := make([]byte, 2*testMaxData)
+	sniffer := NewSequentialSniffer(
+		WithSequentialSnifferStrategy(newIncrementalStub("", SniffNeedMore)),
+		WithSequentialTimeout(testMaxTime),
+		WithSequentialMaxData(testMaxData),
+	)
+	var hostname string
+	var err error
+
+	before := time.Now()
+	restOfRequest := streamRequestViaConn(bytes.NewReader(testBytes), func(c net.Conn) {
+		hostname, err = sniffer.SniffHostName(c)
+	})
+	after := time.Now()
+	require.Less(t, after.Sub(before), testMaxTime)
+	require.Empty(t, hostname)
+	require.ErrorIs(t, errTimeoutOrDataLimitExceeded, err)
+	checkRebuiltRequest(t, bytes.NewReader(testBytes), sniffer, restOfRequest)
+}
+
+func TestSequentialSnifferWithHTTPStrategyOnly(t *testing.T) {
+	factory := func() *Sniffer {
+		return NewSequentialSniffer(WithSequentialSnifferStrategy(NewIncrementalHTTPSnifferStrategy()))
+	}
+	tableTestHelper(t, factory, httpTestTable)
+}
+
+func TestSequentialSnifferWithTLSStrategyOnly(t *testing.T) {
+	factory := func() *Sniffer {
+		return NewSequentialSniffer(WithSequentialSnifferStrategy(NewIncrementalTLSSnifferStrategy()))
+	}
+	tableTestHelper(t, factory, tlsTestTable)
+}
+
+func TestSequentialSnifferWithH2CStrategyOnly(t *testing.T) {
+	factory := func() *Sniffer {
+		return NewSequentialSniffer(WithSequentialSnifferStrategy(NewIncrementalH2CSnifferStrategy()))
+	}
+	tableTestHelper(t, factory, h2cTestTable)
+}
+
+func TestSequentialSnifferWithXMPPStrategyOnly(t *testing.T) {
+	factory := func() *Sniffer {
+		return NewSequentialSniffer(WithSequentialSnifferStrategy(NewIncrementalXMPPSnifferStrategy()))
+	}
+	tableTestHelper(t, factory, xmppTestTable)
+}
+
+func TestSequentialSnifferWithPostgresStrategyOnly(t *testing.T) {
+	factory := func() *Sniffer {
+		return NewSequentialSniffer(WithSequentialSnifferStrategy(NewIncrementalPostgresSnifferStrategy()))
+	}
+	tableTestHelper(t, factory, postgresTestTable)
+}
+
+func TestSequentialSnifferWithTLSAndHTTPStrategies(t *testing.T) {
+	factory := func() *Sniffer {
+		return NewSequentialSniffer(
+			WithSequentialSnifferStrategy(NewIncrementalTLSSnifferStrategy()),
+			WithSequentialSnifferStrategy(NewIncrementalHTTPSnifferStrategy()),
+		)
+	}
+	tableTestHelper(t, factory, httpTestTable)
+	tableTestHelper(t, factory, tlsTestTable)
+}
+
+func TestSequentialSnifferWithAdaptedStrategies(t *testing.T) {
+	factory := func() *Sniffer {
+		return NewSequentialSniffer(
+			WithSequentialSnifferStrategy(NewIncrementalSniffStrategyFromReaderStrategy(NewTLSSnifferStrategy())),
+			WithSequentialSnifferStrategy(NewIncrementalSniffStrategyFromReaderStrategy(NewHTTPSnifferStrategy())),
+			// Like with parallelSniffer, the TLS strategy waits for HTTP data
+			// to fill a huge record, so failures take the whole timeout
+			WithSequentialTimeout(100*time.Millisecond),
+		)
+	}
+	tableTestHelper(t, factory, httpTestTable)
+	tableTestHelper(t, factory, tlsTestTable)
+}
+
+// Requests trickling in one byte at a time must be handled like requests
+// arriving in one go
+type oneByteAtATime struct {
+	testDataInterface
+}
+
+func (td oneByteAtATime) ReaderForRequest() io.Reader {
+	return iotest.OneByteReader(td.testDataInterface.ReaderForRequest())
+}
+
+func TestSequentialSnifferWithShortReads(t *testing.T) {
+	var table []oneByteAtATime
+	for _, td := range httpTestTable {
+		table = append(table, oneByteAtATime{td})
+	}
+	for _, td := range tlsTestTable {
+		table = append(table, oneByteAtATime{td})
+	}
+	factory := func() *Sniffer {
+		return NewSequentialSniffer(
+			WithSequentialSnifferStrategy(NewIncrementalTLSSnifferStrategy()),
+			WithSequentialSnifferStrategy(NewIncrementalHTTPSnifferStrategy()),
+		)
+	}
+	tableTestHelper(t, factory, table)
+}
+
+func BenchmarkSniffers(b *testing.B) {
+	const benchmarkTimeout = 100 * time.Millisecond
+	engines := []struct {
+		Name    string
+		Factory func() *Sniffer
+	}{
+		{"Parallel", func() *Sniffer {
+			return NewParallelSniffer(
+				WithParallelSnifferStrategy(NewTLSSnifferStrategy()),
+				WithParallelSnifferStrategy(NewHTTPSnifferStrategy()),
+				WithParallelTimeout(benchmarkTimeout),
+			)
+		}},
+		{"Sequential", func() *Sniffer {
+			return NewSequentialSniffer(
+				WithSequentialSnifferStrategy(NewIncrementalTLSSnifferStrategy()),
+				WithSequentialSnifferStrategy(NewIncrementalHTTPSnifferStrategy()),
+				WithSequentialTimeout(benchmarkTimeout),
+			)
+		}},
+	}
+	var scenarios []testDataInterface
+	for _, td := range httpTestTable {
+		scenarios = append(scenarios, td)
+	}
+	for _, td := range tlsTestTable {
+		scenarios = append(scenarios, td)
+	}
+
+	sniff := func(factory func() *Sniffer, scenario testDataInterface) error {
+		var err error
+		streamRequestViaConn(scenario.ReaderForRequest(), func(c net.Conn) {
+			_, err = factory().SniffHostName(c)
+		})
+		return err
+	}
+
+	for _, scenario := range scenarios {
+		for _, engine := range engines {
+			b.Run(fmt.Sprintf("%s/%s", engine.Name, scenario.GetDescription()), func(b *testing.B) {
+				// Failures only measure the timeout
+				if sniff(engine.Factory, scenario) != nil {
+					b.Skip("no hostname in request")
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for range b.N {
+					_ = sniff(engine.Factory, scenario)
+				}
+			})
+		}
+	}
+}
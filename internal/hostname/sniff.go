@@ -1,6 +1,7 @@
 package hostname
 
 import (
+	"fmt"
 	"io"
 	"net"
 	"strings"
@@ -37,8 +38,12 @@ type Sniffer struct {
 }
 
 type SnifferInterface interface {
-	SniffHostName(c net.Conn) (string, error)
+	SniffMetadata(c net.Conn) (*Metadata, error)
 	GetBufferedData() io.WriterTo
+	// Release gives back the resources used by the sniffer. The data
+	// returned by GetBufferedData must have been consumed before, and
+	// becomes unavailable after. Calling Release more than once is allowed.
+	Release()
 }
 
 type snifferInterface = SnifferInterface
@@ -47,22 +52,79 @@ func NewSnifferFromInterface(snifferInterface SnifferInterface) *Sniffer {
 	return &Sniffer{snifferInterface}
 }
 
+// SniffHostName is like SniffMetadata, for callers which only need the
+// hostname, with the port if the client sent one.
+func (sniffer *Sniffer) SniffHostName(c net.Conn) (string, error) {
+	metadata, err := sniffer.SniffMetadata(c)
+	if err != nil {
+		return "", err
+	}
+	return metadata.Authority(), nil
+}
+
 type SniffStrategy struct {
-	sniffStrategyInterface
+	metadataSniffStrategyInterface
 }
 
+// MetadataSniffStrategyInterface is implemented by strategies which can tell
+// more than the hostname. Strategies must return an error if they cannot find
+// a hostname.
+type MetadataSniffStrategyInterface interface {
+	SniffMetadata(r io.Reader) (*Metadata, error)
+}
+
+type metadataSniffStrategyInterface = MetadataSniffStrategyInterface
+
+// SniffStrategyInterface is implemented by strategies which only return the
+// hostname.
 type SniffStrategyInterface interface {
 	SniffHostName(r io.Reader) (string, error)
 }
 
-type sniffStrategyInterface = SniffStrategyInterface
-
 func NewSniffStrategyFromInterface(strategyInterface SniffStrategyInterface) *SniffStrategy {
+	return &SniffStrategy{hostNameOnlyStrategy{strategyInterface}}
+}
+
+func NewSniffStrategyFromMetadataInterface(strategyInterface MetadataSniffStrategyInterface) *SniffStrategy {
 	return &SniffStrategy{strategyInterface}
 }
 
+// SniffHostName is like SniffMetadata, for callers which only need the
+// hostname, with the port if the client sent one.
+func (strategy *SniffStrategy) SniffHostName(r io.Reader) (string, error) {
+	metadata, err := strategy.SniffMetadata(r)
+	if err != nil {
+		return "", err
+	}
+	return metadata.Authority(), nil
+}
+
+// hostNameOnlyStrategy adapts strategies which only return the hostname
+type hostNameOnlyStrategy struct {
+	strategy SniffStrategyInterface
+}
+
+func (adapter hostNameOnlyStrategy) SniffMetadata(r io.Reader) (*Metadata, error) {
+	name, err := adapter.strategy.SniffHostName(r)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no hostname found")
+	}
+	metadata := &Metadata{}
+	metadata.HostName, metadata.Port = splitAuthority(name)
+	return metadata, nil
+}
+
 type snifferStrategyFunction func(r io.Reader) (string, error)
 
 func (sniffer snifferStrategyFunction) SniffHostName(r io.Reader) (string, error) {
 	return sniffer(r)
 }
+
+type metadataSnifferStrategyFunction func(r io.Reader) (*Metadata, error)
+
+func (sniffer metadataSnifferStrategyFunction) SniffMetadata(r io.Reader) (*Metadata, error) {
+	return sniffer(r)
+}
@@ -2,40 +2,209 @@ package hostname
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 
 	dissector "github.com/go-gost/tls-dissector"
 )
 
-func sniffHostNameFromTLSSNI(r io.Reader) (string, error) {
+const StrategyNameTLS = "tls"
+
+const tlsHandshakeTypeClientHello = 1
+const tlsHandshakeHeaderLen = 4
+
+const (
+	tlsExtensionSupportedGroups   = 0x000a
+	tlsExtensionECPointFormats    = 0x000b
+	tlsExtensionALPN              = 0x0010
+	tlsExtensionSupportedVersions = 0x002b
+	tlsExtensionECH               = 0xfe0d
+)
+
+// ECHClientHello types, from draft-ietf-tls-esni
+const tlsECHClientHelloOuter = 0
+
+func sniffMetadataFromTLS(r io.Reader) (*Metadata, error) {
 
 	var recordData bytes.Buffer
 	for {
 		rec, err := dissector.ReadRecord(r)
 		if err != nil {
-			return "", fmt.Errorf("unable to extract SNI from TLS stream: %w", err)
+			return nil, fmt.Errorf("unable to extract SNI from TLS stream: %w", err)
 		}
 		recordData.Write(rec.Opaque)
 
 		var clientHello dissector.ClientHelloHandshake
 		_, err = clientHello.ReadFrom(bytes.NewReader(recordData.Bytes()))
 		if err == nil {
-			for _, ext := range clientHello.Extensions {
-				if sni, ok := ext.(*dissector.ServerNameExtension); ok {
-					return sni.Name, nil
-				}
-			}
-			return "", fmt.Errorf("unable to extract SNI from TLS stream: the SNI extension is absent")
+			return metadataFromClientHello(&clientHello)
 		} else if !(errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)) {
-			return "", fmt.Errorf("unable to extract SNI from TLS stream: %w", err)
+			return nil, fmt.Errorf("unable to extract SNI from TLS stream: %w", err)
+		}
+	}
+}
+
+func metadataFromClientHello(clientHello *dissector.ClientHelloHandshake) (*Metadata, error) {
+	metadata := &Metadata{
+		Protocol:   ProtocolTLS,
+		Strategy:   StrategyNameTLS,
+		TLSVersion: uint16(clientHello.Version),
+		JA3:        ja3(clientHello),
+	}
+	for _, ext := range clientHello.Extensions {
+		if sni, ok := ext.(*dissector.ServerNameExtension); ok && metadata.HostName == "" {
+			metadata.HostName = sni.Name
+		}
+	}
+	if metadata.HostName == "" {
+		return nil, fmt.Errorf("unable to extract SNI from TLS stream: the SNI extension is absent")
+	}
+	var err error
+	if metadata.HostName, err = normalizeHostName(metadata.HostName); err != nil {
+		return nil, fmt.Errorf("invalid SNI: %w", err)
+	}
+	if data, ok := tlsExtensionData(clientHello, tlsExtensionALPN); ok {
+		protocols, _ := tlsVector(data, 2)
+		for len(protocols) > 0 {
+			protocol, ok := tlsVector(protocols, 1)
+			if !ok {
+				break
+			}
+			metadata.ALPN = append(metadata.ALPN, string(protocol))
+			protocols = protocols[1+len(protocol):]
+		}
+	}
+	if data, ok := tlsExtensionData(clientHello, tlsExtensionSupportedVersions); ok {
+		versions, _ := tlsVector(data, 1)
+		for _, version := range tlsUint16s(versions) {
+			if !isGREASE(version) {
+				metadata.TLSVersion = max(metadata.TLSVersion, version)
+			}
+		}
+	}
+	// The inner ClientHello, which only travels encrypted, carries an empty
+	// extension of type inner
+	if data, ok := tlsExtensionData(clientHello, tlsExtensionECH); ok && len(data) > 0 && data[0] == tlsECHClientHelloOuter {
+		metadata.ECH = true
+		metadata.PublicName = metadata.HostName
+	}
+	metadata.JA4 = ja4(clientHello, metadata.TLSVersion, firstOrEmpty(metadata.ALPN))
+	return metadata, nil
+}
+
+func firstOrEmpty(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// tlsExtensionData returns the body of the first extension of the given type.
+func tlsExtensionData(clientHello *dissector.ClientHelloHandshake, extensionType uint16) ([]byte, bool) {
+	i := slices.IndexFunc(clientHello.Extensions, func(ext dissector.Extension) bool {
+		return ext.Type() == extensionType
+	})
+	if i < 0 {
+		return nil, false
+	}
+	// Bytes include the type and length
+	return clientHello.Extensions[i].Bytes()[4:], true
+}
+
+// tlsVector returns the contents of the variable length vector at the start of
+// data, whose length takes lengthSize bytes.
+func tlsVector(data []byte, lengthSize int) ([]byte, bool) {
+	if len(data) < lengthSize {
+		return nil, false
+	}
+	length := 0
+	for _, b := range data[:lengthSize] {
+		length = length<<8 | int(b)
+	}
+	if len(data) < lengthSize+length {
+		return nil, false
+	}
+	return data[lengthSize : lengthSize+length], true
+}
+
+func tlsUint16s(data []byte) []uint16 {
+	values := make([]uint16, 0, len(data)/2)
+	for ; len(data) >= 2; data = data[2:] {
+		values = append(values, binary.BigEndian.Uint16(data))
+	}
+	return values
+}
+
+// isGREASE tells values reserved by RFC 8701, which clients sprinkle among real
+// ones to keep servers tolerant of unknown values.
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// sniffMetadataFromTLSIncremental only parses the ClientHello once all the
+// records carrying it have arrived, and gives up as soon as the data cannot be
+// a TLS handshake.
+func sniffMetadataFromTLSIncremental(data []byte, atEOF bool) (*Metadata, SniffProgress) {
+	needMore := SniffNeedMore
+	if atEOF {
+		needMore = SniffNotMine
+	}
+
+	var handshake []byte
+	for {
+		if len(data) < dissector.RecordHeaderLen {
+			return nil, needMore
+		}
+		if data[0] != dissector.Handshake {
+			return nil, SniffNotMine
+		}
+		length := dissector.RecordHeaderLen + int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < length {
+			return nil, needMore
+		}
+		fragment := data[dissector.RecordHeaderLen:length]
+		data = data[length:]
+		if handshake == nil {
+			// The capacity limit makes the next append copy, rather than
+			// overwrite the following record
+			handshake = fragment[:len(fragment):len(fragment)]
+		} else {
+			handshake = append(handshake, fragment...)
+		}
+
+		if len(handshake) < tlsHandshakeHeaderLen {
+			continue
+		}
+		if handshake[0] != tlsHandshakeTypeClientHello {
+			return nil, SniffNotMine
 		}
+		length = tlsHandshakeHeaderLen + (int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3]))
+		if len(handshake) < length {
+			continue
+		}
+		var clientHello dissector.ClientHelloHandshake
+		if _, err := clientHello.ReadFrom(bytes.NewReader(handshake[:length])); err != nil {
+			return nil, SniffNotMine
+		}
+		if metadata, err := metadataFromClientHello(&clientHello); err == nil {
+			return metadata, SniffFound
+		}
+		return nil, SniffNotMine
 	}
 }
 
-var tlsSingleton = NewSniffStrategyFromInterface(snifferStrategyFunction(sniffHostNameFromTLSSNI))
+var tlsSingleton = NewSniffStrategyFromMetadataInterface(metadataSnifferStrategyFunction(sniffMetadataFromTLS))
 
 func NewTLSSnifferStrategy() *SniffStrategy {
 	return tlsSingleton
 }
+
+var tlsIncrementalSingleton = NewIncrementalSniffStrategyFromInterface(
+	incrementalSniffStrategyFunction(sniffMetadataFromTLSIncremental))
+
+func NewIncrementalTLSSnifferStrategy() *IncrementalSniffStrategy {
+	return tlsIncrementalSingleton
+}
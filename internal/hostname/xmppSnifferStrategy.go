@@ -0,0 +1,79 @@
+package hostname
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const StrategyNameXMPP = "xmpp"
+
+const xmppStreamsNamespace = "http://etherx.jabber.org/streams"
+
+// sniffMetadataFromXMPP reads the stream header sent by XMPP clients, and
+// servers, which names the domain they want to talk to in its to attribute.
+func sniffMetadataFromXMPP(r io.Reader) (*Metadata, error) {
+	br := bufio.NewReader(r)
+	// Anything other than markup cannot be XMPP, and the decoder would keep
+	// reading it as character data
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read XMPP stream header: %w", err)
+		}
+		if c == '<' {
+			break
+		} else if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return nil, fmt.Errorf("not an XMPP stream")
+		}
+	}
+	if err := br.UnreadByte(); err != nil {
+		return nil, err
+	}
+
+	decoder := xml.NewDecoder(br)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read XMPP stream header: %w", err)
+		}
+		switch token := token.(type) {
+		case xml.ProcInst, xml.Comment, xml.CharData:
+			continue
+		case xml.StartElement:
+			if token.Name.Space != xmppStreamsNamespace || token.Name.Local != "stream" {
+				return nil, fmt.Errorf("not an XMPP stream header: %s", token.Name.Local)
+			}
+			for _, attr := range token.Attr {
+				if attr.Name.Space == "" && attr.Name.Local == "to" && attr.Value != "" {
+					metadata := &Metadata{
+						Protocol: ProtocolXMPP,
+						Strategy: StrategyNameXMPP,
+					}
+					var err error
+					if metadata.HostName, metadata.Port, err = parseAuthority(attr.Value); err != nil {
+						return nil, fmt.Errorf("invalid XMPP stream to attribute: %w", err)
+					}
+					return metadata, nil
+				}
+			}
+			return nil, errors.New("XMPP stream header has no to attribute")
+		default:
+			return nil, fmt.Errorf("unexpected XMPP token %T", token)
+		}
+	}
+}
+
+var xmppSingleton = NewSniffStrategyFromMetadataInterface(metadataSnifferStrategyFunction(sniffMetadataFromXMPP))
+
+func NewXMPPSnifferStrategy() *SniffStrategy {
+	return xmppSingleton
+}
+
+var xmppIncrementalSingleton = NewIncrementalSniffStrategyFromReaderStrategy(xmppSingleton)
+
+func NewIncrementalXMPPSnifferStrategy() *IncrementalSniffStrategy {
+	return xmppIncrementalSingleton
+}
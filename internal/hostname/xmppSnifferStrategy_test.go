@@ -0,0 +1,78 @@
+package hostname
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var xmppTestTable = []*testData{
+	// Bad
+	{
+		"Empty request",
+		"",
+		require.Empty, require.Error,
+	},
+	{
+		"HTTP request",
+		"GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n",
+		require.Empty, require.Error,
+	},
+	{
+		"Other XML document",
+		"<?xml version='1.0'?><html to='example.com'>",
+		require.Empty, require.Error,
+	},
+	{
+		"Stream element in another namespace",
+		"<stream:stream xmlns:stream='urn:example:streams' to='example.com'>",
+		require.Empty, require.Error,
+	},
+	{
+		"Stream header without to",
+		"<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>",
+		require.Empty, require.Error,
+	},
+	{
+		"Truncated stream header",
+		"<?xml version='1.0'?><stream:stream xmlns:stream='http://etherx.jabber.org/streams' to='exa",
+		require.Empty, require.Error,
+	},
+	// Good
+	{
+		"Client stream header",
+		"<?xml version='1.0'?><stream:stream to='example.com' xmlns='jabber:client' " +
+			"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>",
+		withExpected("example.com"), require.NoError,
+	},
+	{
+		"Client stream header without XML declaration, with double quotes",
+		"<stream:stream xmlns=\"jabber:client\" xmlns:stream=\"http://etherx.jabber.org/streams\" " +
+			"to=\"example.com\" version=\"1.0\">",
+		withExpected("example.com"), require.NoError,
+	},
+	{
+		"Server stream header after whitespace",
+		"\r\n <?xml version='1.0'?>\n<stream:stream from='example.net' to='example.com' xmlns='jabber:server' " +
+			"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>",
+		withExpected("example.com"), require.NoError,
+	},
+}
+
+func TestXMPPSniffStrategy(t *testing.T) {
+	for _, test := range xmppTestTable {
+		t.Run(test.Description, func(t *testing.T) {
+			strategy := NewXMPPSnifferStrategy()
+			hostName, err := strategy.SniffHostName(test.ReaderForRequest())
+			test.ErrorCheck(t, err)
+			test.HostnameCheck(t, hostName)
+		})
+	}
+}
+
+func TestXMPPMetadata(t *testing.T) {
+	metadata, err := NewXMPPSnifferStrategy().SniffMetadata(bytes.NewReader([]byte(xmppTestTable[len(xmppTestTable)-1].Request)))
+	require.NoError(t, err)
+	require.Equal(t, &Metadata{Protocol: ProtocolXMPP, Strategy: "xmpp", HostName: "example.com"}, metadata)
+}
@@ -0,0 +1,91 @@
+// Package ratelimit implements token buckets, used to limit how often events
+// happen.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket holds up to burst tokens and is refilled at a constant rate of
+// tokens per second. It is safe for concurrent use.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewTokenBucket returns a full bucket.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return newTokenBucketWithClock(rate, burst, time.Now)
+}
+
+func newTokenBucketWithClock(rate float64, burst int, now func() time.Time) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now(),
+		now:    now,
+	}
+}
+
+// refill must be called with the lock held.
+func (b *TokenBucket) refill() time.Time {
+	now := b.now()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	return now
+}
+
+// Allow takes a token if one is available.
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// AllowN takes n tokens if they are all available.
+func (b *TokenBucket) AllowN(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Full reports whether the bucket has been refilled completely, meaning that
+// it is indistinguishable from a new one.
+func (b *TokenBucket) Full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+// Reserve takes n tokens, even if they are not available yet, and returns how
+// long the caller must wait before the bucket is out of debt.
+func (b *TokenBucket) Reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Burst returns the maximum number of tokens the bucket can hold.
+func (b *TokenBucket) Burst() int {
+	return int(b.burst)
+}
@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestTokenBucketBurstAndRefill(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 0)}
+	bucket := newTokenBucketWithClock(2, 3, clock.Now)
+
+	require.True(t, bucket.Full())
+	for range 3 {
+		require.True(t, bucket.Allow())
+	}
+	require.False(t, bucket.Allow())
+	require.False(t, bucket.Full())
+
+	clock.Advance(250 * time.Millisecond)
+	require.False(t, bucket.Allow())
+	clock.Advance(250 * time.Millisecond)
+	require.True(t, bucket.Allow())
+	require.False(t, bucket.Allow())
+
+	// Refill never exceeds the burst
+	clock.Advance(time.Hour)
+	require.True(t, bucket.Full())
+	require.True(t, bucket.AllowN(3))
+	require.False(t, bucket.Allow())
+}
+
+func TestTokenBucketAllowNIsAllOrNothing(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 0)}
+	bucket := newTokenBucketWithClock(1, 4, clock.Now)
+
+	require.False(t, bucket.AllowN(5))
+	require.True(t, bucket.AllowN(4))
+}
+
+func TestTokenBucketMinimumBurst(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 0)}
+	bucket := newTokenBucketWithClock(1, 0, clock.Now)
+
+	require.True(t, bucket.Allow())
+	require.False(t, bucket.Allow())
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	clock := &fakeClock{time.Unix(0, 0)}
+	bucket := newTokenBucketWithClock(1000, 500, clock.Now)
+
+	require.Equal(t, 500, bucket.Burst())
+	require.Zero(t, bucket.Reserve(500))
+	require.Equal(t, 250*time.Millisecond, bucket.Reserve(250))
+	// Debt accumulates
+	require.Equal(t, 500*time.Millisecond, bucket.Reserve(250))
+	require.False(t, bucket.Allow())
+
+	clock.Advance(500 * time.Millisecond)
+	require.Zero(t, bucket.Reserve(0))
+	require.False(t, bucket.Allow())
+	clock.Advance(time.Millisecond)
+	require.True(t, bucket.Allow())
+}
@@ -0,0 +1,246 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Timeout for a single query to a single server
+const dnsQueryTimeout = 2 * time.Second
+
+var errTruncated = errors.New("truncated DNS response")
+
+// dnsClient sends A and AAAA queries straight to the configured name servers,
+// falling back to the system resolver when that does not work.
+type dnsClient struct {
+	confPath string
+	// Overrides the port, for tests
+	port   string
+	system func(ctx context.Context, host string) ([]netip.Addr, error)
+}
+
+func newDNSClient(confPath string) *dnsClient {
+	return &dnsClient{
+		confPath: confPath,
+		port:     "53",
+		system: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+	}
+}
+
+// servers returns the name servers listed in the resolver configuration. It is
+// read on every lookup, as lookups only happen when the cache expires.
+func (client *dnsClient) servers() []string {
+	f, err := os.Open(client.confPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if _, err := netip.ParseAddr(fields[1]); err == nil {
+				servers = append(servers, net.JoinHostPort(fields[1], client.port))
+			}
+		}
+	}
+	return servers
+}
+
+func (client *dnsClient) lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	servers := client.servers()
+	// Names without dots may be subject to search domains, leave them to the
+	// system resolver
+	if len(servers) > 0 && strings.Contains(strings.TrimSuffix(host, "."), ".") {
+		addrs, ttl, err := client.query(ctx, servers, host)
+		if err == nil && len(addrs) > 0 {
+			return addrs, ttl, nil
+		}
+	}
+	addrs, err := client.system(ctx, host)
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs, 0, err
+}
+
+// query looks up A and AAAA records in parallel. The returned TTL is the
+// lowest among all records in both answers.
+func (client *dnsClient) query(ctx context.Context, servers []string, host string) ([]netip.Addr, time.Duration, error) {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	type answer struct {
+		addrs []netip.Addr
+		ttl   uint32
+		err   error
+	}
+	// AAAA first: the answers are merged in this order, whichever arrives
+	// first, so that IPv6 addresses come first, as RFC 8305 recommends
+	types := []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	answers := make([]answer, len(types))
+	var wg sync.WaitGroup
+	for i, qtype := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := &answers[i]
+			a.addrs, a.ttl, a.err = client.exchange(ctx, servers, name, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	var errs []error
+	ttl := ^uint32(0)
+	for _, a := range answers {
+		if a.err != nil {
+			errs = append(errs, a.err)
+			continue
+		}
+		addrs = append(addrs, a.addrs...)
+		if len(a.addrs) > 0 {
+			ttl = min(ttl, a.ttl)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, errors.Join(errs...)
+	}
+	// A zero TTL means the fallback TTL to callers, so never go below 1s
+	return addrs, max(time.Duration(ttl)*time.Second, time.Second), nil
+}
+
+// exchange tries servers in order until one answers.
+func (client *dnsClient) exchange(ctx context.Context, servers []string, name dnsmessage.Name, qtype dnsmessage.Type) ([]netip.Addr, uint32, error) {
+	var err error
+	for _, server := range servers {
+		var addrs []netip.Addr
+		var ttl uint32
+		if addrs, ttl, err = client.exchangeWith(ctx, server, name, qtype); err == nil {
+			return addrs, ttl, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, err
+}
+
+func (client *dnsClient) exchangeWith(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) ([]netip.Addr, uint32, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+
+	id := uint16(rand.Uint32())
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		addrs, ttl, err := parseResponse(buf[:n], id, name, qtype)
+		if errors.Is(err, errUnrelatedResponse) {
+			continue
+		}
+		return addrs, ttl, err
+	}
+}
+
+var errUnrelatedResponse = errors.New("unrelated DNS response")
+
+// parseResponse extracts the addresses of type qtype from a response, together
+// with the lowest TTL of the records in the answer section, including CNAMEs.
+func parseResponse(msg []byte, id uint16, name dnsmessage.Name, qtype dnsmessage.Type) ([]netip.Addr, uint32, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.ID != id || !header.Response {
+		return nil, 0, errUnrelatedResponse
+	}
+	question, err := p.Question()
+	if err != nil || question.Type != qtype || !strings.EqualFold(question.Name.String(), name.String()) {
+		return nil, 0, errUnrelatedResponse
+	}
+	if header.Truncated {
+		return nil, 0, errTruncated
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("DNS query for %s returned %s", name, header.RCode)
+	}
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var addrs []netip.Addr
+	ttl := ^uint32(0)
+	for {
+		h, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = min(ttl, h.TTL)
+		switch {
+		case h.Class != dnsmessage.ClassINET || h.Type != qtype:
+			err = p.SkipAnswer()
+		case qtype == dnsmessage.TypeA:
+			var r dnsmessage.AResource
+			if r, err = p.AResource(); err == nil {
+				addrs = append(addrs, netip.AddrFrom4(r.A))
+			}
+		case qtype == dnsmessage.TypeAAAA:
+			var r dnsmessage.AAAAResource
+			if r, err = p.AAAAResource(); err == nil {
+				addrs = append(addrs, netip.AddrFrom16(r.AAAA).Unmap())
+			}
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return addrs, ttl, nil
+}
@@ -0,0 +1,176 @@
+// Package resolver looks up the addresses of hosts, caching answers for as
+// long as their DNS TTL allows.
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultFallbackTTL is how long answers are cached when their TTL is
+	// unknown, because they came from the system resolver.
+	DefaultFallbackTTL = 30 * time.Second
+	// DefaultNegativeTTL is how long failed lookups are cached.
+	DefaultNegativeTTL = 5 * time.Second
+	// DefaultMaxTTL caps the TTL of DNS answers.
+	DefaultMaxTTL = time.Hour
+)
+
+// Expired entries are dropped when the cache grows beyond this size
+const cacheSweepThreshold = 1024
+
+// lookupFunc returns the addresses of host and how long they may be cached. A
+// zero TTL selects the fallback TTL.
+type lookupFunc func(ctx context.Context, host string) ([]netip.Addr, time.Duration, error)
+
+type cacheEntry struct {
+	// Closed once the lookup filling this entry is done
+	ready   chan struct{}
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+// Resolver caches host addresses. It is safe for concurrent use.
+type Resolver struct {
+	lookup      lookupFunc
+	now         func() time.Time
+	fallbackTTL time.Duration
+	negativeTTL time.Duration
+	maxTTL      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+}
+
+type Option func(resolver *Resolver)
+
+// WithFallbackTTL sets how long answers with an unknown TTL are cached.
+func WithFallbackTTL(ttl time.Duration) Option {
+	return func(resolver *Resolver) {
+		if ttl > 0 {
+			resolver.fallbackTTL = ttl
+		}
+	}
+}
+
+// WithMaxTTL caps the TTL of DNS answers.
+func WithMaxTTL(ttl time.Duration) Option {
+	return func(resolver *Resolver) {
+		if ttl > 0 {
+			resolver.maxTTL = ttl
+		}
+	}
+}
+
+// New returns a Resolver which queries the name servers listed in
+// /etc/resolv.conf directly, to learn the TTL of the answers. Names which are
+// not fully qualified, cannot be found in DNS or cannot be resolved that way
+// are looked up via the system resolver, so that /etc/hosts and search domains
+// still work.
+func New(opts ...Option) *Resolver {
+	return newWithLookup(newDNSClient("/etc/resolv.conf").lookup, time.Now, opts...)
+}
+
+func newWithLookup(lookup lookupFunc, now func() time.Time, opts ...Option) *Resolver {
+	resolver := &Resolver{
+		lookup:      lookup,
+		now:         now,
+		fallbackTTL: DefaultFallbackTTL,
+		negativeTTL: DefaultNegativeTTL,
+		maxTTL:      DefaultMaxTTL,
+		cache:       make(map[string]*cacheEntry),
+	}
+	for _, opt := range opts {
+		opt(resolver)
+	}
+	return resolver
+}
+
+// LookupNetIP returns the addresses of host, which can also be an IP literal.
+// Concurrent lookups of the same host are merged. If refreshing an expired
+// answer fails, the stale one keeps being used for the negative TTL.
+func (resolver *Resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+
+	resolver.mu.Lock()
+	entry := resolver.cache[host]
+	if entry != nil {
+		select {
+		case <-entry.ready:
+			if resolver.now().Before(entry.expires) {
+				resolver.mu.Unlock()
+				return entry.addrs, entry.err
+			}
+		default:
+			// Someone else is already looking host up
+			resolver.mu.Unlock()
+			return resolver.wait(ctx, entry)
+		}
+	}
+	stale := entry
+	entry = &cacheEntry{ready: make(chan struct{})}
+	resolver.cache[host] = entry
+	if len(resolver.cache) > cacheSweepThreshold {
+		resolver.sweep()
+	}
+	resolver.mu.Unlock()
+
+	// The lookup must not be bound to the first caller's context, since others
+	// may be waiting for it
+	go resolver.fill(host, entry, stale)
+	return resolver.wait(ctx, entry)
+}
+
+// sweep drops expired entries. It must be called with the lock held.
+func (resolver *Resolver) sweep() {
+	now := resolver.now()
+	for host, entry := range resolver.cache {
+		select {
+		case <-entry.ready:
+			if !now.Before(entry.expires) {
+				delete(resolver.cache, host)
+			}
+		default:
+		}
+	}
+}
+
+func (resolver *Resolver) wait(ctx context.Context, entry *cacheEntry) ([]netip.Addr, error) {
+	select {
+	case <-entry.ready:
+		return entry.addrs, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (resolver *Resolver) fill(host string, entry, stale *cacheEntry) {
+	const lookupTimeout = 30 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	addrs, ttl, err := resolver.lookup(ctx, host)
+	switch {
+	case err == nil && len(addrs) == 0:
+		err = &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+		fallthrough
+	case err != nil:
+		ttl = resolver.negativeTTL
+		if stale != nil && stale.err == nil {
+			addrs, err = stale.addrs, nil
+		}
+	case ttl <= 0:
+		ttl = resolver.fallbackTTL
+	}
+	entry.addrs = addrs
+	entry.err = err
+	entry.expires = resolver.now().Add(min(ttl, resolver.maxTTL))
+	close(entry.ready)
+}
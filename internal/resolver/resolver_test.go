@@ -0,0 +1,263 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+// fakeLookup returns the configured answer and counts calls.
+type fakeLookup struct {
+	addrs []netip.Addr
+	ttl   time.Duration
+	err   error
+	calls atomic.Int32
+	// If not nil, lookups block until it is closed
+	block chan struct{}
+}
+
+func (lookup *fakeLookup) lookup(context.Context, string) ([]netip.Addr, time.Duration, error) {
+	lookup.calls.Add(1)
+	if lookup.block != nil {
+		<-lookup.block
+	}
+	return lookup.addrs, lookup.ttl, lookup.err
+}
+
+var testAddrs = []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.1")}
+
+func TestCacheHonoursTTL(t *testing.T) {
+	clock := &fakeClock{time.Unix(1700000000, 0)}
+	lookup := &fakeLookup{addrs: testAddrs, ttl: 10 * time.Second}
+	resolver := newWithLookup(lookup.lookup, clock.Now)
+
+	for range 3 {
+		addrs, err := resolver.LookupNetIP(context.Background(), "proxy.example")
+		require.NoError(t, err)
+		require.Equal(t, testAddrs, addrs)
+	}
+	require.EqualValues(t, 1, lookup.calls.Load())
+
+	clock.now = clock.now.Add(10 * time.Second)
+	_, err := resolver.LookupNetIP(context.Background(), "proxy.example")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, lookup.calls.Load())
+}
+
+func TestCacheTTLBounds(t *testing.T) {
+	tests := []struct {
+		Description string
+		TTL         time.Duration
+		Expected    time.Duration
+	}{
+		{"Unknown TTL", 0, DefaultFallbackTTL},
+		{"Capped TTL", 48 * time.Hour, DefaultMaxTTL},
+	}
+	for _, test := range tests {
+		t.Run(test.Description, func(t *testing.T) {
+			clock := &fakeClock{time.Unix(1700000000, 0)}
+			lookup := &fakeLookup{addrs: testAddrs, ttl: test.TTL}
+			resolver := newWithLookup(lookup.lookup, clock.Now)
+
+			_, _ = resolver.LookupNetIP(context.Background(), "proxy.example")
+			clock.now = clock.now.Add(test.Expected - time.Nanosecond)
+			_, _ = resolver.LookupNetIP(context.Background(), "proxy.example")
+			require.EqualValues(t, 1, lookup.calls.Load())
+			clock.now = clock.now.Add(time.Nanosecond)
+			_, _ = resolver.LookupNetIP(context.Background(), "proxy.example")
+			require.EqualValues(t, 2, lookup.calls.Load())
+		})
+	}
+}
+
+func TestFailuresAreCachedAndStaleAnswersKept(t *testing.T) {
+	clock := &fakeClock{time.Unix(1700000000, 0)}
+	lookup := &fakeLookup{err: errors.New("SERVFAIL")}
+	resolver := newWithLookup(lookup.lookup, clock.Now)
+
+	_, err := resolver.LookupNetIP(context.Background(), "proxy.example")
+	require.Error(t, err)
+	_, err = resolver.LookupNetIP(context.Background(), "proxy.example")
+	require.Error(t, err)
+	require.EqualValues(t, 1, lookup.calls.Load())
+
+	clock.now = clock.now.Add(DefaultNegativeTTL)
+	lookup.addrs, lookup.ttl, lookup.err = testAddrs, time.Minute, nil
+	addrs, err := resolver.LookupNetIP(context.Background(), "proxy.example")
+	require.NoError(t, err)
+	require.Equal(t, testAddrs, addrs)
+
+	clock.now = clock.now.Add(time.Minute)
+	lookup.addrs, lookup.err = nil, errors.New("SERVFAIL")
+	addrs, err = resolver.LookupNetIP(context.Background(), "proxy.example")
+	require.NoError(t, err)
+	require.Equal(t, testAddrs, addrs)
+}
+
+func TestConcurrentLookupsAreMerged(t *testing.T) {
+	lookup := &fakeLookup{addrs: testAddrs, ttl: time.Minute, block: make(chan struct{})}
+	resolver := newWithLookup(lookup.lookup, time.Now)
+
+	results := make(chan error)
+	for range 5 {
+		go func() {
+			_, err := resolver.LookupNetIP(context.Background(), "proxy.example")
+			results <- err
+		}()
+	}
+	require.Eventually(t, func() bool { return lookup.calls.Load() == 1 }, time.Second, time.Millisecond)
+	close(lookup.block)
+	for range 5 {
+		require.NoError(t, <-results)
+	}
+	require.EqualValues(t, 1, lookup.calls.Load())
+}
+
+func TestIPLiteralsAreNotLookedUp(t *testing.T) {
+	lookup := &fakeLookup{}
+	resolver := newWithLookup(lookup.lookup, time.Now)
+	addrs, err := resolver.LookupNetIP(context.Background(), "::ffff:192.0.2.1")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, addrs)
+	require.Zero(t, lookup.calls.Load())
+}
+
+type testRecord struct {
+	Type  dnsmessage.Type
+	TTL   uint32
+	Value string
+}
+
+// serveDNS answers queries for any name with the records of the requested
+// type, plus a CNAME, on a local UDP socket.
+func serveDNS(t *testing.T, records []testRecord) string {
+	return serveDNSWithDelays(t, records, nil)
+}
+
+// serveDNSWithDelays is like serveDNS, delaying the answers to queries of some
+// types.
+func serveDNSWithDelays(t *testing.T, records []testRecord, delays map[dnsmessage.Type]time.Duration) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil {
+				continue
+			}
+			q := query.Questions[0]
+			response := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+				Questions: query.Questions,
+			}
+			target := dnsmessage.MustNewName("target.example.")
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.CNAMEResource{CNAME: target},
+			})
+			for _, record := range records {
+				if record.Type != q.Type {
+					continue
+				}
+				header := dnsmessage.ResourceHeader{Name: target, Type: record.Type, Class: dnsmessage.ClassINET, TTL: record.TTL}
+				addr := netip.MustParseAddr(record.Value)
+				if record.Type == dnsmessage.TypeA {
+					response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+				} else {
+					response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+				}
+			}
+			packed, err := response.Pack()
+			if err == nil {
+				time.AfterFunc(delays[q.Type], func() {
+					_, _ = conn.WriteTo(packed, addr)
+				})
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func newTestDNSClient(t *testing.T, server string) *dnsClient {
+	host, port, err := net.SplitHostPort(server)
+	require.NoError(t, err)
+	confPath := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(confPath, []byte("search example\nnameserver "+host+"\n"), 0o644))
+	client := newDNSClient(confPath)
+	client.port = port
+	client.system = func(context.Context, string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("::ffff:198.51.100.1")}, nil
+	}
+	return client
+}
+
+func TestDNSLookup(t *testing.T) {
+	server := serveDNS(t, []testRecord{
+		{dnsmessage.TypeA, 60, "192.0.2.1"},
+		{dnsmessage.TypeA, 30, "192.0.2.2"},
+		{dnsmessage.TypeAAAA, 120, "2001:db8::1"},
+	})
+	client := newTestDNSClient(t, server)
+
+	addrs, ttl, err := client.lookup(context.Background(), "proxy.example")
+	require.NoError(t, err)
+	require.Equal(t, parseAddrs(t, "2001:db8::1", "192.0.2.1", "192.0.2.2"), addrs)
+	require.Equal(t, 30*time.Second, ttl)
+}
+
+func TestDNSLookupPutsIPv6First(t *testing.T) {
+	// The AAAA answer arrives last
+	server := serveDNSWithDelays(t, []testRecord{
+		{dnsmessage.TypeA, 60, "192.0.2.1"},
+		{dnsmessage.TypeAAAA, 60, "2001:db8::1"},
+	}, map[dnsmessage.Type]time.Duration{dnsmessage.TypeAAAA: 100 * time.Millisecond})
+	client := newTestDNSClient(t, server)
+
+	addrs, _, err := client.lookup(context.Background(), "proxy.example")
+	require.NoError(t, err)
+	require.Equal(t, parseAddrs(t, "2001:db8::1", "192.0.2.1"), addrs)
+}
+
+func TestDNSLookupFallsBackToSystemResolver(t *testing.T) {
+	client := newTestDNSClient(t, serveDNS(t, nil))
+
+	for _, host := range []string{"proxy.example", "proxy"} {
+		addrs, ttl, err := client.lookup(context.Background(), host)
+		require.NoError(t, err)
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("198.51.100.1")}, addrs)
+		require.Zero(t, ttl)
+	}
+}
+
+func parseAddrs(t *testing.T, s ...string) []netip.Addr {
+	t.Helper()
+	var result []netip.Addr
+	for _, a := range s {
+		result = append(result, netip.MustParseAddr(a))
+	}
+	return result
+}